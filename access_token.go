@@ -1,12 +1,30 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"log"
 	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultRefreshTTL    = 60 * 24 * time.Hour
+	defaultSweepInterval = time.Hour
 )
 
-func createRefreshToken(userID int) (DB_Refr_Token, error) {
+// Refresh tokens are stored as their SHA-256, so a copy of the database can't be used to log in.
+// The tokens are random, so unlike passwords a fast unsalted hash is enough.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func createRefreshToken(userID int, ttl time.Duration) (DB_Refr_Token, error) {
 	randArr := make([]byte, 32)
 	_, err := rand.Read(randArr)
 	if err != nil {
@@ -14,9 +32,155 @@ func createRefreshToken(userID int) (DB_Refr_Token, error) {
 	}
 
 	refrToken := DB_Refr_Token{
-		ID: userID,
-		Expiry_Time:   time.Now().Add(time.Duration(60) * 24 * time.Duration(time.Hour)),
+		ID:            userID,
+		Expiry_Time:   time.Now().Add(ttl),
 		Refresh_Token: hex.EncodeToString(randArr),
 	}
+	refrToken.Token_Hash = hashRefreshToken(refrToken.Refresh_Token)
 	return refrToken, nil
 }
+
+// A new refresh token for the user in the given family, used from dev
+func (apicfg *apiConfig) newRefreshToken(userID int, familyID string, dev device) (DB_Refr_Token, error) {
+	newRefrToken, err := createRefreshToken(userID, apicfg.refreshTTL)
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	now := time.Now().UTC()
+
+	newRefrToken.Family_ID = familyID
+	newRefrToken.User_Agent = dev.User_Agent
+	newRefrToken.IP = dev.IP
+	newRefrToken.Created_At = now
+	newRefrToken.Last_Used_At = now
+
+	return newRefrToken, nil
+}
+
+// Logging in starts a new family of refresh tokens, which is the session on that device
+func (apicfg *apiConfig) makeAndStoreRefreshToken(userID int, dev device) (DB_Refr_Token, error) {
+	newRefrToken, err := apicfg.newRefreshToken(userID, uuid.NewString(), dev)
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	err = apicfg.db.appendDBRefrToken(newRefrToken)
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	return newRefrToken, nil
+}
+
+// Logs out the refresh token in the header. That ends its whole family,
+// including the tokens it was rotated from.
+func (apicfg *apiConfig) findAndDeleteRefrToken(header string) error {
+	if len(header) < 7 {
+		return errors.New("no header found")
+	}
+
+	refrToken, err := apicfg.db.getRefrByHash(hashRefreshToken(header[7:]))
+
+	if err != nil {
+		return err
+	}
+
+	// Left for the sweeper, it can't be used anyway
+	if !time.Now().Before(refrToken.Expiry_Time) {
+		return errTokenNotFound
+	}
+
+	if err := apicfg.db.revokeRefrFamily(refrToken.Family_ID); err != nil {
+		return err
+	}
+
+	if refrToken.Rotated_At != nil {
+		return errTokenReused
+	}
+
+	return nil
+}
+
+// Swaps a refresh token for a new one in the same family. A token that was
+// already swapped being presented again means someone has a copy of it, so the
+// whole family is revoked and the user has to log in again.
+func (apicfg *apiConfig) rotateRefreshToken(refr_token_string_with_bearer string, dev device) (DB_Refr_Token, error) {
+	if len(refr_token_string_with_bearer) < 7 {
+		return DB_Refr_Token{}, errors.New("no header found")
+	}
+
+	refr_token_string := refr_token_string_with_bearer[7:]
+
+	refrToken, err := apicfg.db.getRefrByHash(hashRefreshToken(refr_token_string))
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	if refrToken.Rotated_At != nil {
+		return DB_Refr_Token{}, apicfg.revokeReusedFamily(refrToken)
+	}
+
+	if !time.Now().Before(refrToken.Expiry_Time) {
+		return DB_Refr_Token{}, errors.New("refresh token expired")
+	}
+
+	next, err := apicfg.newRefreshToken(refrToken.ID, refrToken.Family_ID, dev)
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	// Still the same session
+	next.Created_At = refrToken.Created_At
+
+	err = apicfg.db.rotateRefrToken(refrToken.Token_Hash, next)
+
+	// Another request rotated it first, one of them is using a copy
+	if errors.Is(err, errTokenReused) {
+		return DB_Refr_Token{}, apicfg.revokeReusedFamily(refrToken)
+	}
+
+	if err != nil {
+		return DB_Refr_Token{}, err
+	}
+
+	return next, nil
+}
+
+func (apicfg *apiConfig) revokeReusedFamily(refrToken DB_Refr_Token) error {
+	if err := apicfg.db.revokeRefrFamily(refrToken.Family_ID); err != nil {
+		return err
+	}
+
+	log.Printf("Refresh token reused for user %d, revoked its family", refrToken.ID)
+
+	return errTokenReused
+}
+
+// Removes expired refresh tokens from storage every interval, until ctx is cancelled
+func (apicfg *apiConfig) runRefreshTokenSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		swept, err := apicfg.db.purgeExpiredRefrTokens(time.Now())
+
+		if err != nil {
+			log.Println("Error sweeping expired refresh tokens:", err)
+		} else if swept > 0 {
+			apicfg.refreshTokensSwept.Add(int64(swept))
+			log.Printf("Swept %d expired refresh tokens", swept)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
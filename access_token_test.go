@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func refresh(t *testing.T, handler http.Handler, refrToken string) (int, refreshResponse) {
+	t.Helper()
+
+	resp := refreshResponse{}
+	code := doRequest(t, handler, http.MethodPost, "/api/refresh", refrToken, nil, &resp)
+
+	return code, resp
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			apicfg := newTestAPI(t, db)
+			handler := apicfg.routes()
+
+			stolen := signup(t, handler, "user@example.com")
+			other := login(t, handler, "user@example.com")
+
+			// Rotated twice, so the family is three tokens long
+			family := []string{stolen.Refresh_Token}
+			access := stolen.Token
+
+			for i := 0; i < 2; i++ {
+				code, resp := refresh(t, handler, family[len(family)-1])
+
+				if code != http.StatusOK {
+					t.Fatalf("rotation %d: %d", i, code)
+				}
+
+				family = append(family, resp.Refresh_Token)
+				access = resp.Token
+			}
+
+			// The first token turning up again means someone kept a copy
+			resp := errResponse{}
+
+			if code := doRequest(t, handler, http.MethodPost, "/api/refresh", family[0], nil, &resp); code != http.StatusUnauthorized || resp.Error != errTokenReused.Error() {
+				t.Errorf("reusing the first token: got %d %+v, want 401 %q", code, resp, errTokenReused)
+			}
+
+			// That ends every token in the family, including the one in use
+			for i, token := range family {
+				if code, _ := refresh(t, handler, token); code != http.StatusUnauthorized {
+					t.Errorf("token %d after the reuse: got %d, want 401", i, code)
+				}
+			}
+
+			if code := doRequest(t, handler, http.MethodGet, "/api/sessions", access, nil, nil); code != http.StatusUnauthorized {
+				t.Errorf("access token from the revoked family: got %d, want 401", code)
+			}
+
+			// Another login is a different family, it's left alone
+			code, rotated := refresh(t, handler, other.Refresh_Token)
+
+			if code != http.StatusOK {
+				t.Fatalf("other session: got %d, want 200", code)
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				for i, token := range family {
+					if _, err := store.getRefrByHash(hashRefreshToken(token)); err != errTokenNotFound {
+						t.Errorf("token %d is still stored: %v", i, err)
+					}
+				}
+
+				if _, err := store.getRefrByHash(hashRefreshToken(rotated.Refresh_Token)); err != nil {
+					t.Errorf("other session's token: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentRefreshReuse(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+			apicfg := newTestAPI(t, db)
+			handler := apicfg.routes()
+
+			first := signup(t, handler, "user@example.com")
+			header := "Bearer " + first.Refresh_Token
+
+			rotated := atomic.Int64{}
+			refused := atomic.Int64{}
+			next := make(chan DB_Refr_Token, stressWorkers)
+
+			// Every worker presents the same token at once, only one can rotate it
+			runConcurrently(t, func(i int) error {
+				token, err := apicfg.rotateRefreshToken(header, device{})
+
+				// Workers that get there after the family was revoked find nothing
+				if err == errTokenReused || err == errTokenNotFound {
+					refused.Add(1)
+					return nil
+				}
+
+				if err != nil {
+					return err
+				}
+
+				rotated.Add(1)
+				next <- token
+
+				return nil
+			})
+
+			close(next)
+
+			if rotated.Load() != 1 || refused.Load() != stressWorkers-1 {
+				t.Fatalf("%d rotated and %d refused, want 1 and %d", rotated.Load(), refused.Load(), stressWorkers-1)
+			}
+
+			// The losers revoked the family, so even the winner's token is gone
+			winner := <-next
+
+			if _, err := db.getRefrByHash(winner.Token_Hash); err != errTokenNotFound {
+				t.Errorf("winning token after the reuse: %v", err)
+			}
+
+			if _, err := db.getSession(winner.Family_ID); err != errTokenNotFound {
+				t.Errorf("session after the reuse: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoresRotateTokensOnce(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+			now := time.Now().UTC()
+
+			first := DB_Refr_Token{ID: 1, Expiry_Time: now.Add(time.Hour), Token_Hash: "first", Family_ID: "family", Created_At: now, Last_Used_At: now}
+
+			if err := db.appendDBRefrToken(first); err != nil {
+				t.Fatal(err)
+			}
+
+			second := first
+			second.Token_Hash = "second"
+
+			if err := db.rotateRefrToken("first", second); err != nil {
+				t.Fatal(err)
+			}
+
+			third := first
+			third.Token_Hash = "third"
+
+			if err := db.rotateRefrToken("first", third); err != errTokenReused {
+				t.Errorf("rotating the same token again: got %v, want errTokenReused", err)
+			}
+
+			// The failed rotation stored nothing
+			if _, err := db.getRefrByHash("third"); err != errTokenNotFound {
+				t.Errorf("token from the failed rotation: %v", err)
+			}
+
+			stored, err := db.getRefrByHash("first")
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if stored.Rotated_At == nil {
+				t.Errorf("rotated token isn't marked as rotated")
+			}
+		})
+	}
+}
+
+func TestLogoutWithReusedTokenRevokesFamily(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	first := signup(t, handler, "user@example.com")
+
+	code, current := refresh(t, handler, first.Refresh_Token)
+
+	if code != http.StatusOK {
+		t.Fatalf("rotating: %d", code)
+	}
+
+	// Logging out with the old copy still logs the session out, but says why
+	resp := errResponse{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/revoke", first.Refresh_Token, nil, &resp); code != http.StatusUnauthorized || resp.Error != errTokenReused.Error() {
+		t.Errorf("revoking the old token: got %d %+v, want 401 %q", code, resp, errTokenReused)
+	}
+
+	if code, _ := refresh(t, handler, current.Refresh_Token); code != http.StatusUnauthorized {
+		t.Errorf("current token after the old one was revoked: got %d, want 401", code)
+	}
+}
+
+func TestStoresPurgeExpiredTokens(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			now := time.Now().UTC().Truncate(time.Second)
+
+			expiries := map[string]time.Duration{
+				"long-gone": -30 * 24 * time.Hour,
+				"just-gone": -time.Second,
+				"at-cutoff": 0,
+				"live":      time.Hour,
+				"rotated":   time.Minute,
+				"stale":     -2 * time.Hour,
+			}
+
+			for hash, expiry := range expiries {
+				token := DB_Refr_Token{ID: 1, Expiry_Time: now.Add(expiry), Token_Hash: hash, Family_ID: hash, Created_At: now, Last_Used_At: now}
+
+				if err := db.appendDBRefrToken(token); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Rotated tokens are kept to catch reuse for as long as their family lives,
+			// and swept with it
+			rotations := map[string]time.Duration{"rotated": 2 * time.Hour, "stale": -time.Hour}
+
+			for hash, expiry := range rotations {
+				next := DB_Refr_Token{ID: 1, Expiry_Time: now.Add(expiry), Token_Hash: hash + "-next", Family_ID: hash, Created_At: now, Last_Used_At: now}
+
+				if err := db.rotateRefrToken(hash, next); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			swept, err := db.purgeExpiredRefrTokens(now)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if swept != 4 {
+				t.Errorf("swept %d tokens, want 4", swept)
+			}
+
+			if swept, err := db.purgeExpiredRefrTokens(now); err != nil || swept != 0 {
+				t.Errorf("sweeping again: %d, %v", swept, err)
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				for hash, kept := range map[string]bool{
+					"long-gone": false, "just-gone": false, "stale": false, "stale-next": false,
+					"at-cutoff": true, "live": true, "rotated": true, "rotated-next": true,
+				} {
+					if _, err := store.getRefrByHash(hash); (err == nil) != kept {
+						t.Errorf("%s: got %v, want kept %t", hash, err, kept)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRefreshTokenSweeper(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	admin := signup(t, handler, "admin@example.com")
+
+	if _, err := grantAdmin(apicfg.db, admin.UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	expire := func(hashes ...string) {
+		t.Helper()
+
+		for _, hash := range hashes {
+			token := DB_Refr_Token{ID: 1, Expiry_Time: time.Now().Add(-time.Minute), Token_Hash: hash, Family_ID: hash}
+
+			if err := apicfg.db.appendDBRefrToken(token); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	waitForSwept := func(want int64) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for apicfg.refreshTokensSwept.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("swept count is %d, want %d", apicfg.refreshTokensSwept.Load(), want)
+			}
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	expire("a", "b", "c")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		apicfg.runRefreshTokenSweeper(ctx, 20*time.Millisecond)
+		close(done)
+	}()
+
+	// The first pass runs straight away, later ones add to the count
+	waitForSwept(3)
+	expire("d", "e")
+	waitForSwept(5)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+	req.Header.Set("Authorization", "Bearer "+admin.Token)
+	handler.ServeHTTP(rec, req)
+
+	if !strings.Contains(rec.Body.String(), "Refresh tokens swept: 5") {
+		t.Errorf("metrics: %q", rec.Body.String())
+	}
+
+	// The user's own token hasn't expired, so it's left alone
+	if _, err := apicfg.db.getRefrByHash(hashRefreshToken(admin.Refresh_Token)); err != nil {
+		t.Errorf("live token: %v", err)
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeper didn't stop after its context was cancelled")
+	}
+
+	// Nothing is swept once it's stopped
+	expire("f")
+	time.Sleep(100 * time.Millisecond)
+
+	if _, err := apicfg.db.getRefrByHash("f"); err != nil {
+		t.Errorf("token expired after shutdown: %v", err)
+	}
+
+	if swept := apicfg.refreshTokensSwept.Load(); swept != 5 {
+		t.Errorf("swept count after shutdown is %d, want 5", swept)
+	}
+}
@@ -1,13 +1,37 @@
 package main
 
 import (
+	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 type apiConfig struct {
 	fileserverHits int
 	jwtSecret      string
+	jwtKeys        *keyRing
 	polkaApiKey    string
+	db             Store
+	search         *searchIndex
+	hashtags       *hashtagIndex
+	// Only accept chirp and user UUIDs from clients, so sequential IDs can't be enumerated
+	opaqueIDs bool
+	// How long a deleted chirp can be restored for before it's purged
+	restoreWindow time.Duration
+	timelines     *timelineCache
+	moderation    *moderator
+	chirpLimits   chirpLimits
+	media         *blobStore
+	mediaMaxSize  int64
+	// How far back trending hashtags look by default
+	trendingWindow time.Duration
+	// How long a refresh token lasts, rotating it starts the clock again
+	refreshTTL time.Duration
+	// Expired refresh tokens removed by the sweeper since startup
+	refreshTokensSwept atomic.Int64
 }
 
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
@@ -17,3 +41,47 @@ func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// The value of an env variable, or def when it's unset
+func envOr(name, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+// Reads a duration from an env variable, falling back to def when it's unset or invalid
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	val := os.Getenv(name)
+
+	if val == "" {
+		return def
+	}
+
+	duration, err := time.ParseDuration(val)
+
+	if err != nil || duration <= 0 {
+		log.Printf("Invalid %s %q, using %s", name, val, def)
+		return def
+	}
+
+	return duration
+}
+
+// Reads a positive integer from an env variable, falling back to def when it's unset or invalid
+func intFromEnv(name string, def int) int {
+	val := os.Getenv(name)
+
+	if val == "" {
+		return def
+	}
+
+	num, err := strconv.Atoi(val)
+
+	if err != nil || num <= 0 {
+		log.Printf("Invalid %s %q, using %d", name, val, def)
+		return def
+	}
+
+	return num
+}
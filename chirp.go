@@ -1,39 +1,374 @@
 package main
 
 import (
-	"strings"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rivo/uniseg"
+)
+
+const (
+	defaultChirpLength    = 140
+	defaultRedChirpLength = 280
+)
+
+var (
+	errChirpEmpty   = &validationError{Code: "chirp_empty", Msg: "chirp can't be empty"}
+	errChirpTooLong = &validationError{Code: "chirp_too_long", Msg: "chirp is too long"}
+	errInvalidBody  = &validationError{Code: "invalid_body", Msg: "request body isn't valid JSON"}
 )
 
+// How long chirps can be for each tier, counted in user-perceived characters
+type chirpLimits struct {
+	Standard int
+	// For Chirpy Red members
+	Red int
+}
+
 type chirp struct {
-	ID        int    `json:"id"`
-	Author_ID int    `json:"author_id"`
-	Chirp     string `json:"body"`
+	// Left out of responses when OPAQUE_IDS is set, along with the other sequential IDs
+	ID          int       `json:"id,omitempty"`
+	UUID        string    `json:"uuid"`
+	Author_ID   int       `json:"author_id,omitempty"`
+	Author_UUID string    `json:"author_uuid,omitempty"`
+	Chirp       string    `json:"body"`
+	Created_At  time.Time `json:"created_at"`
+	Updated_At  time.Time `json:"updated_at"`
+	Edited      bool      `json:"edited"`
+	// Set while the chirp is in the trash
+	Deleted_At *time.Time `json:"deleted_at,omitempty"`
+	// The chirp this replies to, 0 and empty if it isn't a reply
+	In_Reply_To      int    `json:"in_reply_to,omitempty"`
+	In_Reply_To_UUID string `json:"in_reply_to_uuid,omitempty"`
+	// Direct replies that aren't in the trash
+	Reply_Count   int `json:"reply_count"`
+	Like_Count    int `json:"like_count"`
+	Rechirp_Count int `json:"rechirp_count"`
+	// Matched a moderation rule that holds chirps for review
+	Flagged bool `json:"flagged"`
+	// Attached images, see GET /api/media/{id}
+	Media_IDs []string `json:"media_ids,omitempty"`
+	// Mentions, hashtags and links in the body
+	Entities []entity `json:"entities,omitempty"`
+}
+
+// What clients send to create or edit a chirp
+type chirpParams struct {
+	Body string `json:"body"`
+	// ID or UUID of the chirp being replied to, only used when creating
+	In_Reply_To chirpRef `json:"in_reply_to"`
+	// Uploaded images to attach, only used when creating
+	Media_IDs []string `json:"media_ids"`
+}
+
+// chirpRef is a chirp ID or UUID, sent as either a JSON number or string
+type chirpRef string
+
+func (ref *chirpRef) UnmarshalJSON(data []byte) error {
+	var val any
+
+	if err := json.Unmarshal(data, &val); err != nil {
+		return err
+	}
+
+	switch v := val.(type) {
+	case nil:
+		*ref = ""
+	case float64:
+		*ref = chirpRef(strconv.FormatFloat(v, 'f', -1, 64))
+	case string:
+		*ref = chirpRef(v)
+	default:
+		return errors.New("chirp reference must be an ID or UUID")
+	}
+
+	return nil
+}
+
+// chirpRevision is an earlier body of an edited chirp
+type chirpRevision struct {
+	// Left out of responses when OPAQUE_IDS is set
+	Chirp_ID int    `json:"chirp_id,omitempty"`
+	Revision int    `json:"revision"`
+	Chirp    string `json:"body"`
+	// When this body was written
+	Created_At time.Time `json:"created_at"`
+}
+
+const (
+	sortByCreatedAt = "created_at"
+	sortByID        = "id"
+)
+
+// Whether a comes before b in ascending order, ties are always broken by ID
+func chirpLess(a, b chirp, sortBy string) bool {
+	if sortBy == sortByCreatedAt && !a.Created_At.Equal(b.Created_At) {
+		return a.Created_At.Before(b.Created_At)
+	}
+	return a.ID < b.ID
+}
+
+func createChirpStruct(data io.ReadCloser) (chirp, chirpRef, error) {
+	dec := json.NewDecoder(data)
+
+	params := chirpParams{}
+
+	err := dec.Decode(&params)
+
+	if err != nil {
+		return chirp{}, "", &validationError{Code: errInvalidBody.Code, Msg: "invalid request body: " + err.Error()}
+	}
+
+	newChirp := chirp{Chirp: params.Body, Media_IDs: params.Media_IDs, Entities: parseEntities(params.Body)}
+
+	return newChirp, params.In_Reply_To, nil
+}
+
+func (apicfg *apiConfig) createChirp(r *http.Request, userID int) (chirp, error) {
+	newChirp, parentRef, err := createChirpStruct(r.Body)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	// The length is what the author wrote, masking can make a body shorter or longer
+	if err := apicfg.validateChirpBody(newChirp.Chirp, userID); err != nil {
+		return chirp{}, err
+	}
+
+	moderated, err := apicfg.moderation.check(newChirp.Chirp)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	// Masking moves things around, so the offsets have to be worked out again
+	if moderated.Body != newChirp.Chirp {
+		newChirp.Entities = parseEntities(moderated.Body)
+	}
+
+	newChirp.Chirp = moderated.Body
+	newChirp.Flagged = moderated.Flagged
+	newChirp.Entities = resolveMentions(newChirp.Entities, apicfg.db.getByHandle)
+
+	if err := apicfg.checkAttachedMedia(newChirp.Media_IDs); err != nil {
+		return chirp{}, err
+	}
+
+	if parentRef != "" {
+		parent, err := apicfg.visibleChirpFromParam(r, string(parentRef))
+
+		if errors.Is(err, errChirpNotFound) {
+			return chirp{}, errParentNotFound
+		}
+
+		if errors.Is(err, errChirpGone) {
+			return chirp{}, errParentGone
+		}
+
+		if err != nil {
+			return chirp{}, err
+		}
+
+		newChirp.In_Reply_To = parent.ID
+	}
+
+	newChirp.Author_ID = userID
+	newChirp.UUID = uuid.NewString()
+	newChirp.Created_At = time.Now().UTC()
+	newChirp.Updated_At = newChirp.Created_At
+
+	newChirp, err = apicfg.db.insertChirp(newChirp)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	// The chirp is already stored, a timeline that misses it is rebuilt from storage on restart
+	if err := apicfg.publishChirp(newChirp); err != nil {
+		log.Println("Error fanning out chirp:", err)
+	}
+
+	return newChirp, nil
+}
+
+// Makes a chirp searchable and puts it in its author's followers' timelines,
+// unless it's held for review
+func (apicfg *apiConfig) publishChirp(val chirp) error {
+	if val.Flagged {
+		return nil
+	}
+
+	apicfg.search.add(val)
+	apicfg.hashtags.add(val)
+
+	return apicfg.timelines.fanOut(val)
+}
+
+// Takes a chirp back out of search and timelines
+func (apicfg *apiConfig) unpublishChirp(val chirp) error {
+	apicfg.search.remove(val.ID)
+	apicfg.hashtags.remove(val.ID)
+
+	return apicfg.timelines.removeChirp(val)
+}
+
+// Replaces the body of a chirp, the old body is kept as a revision
+func (apicfg *apiConfig) editChirp(data io.ReadCloser, target chirp) (chirp, error) {
+	edited, _, err := createChirpStruct(data)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if err := apicfg.validateChirpBody(edited.Chirp, target.Author_ID); err != nil {
+		return chirp{}, err
+	}
+
+	moderated, err := apicfg.moderation.check(edited.Chirp)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	entities := edited.Entities
+
+	if moderated.Body != edited.Chirp {
+		entities = parseEntities(moderated.Body)
+	}
+
+	entities = resolveMentions(entities, apicfg.db.getByHandle)
+
+	// Written together, so an edit that gets the chirp held is never visible first.
+	// Edits can't clear a flag, only a moderator can.
+	updated, err := apicfg.db.updateChirpBody(target.ID, moderated.Body, entities, moderated.Flagged, time.Now().UTC())
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if updated.Flagged {
+		return updated, apicfg.unpublishChirp(updated)
+	}
+
+	apicfg.search.add(updated)
+	apicfg.hashtags.add(updated)
+
+	return updated, nil
 }
 
-func (chirp *chirp) filterForProfane() string {
-	val := chirp.Chirp
+// Checks a body fits the author's limit. Length is counted in grapheme clusters,
+// so an emoji or an accented letter is one character however many bytes it takes.
+func (apicfg *apiConfig) validateChirpBody(body string, authorID int) error {
+	length := uniseg.GraphemeClusterCount(body)
+
+	if length == 0 {
+		return errChirpEmpty
+	}
+
+	author, err := apicfg.db.getUsrByID(authorID)
 
-	splitVal := strings.Split(val, " ")
+	if err != nil {
+		return err
+	}
 
-	returnStr := make([]string, len(splitVal))
+	limit := apicfg.chirpLimits.Standard
 
-	for i, val := range splitVal {
-		if strings.ToLower(val) == "kerfuffle" || strings.ToLower(val) == "sharbert" || strings.ToLower(val) == "fornax" {
-			returnStr[i] = "****"
-		} else {
-			returnStr[i] = val
+	if author.Is_Chirpy_Red {
+		limit = apicfg.chirpLimits.Red
+	}
+
+	if length > limit {
+		return &validationError{
+			Code: errChirpTooLong.Code,
+			Msg:  fmt.Sprintf("chirp is %d characters long, the limit is %d", length, limit),
+		}
+	}
+
+	return nil
+}
+
+// Finds the chirp a path or query parameter refers to. A UUID always works,
+// a sequential ID only when opaque IDs are turned off. Chirps in the trash are
+// returned along with errChirpGone.
+func (apicfg *apiConfig) chirpFromParam(param string) (chirp, error) {
+	found := chirp{}
+
+	if _, err := uuid.Parse(param); err == nil {
+		found, err = apicfg.db.getChirpByUUID(param)
+
+		if err != nil {
+			return chirp{}, err
+		}
+	} else {
+		id, err := strconv.Atoi(param)
+
+		if err != nil || apicfg.opaqueIDs {
+			return chirp{}, errChirpNotFound
+		}
+
+		found, err = apicfg.db.getChirp(id)
+
+		if err != nil {
+			return chirp{}, err
 		}
 	}
-	strChirp := strings.Join(returnStr, " ")
 
-	chirp.Chirp = strChirp
+	if found.Deleted_At != nil {
+		return found, errChirpGone
+	}
 
-	return strChirp
+	return found, nil
 }
 
-func reverseOrder(chirpArr []chirp) []chirp {
-	for i, j := 0, len(chirpArr)-1; i < j; i, j = i+1, j-1 {
-		chirpArr[i], chirpArr[j] = chirpArr[j], chirpArr[i]
+// Same as chirpFromParam, but a held chirp the request can't see is as good as missing
+func (apicfg *apiConfig) visibleChirpFromParam(r *http.Request, param string) (chirp, error) {
+	found, err := apicfg.chirpFromParam(param)
+
+	if (err == nil || errors.Is(err, errChirpGone)) && !apicfg.canSeeChirp(r, found) {
+		return chirp{}, errChirpNotFound
 	}
-	return chirpArr
+
+	return found, err
+}
+
+// The chirp as clients see it. With opaque IDs that's without any sequential
+// IDs, only the UUIDs they can pass back.
+func (apicfg *apiConfig) publicChirp(val chirp) chirp {
+	if !apicfg.opaqueIDs {
+		return val
+	}
+
+	val.ID, val.Author_ID, val.In_Reply_To = 0, 0, 0
+
+	// A copy, the entities are shared with the stored chirp
+	if val.Entities != nil {
+		entities := make([]entity, len(val.Entities))
+
+		for i, ent := range val.Entities {
+			ent.User_ID = 0
+			entities[i] = ent
+		}
+
+		val.Entities = entities
+	}
+
+	return val
+}
+
+func (apicfg *apiConfig) publicChirps(chirpArr []chirp) []chirp {
+	public := make([]chirp, len(chirpArr))
+
+	for i, val := range chirpArr {
+		public[i] = apicfg.publicChirp(val)
+	}
+
+	return public
 }
@@ -0,0 +1,585 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestChirpsCarryUUIDs(t *testing.T) {
+	for name, open := range stressStores(t) {
+		for _, opaque := range []bool{false, true} {
+			label := name
+
+			if opaque {
+				label += "/opaque"
+			}
+
+			t.Run(label, func(t *testing.T) {
+				db, _ := open()
+				apicfg := newTestAPI(t, db)
+				apicfg.opaqueIDs = opaque
+				handler := apicfg.routes()
+
+				for _, email := range []string{"author@example.com", "replier@example.com"} {
+					creds := map[string]string{"email": email, "password": "password", "handle": strings.Split(email, "@")[0]}
+
+					if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+						t.Fatalf("creating %s: %d", email, code)
+					}
+				}
+
+				author := login(t, handler, "author@example.com")
+				replier := login(t, handler, "replier@example.com")
+
+				root := map[string]any{}
+
+				if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "root"}, &root); code != http.StatusCreated {
+					t.Fatalf("chirping: %d", code)
+				}
+
+				reply := map[string]any{}
+				body := map[string]string{"body": "hi @Author", "in_reply_to": root["uuid"].(string)}
+
+				if code := doRequest(t, handler, http.MethodPost, "/api/chirps", replier.Token, body, &reply); code != http.StatusCreated {
+					t.Fatalf("replying: %d", code)
+				}
+
+				fetched := map[string]any{}
+
+				if code := doRequest(t, handler, http.MethodGet, "/api/chirps/"+reply["uuid"].(string), "", nil, &fetched); code != http.StatusOK {
+					t.Fatalf("getting the reply: %d", code)
+				}
+
+				for _, val := range []map[string]any{reply, fetched} {
+					if val["author_uuid"] != replier.UUID {
+						t.Errorf("author_uuid is %v, want %s", val["author_uuid"], replier.UUID)
+					}
+
+					if val["in_reply_to_uuid"] != root["uuid"] {
+						t.Errorf("in_reply_to_uuid is %v, want %v", val["in_reply_to_uuid"], root["uuid"])
+					}
+
+					mention := val["entities"].([]any)[0].(map[string]any)
+
+					if mention["user_uuid"] != author.UUID {
+						t.Errorf("mention user_uuid is %v, want %s", mention["user_uuid"], author.UUID)
+					}
+
+					for _, key := range []string{"id", "author_id", "in_reply_to"} {
+						if _, ok := val[key]; ok == opaque {
+							t.Errorf("%s sent: %v, want %v", key, ok, !opaque)
+						}
+					}
+
+					if _, ok := mention["user_id"]; ok == opaque {
+						t.Errorf("mention user_id sent: %v, want %v", ok, !opaque)
+					}
+				}
+
+				if (author.ID != 0) == opaque {
+					t.Errorf("login response id is %d", author.ID)
+				}
+
+				// Two pages of one chirp each, the cursor between them mustn't carry the ID either
+				page := chirpPage{}
+
+				if code := doRequest(t, handler, http.MethodGet, "/api/chirps?limit=1", "", nil, &page); code != http.StatusOK {
+					t.Fatalf("first page: %d", code)
+				}
+
+				cursor, err := base64.RawURLEncoding.DecodeString(page.Next_Cursor)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if strings.Contains(string(cursor), `"id"`) == opaque {
+					t.Errorf("cursor is %s", cursor)
+				}
+
+				first := page.Chirps[0].UUID
+
+				if code := doRequest(t, handler, http.MethodGet, "/api/chirps?limit=1&cursor="+page.Next_Cursor, "", nil, &page); code != http.StatusOK {
+					t.Fatalf("second page: %d", code)
+				}
+
+				if len(page.Chirps) != 1 || page.Chirps[0].UUID == first {
+					t.Errorf("second page has %+v", page.Chirps)
+				}
+			})
+		}
+	}
+}
+
+func TestOpaqueIDsRejectIDCursors(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.opaqueIDs = true
+
+	if code := doRequest(t, apicfg.routes(), http.MethodGet, "/api/chirps?cursor="+cursorAfter(chirp{ID: 1}).encode(), "", nil, nil); code != http.StatusBadRequest {
+		t.Errorf("cursor with an ID: got %d, want 400", code)
+	}
+}
+
+func TestMalformedChirpBodyIsRejected(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	creds := map[string]string{"email": "author@example.com", "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+		t.Fatalf("creating user: %d", code)
+	}
+
+	author := login(t, handler, "author@example.com")
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "hello"}, nil); code != http.StatusCreated {
+		t.Fatalf("chirping: %d", code)
+	}
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch} {
+		path := "/api/chirps/1"
+
+		if method == http.MethodPost {
+			path = "/api/chirps"
+		}
+
+		for _, body := range []string{`{"body": `, `{"body": 1}`, `{"in_reply_to": true}`} {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+author.Token)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			resp := errResponse{}
+
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if rec.Code != http.StatusBadRequest || resp.Code != errInvalidBody.Code {
+				t.Errorf("%s %s with %s: got %d %+v, want 400 %s", method, path, body, rec.Code, resp, errInvalidBody.Code)
+			}
+		}
+	}
+}
+
+func TestChirpSortIsDeterministic(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		query chirpQuery
+		want  []string
+	}{
+		// Ties on created_at are broken by ID in the same direction
+		{chirpQuery{Sort_By: sortByCreatedAt}, []string{"early", "tie1", "tie2", "late"}},
+		{chirpQuery{Sort_By: sortByCreatedAt, Desc: true}, []string{"late", "tie2", "tie1", "early"}},
+		{chirpQuery{Sort_By: sortByID}, []string{"late", "tie1", "tie2", "early"}},
+		{chirpQuery{Sort_By: sortByID, Desc: true}, []string{"early", "tie2", "tie1", "late"}},
+	}
+
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+
+			// Inserted out of time order so ID and created_at order differ
+			seedChirp(t, db, base, 10, "late")
+			seedChirp(t, db, base, 5, "tie1")
+			seedChirp(t, db, base, 5, "tie2")
+			seedChirp(t, db, base, 0, "early")
+
+			for _, tc := range cases {
+				// More than once, map iteration on the JSON backend mustn't leak into the order
+				for i := 0; i < 5; i++ {
+					chirpArr, err := db.listChirps(tc.query)
+
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					got := []string{}
+
+					for _, val := range chirpArr {
+						got = append(got, val.Chirp)
+					}
+
+					if !slices.Equal(got, tc.want) {
+						t.Fatalf("%+v: got %v, want %v", tc.query, got, tc.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestChirpTimestamps(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	creds := map[string]string{"email": "author@example.com", "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+		t.Fatalf("creating user: %d", code)
+	}
+
+	author := login(t, handler, "author@example.com")
+	before := time.Now().UTC()
+	created := chirp{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "hello"}, &created); code != http.StatusCreated {
+		t.Fatalf("chirping: %d", code)
+	}
+
+	if created.Created_At.Before(before) || created.Created_At.After(time.Now().UTC()) || !created.Updated_At.Equal(created.Created_At) {
+		t.Errorf("created at %v, updated at %v", created.Created_At, created.Updated_At)
+	}
+
+	for _, query := range []string{"sort=sideways", "sort_by=body"} {
+		if code := doRequest(t, handler, http.MethodGet, "/api/chirps?"+query, "", nil, nil); code != http.StatusBadRequest {
+			t.Errorf("?%s: got %d, want 400", query, code)
+		}
+	}
+}
+
+func TestEditsKeepRevisions(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			original := seedChirp(t, db, base, 0, "first")
+			untouched := seedChirp(t, db, base, 1, "never edited")
+
+			for i, body := range []string{"second", "third"} {
+				if _, err := db.updateChirpBody(original.ID, body, nil, false, base.Add(time.Duration(i+1)*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func(db Store) {
+				t.Helper()
+
+				want := []chirpRevision{
+					{Chirp_ID: original.ID, Revision: 1, Chirp: "first", Created_At: base},
+					{Chirp_ID: original.ID, Revision: 2, Chirp: "second", Created_At: base.Add(time.Hour)},
+				}
+
+				revisions, err := db.getChirpRevisions(original.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(revisions) != len(want) {
+					t.Fatalf("got %d revisions, want %d", len(revisions), len(want))
+				}
+
+				for i := range want {
+					if revisions[i].Chirp_ID != want[i].Chirp_ID || revisions[i].Revision != want[i].Revision ||
+						revisions[i].Chirp != want[i].Chirp || !revisions[i].Created_At.Equal(want[i].Created_At) {
+						t.Errorf("revision %d: got %+v, want %+v", i+1, revisions[i], want[i])
+					}
+				}
+
+				current, err := db.getChirp(original.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if current.Chirp != "third" || !current.Edited || !current.Updated_At.Equal(base.Add(2*time.Hour)) || !current.Created_At.Equal(base) {
+					t.Errorf("edited chirp: %+v", current)
+				}
+
+				if revisions, err := db.getChirpRevisions(untouched.ID); err != nil || revisions == nil || len(revisions) != 0 {
+					t.Errorf("unedited chirp: got %v, %v, want an empty list", revisions, err)
+				}
+
+				if _, err := db.getChirpRevisions(original.ID + 100); err != errChirpNotFound {
+					t.Errorf("missing chirp: got %v, want errChirpNotFound", err)
+				}
+			}
+
+			check(db)
+
+			if reopen != nil {
+				check(reopen())
+			}
+		})
+	}
+}
+
+func TestRevisionsEndpoint(t *testing.T) {
+	for _, opaque := range []bool{false, true} {
+		t.Run(fmt.Sprintf("opaque=%t", opaque), func(t *testing.T) {
+			apicfg := newTestAPI(t, newMemDB())
+			apicfg.opaqueIDs = opaque
+			handler := apicfg.routes()
+
+			for _, email := range []string{"author@example.com", "other@example.com"} {
+				creds := map[string]string{"email": email, "password": "password"}
+
+				if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+					t.Fatalf("creating %s: %d", email, code)
+				}
+			}
+
+			author := login(t, handler, "author@example.com")
+			other := login(t, handler, "other@example.com")
+			created := chirp{}
+
+			if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "first"}, &created); code != http.StatusCreated {
+				t.Fatalf("chirping: %d", code)
+			}
+
+			path := "/api/chirps/" + created.UUID
+
+			revisions := func() []chirpRevision {
+				t.Helper()
+
+				resp := []chirpRevision{}
+
+				if code := doRequest(t, handler, http.MethodGet, path+"/revisions", "", nil, &resp); code != http.StatusOK {
+					t.Fatalf("getting revisions: %d", code)
+				}
+
+				return resp
+			}
+
+			if got := revisions(); len(got) != 0 {
+				t.Errorf("before any edit: got %v", got)
+			}
+
+			for _, body := range []string{"second", "third"} {
+				if code := doRequest(t, handler, http.MethodPut, path, author.Token, map[string]string{"body": body}, nil); code != http.StatusOK {
+					t.Fatalf("editing to %q: %d", body, code)
+				}
+			}
+
+			// Edits that are refused don't leave a revision behind
+			if code := doRequest(t, handler, http.MethodPut, path, author.Token, map[string]string{"body": ""}, nil); code != http.StatusBadRequest {
+				t.Errorf("empty edit: got %d, want 400", code)
+			}
+
+			if code := doRequest(t, handler, http.MethodPut, path, other.Token, map[string]string{"body": "hijacked"}, nil); code != http.StatusForbidden {
+				t.Errorf("edit by someone else: got %d, want 403", code)
+			}
+
+			got := revisions()
+			bodies := []string{}
+
+			for i, val := range got {
+				bodies = append(bodies, val.Chirp)
+
+				if val.Revision != i+1 {
+					t.Errorf("revision %d is numbered %d", i+1, val.Revision)
+				}
+
+				if opaque && val.Chirp_ID != 0 {
+					t.Errorf("revision %d leaks chirp ID %d", i+1, val.Chirp_ID)
+				}
+
+				if !opaque && val.Chirp_ID != created.ID {
+					t.Errorf("revision %d is for chirp %d, want %d", i+1, val.Chirp_ID, created.ID)
+				}
+			}
+
+			if !slices.Equal(bodies, []string{"first", "second"}) {
+				t.Errorf("got revisions %v, want [first second]", bodies)
+			}
+
+			if code := doRequest(t, handler, http.MethodGet, "/api/chirps/"+uuid.NewString()+"/revisions", "", nil, nil); code != http.StatusNotFound {
+				t.Errorf("revisions of a missing chirp: got %d, want 404", code)
+			}
+		})
+	}
+}
+
+// A store where holding a chirp on its own always fails
+type failingFlagStore struct {
+	Store
+}
+
+func (s failingFlagStore) setChirpFlagged(id int, flagged bool) (chirp, error) {
+	return chirp{}, errors.New("setChirpFlagged called")
+}
+
+func TestEditsThatFlagAreOneWrite(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			original := seedChirp(t, db, base, 0, "fine")
+
+			updated, err := db.updateChirpBody(original.ID, "flagged", nil, true, base.Add(time.Hour))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !updated.Flagged || updated.Chirp != "flagged" {
+				t.Errorf("edit with a flag returned %+v", updated)
+			}
+
+			// Later edits don't clear it
+			if _, err := db.updateChirpBody(original.ID, "fine again", nil, false, base.Add(2*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				stored, err := store.getChirp(original.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !stored.Flagged || stored.Chirp != "fine again" {
+					t.Errorf("stored chirp: %+v", stored)
+				}
+
+				if revisions, err := store.getChirpRevisions(original.ID); err != nil || len(revisions) != 2 {
+					t.Errorf("got revisions %v, %v, want 2", revisions, err)
+				}
+			}
+		})
+	}
+
+	apicfg := newTestAPI(t, failingFlagStore{newMemDB()})
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	writeModerationConfig(t, path, `{"rules": [{"words": ["fornax"], "action": "flag"}]}`)
+
+	moderation, err := newModerator(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apicfg.moderation = moderation
+	handler := apicfg.routes()
+
+	author := newThreadAuthor(t, handler, "author@example.com")
+	other := signup(t, handler, "other@example.com")
+	created := author.post("nothing to see", chirp{})
+	edited := chirp{}
+
+	if code := doRequest(t, handler, http.MethodPut, "/api/chirps/"+created.UUID, author.token, map[string]string{"body": "look at fornax"}, &edited); code != http.StatusOK {
+		t.Fatalf("editing: %d", code)
+	}
+
+	if !edited.Flagged {
+		t.Error("edit that hit a flag rule isn't held")
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps/"+created.UUID, other.Token, nil, nil); code != http.StatusNotFound {
+		t.Errorf("held chirp for someone else: got %d, want 404", code)
+	}
+
+	if results := apicfg.search.search("fornax", 0); len(results) != 0 {
+		t.Errorf("held chirp is searchable: %v", results)
+	}
+}
+
+func TestChirpLengthCountsGraphemes(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.chirpLimits = chirpLimits{Standard: 10, Red: 20}
+
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	writeModerationConfig(t, path, `{"rules": [{"words": ["kerfuffle", "ab"], "action": "mask"}]}`)
+
+	moderation, err := newModerator(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apicfg.moderation = moderation
+	handler := apicfg.routes()
+
+	standard := signup(t, handler, "standard@example.com")
+	red := signup(t, handler, "red@example.com")
+
+	if _, err := apicfg.db.updateUser(red.ID, func(usr *user) error {
+		usr.Is_Chirpy_Red = true
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := chirp{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", standard.Token, map[string]string{"body": "first"}, &existing); code != http.StatusCreated {
+		t.Fatalf("chirping: %d", code)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+		body  string
+		ok    bool
+	}{
+		// Each of these is a single character however many code points it takes
+		{"flags", standard.Token, strings.Repeat("🇫🇷", 10), true},
+		{"too many flags", standard.Token, strings.Repeat("🇫🇷", 11), false},
+		{"family emoji", standard.Token, strings.Repeat("👩‍👩‍👧‍👦", 10), true},
+		{"skin tones", standard.Token, strings.Repeat("👋🏽", 10), true},
+		{"combining accents", standard.Token, strings.Repeat("e\u0323\u0301", 10), true},
+		{"too many combining accents", standard.Token, strings.Repeat("e\u0301", 11), false},
+		{"empty", standard.Token, "", false},
+		// Masking would bring it under the limit, but it's what was written that counts
+		{"long before masking", standard.Token, "kerfuffle!!", false},
+		// Masking would take it over the limit
+		{"short before masking", standard.Token, "ab ab ab a", true},
+		{"red limit", red.Token, strings.Repeat("👩‍👩‍👧‍👦", 20), true},
+		{"over the red limit", red.Token, strings.Repeat("👩‍👩‍👧‍👦", 21), false},
+	}
+
+	for _, tc := range cases {
+		want := http.StatusCreated
+
+		if !tc.ok {
+			want = http.StatusBadRequest
+		}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/chirps", tc.token, map[string]string{"body": tc.body}, nil); code != want {
+			t.Errorf("creating %s: got %d, want %d", tc.name, code, want)
+		}
+
+		// Edits are held to the author's limit too
+		if tc.token != standard.Token {
+			continue
+		}
+
+		want = http.StatusOK
+
+		if !tc.ok {
+			want = http.StatusBadRequest
+		}
+
+		if code := doRequest(t, handler, http.MethodPut, "/api/chirps/"+existing.UUID, tc.token, map[string]string{"body": tc.body}, nil); code != want {
+			t.Errorf("editing to %s: got %d, want %d", tc.name, code, want)
+		}
+	}
+
+	resp := errResponse{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", standard.Token, map[string]string{"body": "kerfuffle!!"}, &resp); code != http.StatusBadRequest || resp.Code != errChirpTooLong.Code {
+		t.Errorf("long before masking: got %d %+v, want 400 %s", code, resp, errChirpTooLong.Code)
+	}
+}
@@ -1,40 +1,119 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"os"
+	"sort"
 	"sync"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 )
 
+// DB is the JSON file backed Store. A single DB is opened at startup and shared
+// by every request: the whole database is kept in memory and every change goes
+// through Update, which holds the lock from reading the data to writing the file.
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	// raw is the last committed snapshot and data is the decoded form of it,
+	// both are only replaced while holding the write lock
+	raw  []byte
+	data DBStructure
+	// Hash of the refresh token currently in use for each session, by family ID.
+	// Rebuilt from data whenever it's replaced, so JWTs can be checked without a scan.
+	sessions map[string]string
+}
+
+func indexSessions(dbstruct DBStructure) map[string]string {
+	sessions := map[string]string{}
+	for hash, val := range dbstruct.Refresh_Tokens {
+		if val.Rotated_At == nil {
+			sessions[val.Family_ID] = hash
+		}
+	}
+	return sessions
 }
 
 type DBStructure struct {
-	Chirps         map[int]chirp   `json:"chirps"`
-	Users          map[int]user    `json:"users"`
-	Refresh_Tokens []DB_Refr_Token `json:"refresh_tokens"`
+	Chirps map[int]chirp `json:"chirps"`
+	Users  map[int]user  `json:"users"`
+	// Refresh tokens by the SHA-256 of the token, the tokens themselves are never stored
+	Refresh_Tokens map[string]DB_Refr_Token `json:"refresh_token_hashes"`
+	// Plaintext tokens from older files, hashed into Refresh_Tokens when they're loaded
+	Legacy_Refresh_Tokens []legacyRefrToken `json:"refresh_tokens,omitempty"`
+	// Earlier bodies of edited chirps, by chirp ID
+	Revisions map[int][]chirpRevision `json:"revisions"`
+	// Who each user follows, by follower ID
+	Follows map[int][]follow `json:"follows"`
+	// Likes and re-chirps, by chirp ID
+	Reactions map[int][]reaction `json:"reactions"`
+	// User reports, by chirp ID
+	Reports map[int][]report `json:"reports"`
+	// Moderator decisions, by entry ID
+	Audit_Log map[int]auditEntry `json:"audit_log"`
+	// Uploaded images, by media ID
+	Media map[string]media `json:"media"`
+	// Highest ID ever handed out, so IDs of deleted records are never reused
+	Chirp_Seq int `json:"chirp_seq"`
+	User_Seq  int `json:"user_seq"`
+	Audit_Seq int `json:"audit_seq"`
 }
 
 type DB_Refr_Token struct {
-	ID            int       `json:"id"`
-	Expiry_Time   time.Time `json:"expiry_time"`
-	Refresh_Token string    `json:"refresh_token"`
+	ID          int       `json:"id"`
+	Expiry_Time time.Time `json:"expiry_time"`
+	Token_Hash  string    `json:"token_hash"`
+	// The token itself, only known to the request that created it
+	Refresh_Token string `json:"-"`
+	// Tokens rotated from the same login share a family
+	Family_ID string `json:"family_id"`
+	// Set once the token has been swapped for a new one, it's kept to catch it being used again
+	Rotated_At *time.Time `json:"rotated_at,omitempty"`
+	// The device the session is used from, as of its last refresh
+	User_Agent string `json:"user_agent,omitempty"`
+	IP         string `json:"ip,omitempty"`
+	// When the session was logged in, carried over when the token is rotated
+	Created_At   time.Time `json:"created_at"`
+	Last_Used_At time.Time `json:"last_used_at"`
+}
+
+// How refresh tokens were stored before they were hashed
+type legacyRefrToken struct {
+	DB_Refr_Token
+	Refresh_Token string `json:"refresh_token"`
 }
 
 func newDB(path string) (*DB, error) {
-	newDB := DB{path, &sync.RWMutex{}}
+	newDB := DB{path: path, mux: &sync.RWMutex{}}
 	err := newDB.ensureDB()
 	if err != nil {
 		return &DB{}, err
 	}
+	err = newDB.replayJournal()
+	if err != nil {
+		return &DB{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return &DB{}, err
+	}
+	// Refuse to start on top of a corrupt file rather than silently serving an empty database
+	newDB.data, err = decodeDBStructure(data)
+	if err != nil {
+		return &DB{}, fmt.Errorf("database file %s is corrupt: %w", path, err)
+	}
+	newDB.sessions = indexSessions(newDB.data)
+	newDB.raw = data
+	err = newDB.Update(func(dbstruct *DBStructure) error {
+		upgradeDBStructure(dbstruct)
+		return nil
+	})
+	if err != nil {
+		return &DB{}, err
+	}
 	return &newDB, nil
 }
 
@@ -50,483 +129,975 @@ func (db *DB) ensureDB() error {
 	return nil
 }
 
-func (db *DB) loadDB() (DBStructure, error) {
-	db.mux.RLock()
-	defer db.mux.RUnlock()
-
-	data, err := os.ReadFile(db.path)
+func emptyDBStructure() DBStructure {
+	return DBStructure{Chirps: map[int]chirp{}, Users: map[int]user{}, Refresh_Tokens: map[string]DB_Refr_Token{}, Revisions: map[int][]chirpRevision{}, Follows: map[int][]follow{}, Reactions: map[int][]reaction{}, Reports: map[int][]report{}, Audit_Log: map[int]auditEntry{}, Media: map[string]media{}}
+}
 
-	if err != nil {
-		return DBStructure{}, err
+func decodeDBStructure(data []byte) (DBStructure, error) {
+	//If file empty
+	if len(data) == 0 {
+		return emptyDBStructure(), nil
 	}
 
 	dbstruct := DBStructure{}
 
-	err = json.Unmarshal(data, &dbstruct)
-
-	//If file empty
-	if dbstruct.Chirps == nil && dbstruct.Users == nil {
-		return DBStructure{Chirps: map[int]chirp{}, Users: map[int]user{}, Refresh_Tokens: []DB_Refr_Token{}}, nil
-	}
+	err := json.Unmarshal(data, &dbstruct)
 
 	if err != nil {
 		return DBStructure{}, err
 	}
 
-	return dbstruct, nil
-}
-
-func (db *DB) writeDB(dbstruct DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-	data, err := json.Marshal(dbstruct)
-	if err != nil {
-		return err
+	if dbstruct.Chirps == nil {
+		dbstruct.Chirps = map[int]chirp{}
 	}
-	err = os.WriteFile(db.path, data, os.FileMode(0644))
 
-	if err != nil {
-		return err
+	if dbstruct.Users == nil {
+		dbstruct.Users = map[int]user{}
 	}
-	return nil
-}
 
-func (db *DB) getAllChirps() ([]chirp, error) {
-	chirpArr := []chirp{}
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return []chirp{}, err
+	if dbstruct.Revisions == nil {
+		dbstruct.Revisions = map[int][]chirpRevision{}
 	}
-	for _, val := range dbstruct.Chirps {
-		chirpArr = append(chirpArr, val)
-	}
-	return chirpArr, nil
-}
 
-func (db *DB) getAllRefreshTokens() ([]DB_Refr_Token, error) {
-	refrTokenArr := []DB_Refr_Token{}
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return []DB_Refr_Token{}, err
+	if dbstruct.Follows == nil {
+		dbstruct.Follows = map[int][]follow{}
 	}
-	return append(refrTokenArr, dbstruct.Refresh_Tokens...), nil
-}
 
-func (db *DB) newChirpID() (int, error) {
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return -1, nil
+	if dbstruct.Reactions == nil {
+		dbstruct.Reactions = map[int][]reaction{}
 	}
-	return len(dbstruct.Chirps) + 1, nil
-}
 
-func (db *DB) newUserID() (int, error) {
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return -1, nil
+	if dbstruct.Reports == nil {
+		dbstruct.Reports = map[int][]report{}
 	}
-	return len(dbstruct.Users) + 1, nil
-}
-
-func (db *DB) createChirpStruct(data io.ReadCloser) (chirp, error) {
-	dec := json.NewDecoder(data)
 
-	id, err := db.newChirpID()
-
-	if err != nil {
-		return chirp{}, err
+	if dbstruct.Audit_Log == nil {
+		dbstruct.Audit_Log = map[int]auditEntry{}
 	}
 
-	newChirp := chirp{
-		ID: id,
+	if dbstruct.Media == nil {
+		dbstruct.Media = map[string]media{}
 	}
 
-	err = dec.Decode(&newChirp)
-
-	if err != nil {
-		return chirp{}, nil
+	if dbstruct.Refresh_Tokens == nil {
+		dbstruct.Refresh_Tokens = map[string]DB_Refr_Token{}
 	}
 
-	newChirp.filterForProfane()
-
-	return newChirp, nil
+	return dbstruct, nil
 }
 
-func (db *DB) createChirp(data io.ReadCloser, userID int) (chirp, error) {
-	newChirp, err := db.createChirpStruct(data)
+// Fills in anything that files written by older versions of chirpy are missing.
+// Records from before timestamps existed are stamped with the time of the upgrade.
+func upgradeDBStructure(dbstruct *DBStructure) {
+	now := time.Now().UTC()
 
-	if err != nil {
-		return chirp{}, err
+	for id, val := range dbstruct.Chirps {
+		if id > dbstruct.Chirp_Seq {
+			dbstruct.Chirp_Seq = id
+		}
+		if val.UUID == "" {
+			val.UUID = uuid.NewString()
+		}
+		if val.Created_At.IsZero() {
+			val.Created_At, val.Updated_At = now, now
+		}
+		val.Reply_Count, val.Like_Count, val.Rechirp_Count = 0, 0, 0
+		dbstruct.Chirps[id] = val
 	}
 
-	newChirp.Author_ID = userID
-
-	err = db.appendDBChirp(newChirp)
+	// Counts are kept up to date on every write, recounting here fixes up older files
+	for _, val := range dbstruct.Chirps {
+		if val.Deleted_At == nil {
+			adjustReplyCount(dbstruct, val.In_Reply_To, 1)
+		}
+	}
 
-	if err != nil {
-		return chirp{}, err
+	for _, reactions := range dbstruct.Reactions {
+		for _, val := range reactions {
+			adjustReactionCount(dbstruct, val, 1)
+		}
 	}
 
-	return newChirp, nil
-}
+	handles := map[string]user{}
 
-func (db *DB) validatePotential(body io.ReadCloser) (user, error) {
-	newUser := jsonUser{}
+	for _, val := range dbstruct.Users {
+		if val.Handle != "" {
+			handles[val.Handle] = val
+		}
+	}
 
-	dec := json.NewDecoder(body)
+	// Chirps from before entities were extracted
+	for id, val := range dbstruct.Chirps {
+		if val.Entities == nil {
+			val.Entities = resolveMentions(parseEntities(val.Chirp), func(handle string) (user, bool) {
+				usr, ok := handles[handle]
+				return usr, ok
+			})
+			dbstruct.Chirps[id] = val
+		}
+	}
 
-	err := dec.Decode(&newUser)
+	for id, val := range dbstruct.Users {
+		if id > dbstruct.User_Seq {
+			dbstruct.User_Seq = id
+		}
+		if val.UUID == "" {
+			val.UUID = uuid.NewString()
+		}
+		if val.Created_At.IsZero() {
+			val.Created_At, val.Updated_At = now, now
+		}
+		if val.Role == "" {
+			val.Role = roleUser
+		}
+		dbstruct.Users[id] = val
+	}
 
-	if err != nil {
-		return user{}, errors.New("error decoding request")
+	// Chirps from before the author and parent UUIDs were sent, once users and chirps all have one
+	for id, val := range dbstruct.Chirps {
+		fillChirpUUIDs(dbstruct, &val)
+		fillMentionUUIDs(val.Entities, func(id int) (user, bool) {
+			usr, ok := dbstruct.Users[id]
+			return usr, ok
+		})
+		dbstruct.Chirps[id] = val
 	}
 
-	potUser, exists := db.getByEmail(newUser.Email)
+	for id := range dbstruct.Audit_Log {
+		if id > dbstruct.Audit_Seq {
+			dbstruct.Audit_Seq = id
+		}
+	}
 
-	if !exists || bcrypt.CompareHashAndPassword(potUser.Password, []byte(newUser.Password)) != nil {
-		return user{}, errors.New("invalid login details, please try again")
+	for _, val := range dbstruct.Legacy_Refresh_Tokens {
+		token := val.DB_Refr_Token
+		token.Token_Hash = hashRefreshToken(val.Refresh_Token)
+		dbstruct.Refresh_Tokens[token.Token_Hash] = token
 	}
+	dbstruct.Legacy_Refresh_Tokens = nil
 
-	return potUser, nil
+	for hash, val := range dbstruct.Refresh_Tokens {
+		// Refresh tokens from before rotation each start their own family
+		if val.Family_ID == "" {
+			val.Family_ID = uuid.NewString()
+		}
+		if val.Created_At.IsZero() {
+			val.Created_At, val.Last_Used_At = now, now
+		}
+		dbstruct.Refresh_Tokens[hash] = val
+	}
 }
 
-func (db *DB) createTempUser(body io.ReadCloser) (user, error) {
-	defer body.Close()
-
-	newUser := jsonUser{}
+// Returns a private copy of the committed data
+func (db *DB) loadDB() (DBStructure, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	id, err := db.newUserID()
+	return decodeDBStructure(db.raw)
+}
 
-	if err != nil {
-		return user{}, err
-	}
+// Runs fn against the committed data under a read lock, fn must not modify or keep hold of it
+func (db *DB) View(fn func(*DBStructure) error) error {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	finalUser := user{
-		ID: id,
-	}
+	return fn(&db.data)
+}
 
-	dec := json.NewDecoder(body)
+// Runs fn against a copy of the data under the write lock. If fn succeeds the
+// copy is written to disk and becomes the committed data, otherwise it's discarded.
+func (db *DB) Update(fn func(*DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	err = dec.Decode(&newUser)
+	next, err := decodeDBStructure(db.raw)
 
 	if err != nil {
-		return user{}, err
+		return err
 	}
 
-	finalUser.Password, err = bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
-
-	finalUser.Email = newUser.Email
+	err = fn(&next)
 
 	if err != nil {
-		return user{}, errors.New("error creating password")
+		return err
 	}
 
-	return finalUser, nil
-}
-
-func (db *DB) createUser(body io.ReadCloser) (user, error) {
-	defer body.Close()
-
-	newUser := jsonUser{}
-
-	id, err := db.newUserID()
+	raw, err := json.Marshal(next)
 
 	if err != nil {
-		return user{}, err
-	}
-
-	finalUser := user{
-		ID:            id,
-		Is_Chirpy_Red: false,
+		return err
 	}
 
-	dec := json.NewDecoder(body)
-
-	err = dec.Decode(&newUser)
-
-	if err != nil {
-		return user{}, err
+	if bytes.Equal(raw, db.raw) {
+		return nil
 	}
 
-	finalUser.Password, err = bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+	err = db.writeDB(raw)
 
 	if err != nil {
-		return user{}, errors.New("error creating password")
-	}
-
-	if _, exists := db.getByEmail(newUser.Email); exists {
-		return user{}, errors.New("email already exists")
+		return err
 	}
 
-	finalUser.Email = newUser.Email
+	db.raw = raw
+	db.data = next
+	db.sessions = indexSessions(next)
 
-	return finalUser, nil
+	return nil
 }
 
-func (db *DB) appendDBChirp(chirp chirp) error {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		return err
+// Journals the change from the committed snapshot and writes the new one, must hold the write lock
+func (db *DB) writeDB(raw []byte) error {
+	// In-memory only
+	if db.path == "" {
+		return nil
 	}
 
-	dbStruct.Chirps[chirp.ID] = chirp
+	entries, err := diffSnapshots(db.raw, raw)
 
-	err = db.writeDB(dbStruct)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
+	err = db.appendJournal(entries)
 
-func (db *DB) appendDBUser(user user) error {
-	dbStruct, err := db.loadDB()
 	if err != nil {
 		return err
 	}
 
-	dbStruct.Users[user.ID] = user
-
-	err = db.writeDB(dbStruct)
+	err = writeFileAtomic(db.path, raw, os.FileMode(0644))
 
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return db.clearJournal()
 }
 
-func (db *DB) appendDBRefrToken(refrToken DB_Refr_Token) error {
-	dbstruct, err := db.loadDB()
+func (db *DB) getAllChirps() ([]chirp, error) {
+	chirpArr := []chirp{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Chirps {
+			if val.Deleted_At == nil && !val.Flagged {
+				chirpArr = append(chirpArr, val)
+			}
+		}
+		return nil
+	})
+	return chirpArr, err
+}
 
+func (db *DB) listChirps(query chirpQuery) ([]chirp, error) {
+	chirpArr := []chirp{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Chirps {
+			if query.Author_ID != 0 && val.Author_ID != query.Author_ID {
+				continue
+			}
+			if query.Author_IDs != nil && !containsInt(query.Author_IDs, val.Author_ID) {
+				continue
+			}
+			if (val.Deleted_At != nil) != query.Trashed {
+				continue
+			}
+			if !query.Trashed && val.Flagged != query.Held {
+				continue
+			}
+			if query.After != nil {
+				after := chirp{ID: query.After.ID, Created_At: query.After.Created_At}
+				if query.Desc && !chirpLess(val, after, query.Sort_By) || !query.Desc && !chirpLess(after, val, query.Sort_By) {
+					continue
+				}
+			}
+			chirpArr = append(chirpArr, val)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return []chirp{}, err
 	}
 
-	dbstruct.Refresh_Tokens = append(dbstruct.Refresh_Tokens, refrToken)
-
-	err = db.writeDB(dbstruct)
+	sort.Slice(chirpArr, func(i, j int) bool {
+		if query.Desc {
+			return chirpLess(chirpArr[j], chirpArr[i], query.Sort_By)
+		}
+		return chirpLess(chirpArr[i], chirpArr[j], query.Sort_By)
+	})
 
-	if err != nil {
-		return err
+	if query.Limit > 0 && len(chirpArr) > query.Limit {
+		chirpArr = chirpArr[:query.Limit]
 	}
 
-	return nil
+	return chirpArr, nil
+}
+
+func (db *DB) getChirp(id int) (chirp, error) {
+	dbChirp := chirp{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Chirps[id]
+		if !ok {
+			return errChirpNotFound
+		}
+		dbChirp = val
+		return nil
+	})
+	return dbChirp, err
 }
 
-func (db *DB) updateUser(updatedUser *user, userID int) (user, error) {
-	dbstruct, err := db.loadDB()
+func (db *DB) getChirpByUUID(chirpUUID string) (chirp, error) {
+	dbChirp := chirp{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Chirps {
+			if val.UUID == chirpUUID {
+				dbChirp = val
+				return nil
+			}
+		}
+		return errChirpNotFound
+	})
+	return dbChirp, err
+}
 
+func (db *DB) insertChirp(newChirp chirp) (chirp, error) {
+	err := db.Update(func(dbstruct *DBStructure) error {
+		dbstruct.Chirp_Seq++
+		newChirp.ID = dbstruct.Chirp_Seq
+		fillChirpUUIDs(dbstruct, &newChirp)
+		dbstruct.Chirps[newChirp.ID] = newChirp
+		adjustReplyCount(dbstruct, newChirp.In_Reply_To, 1)
+		return nil
+	})
 	if err != nil {
-		return user{}, err
+		return chirp{}, err
 	}
+	return newChirp, nil
+}
 
-	hashedPass, err := bcrypt.GenerateFromPassword([]byte(updatedUser.Password), bcrypt.DefaultCost)
-
+func (db *DB) insertUser(newUser user) (user, error) {
+	err := db.Update(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Users {
+			if val.Email == newUser.Email {
+				return errEmailExists
+			}
+			if newUser.Handle != "" && val.Handle == newUser.Handle {
+				return errHandleExists
+			}
+		}
+		dbstruct.User_Seq++
+		newUser.ID = dbstruct.User_Seq
+		dbstruct.Users[newUser.ID] = newUser
+		return nil
+	})
 	if err != nil {
 		return user{}, err
 	}
+	return newUser, nil
+}
 
-	updatedUser.Password = hashedPass
-
-	if _, ok := dbstruct.Users[userID]; !ok {
-		return user{}, errors.New("user not found")
-	}
+func (db *DB) deleteChirp(id int) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Chirps[id]
+		if !ok {
+			return errChirpNotFound
+		}
+		if val.Deleted_At == nil {
+			adjustReplyCount(dbstruct, val.In_Reply_To, -1)
+		}
+		delete(dbstruct.Chirps, id)
+		delete(dbstruct.Revisions, id)
+		delete(dbstruct.Reactions, id)
+		delete(dbstruct.Reports, id)
+		return nil
+	})
+}
 
-	usrNotPtr := user{
-		ID:       userID,
-		Email:    updatedUser.Email,
-		Password: updatedUser.Password,
-		Is_Chirpy_Red: updatedUser.Is_Chirpy_Red,
-	}
+func (db *DB) setChirpDeleted(id int, deletedAt *time.Time) (chirp, error) {
+	updated := chirp{}
+	err := db.Update(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Chirps[id]
+		if !ok {
+			return errChirpNotFound
+		}
+		if val.Deleted_At == nil && deletedAt != nil {
+			adjustReplyCount(dbstruct, val.In_Reply_To, -1)
+		} else if val.Deleted_At != nil && deletedAt == nil {
+			adjustReplyCount(dbstruct, val.In_Reply_To, 1)
+		}
+		val.Deleted_At = deletedAt
+		dbstruct.Chirps[id] = val
+		updated = val
+		return nil
+	})
+	return updated, err
+}
 
-	dbstruct.Users[userID] = usrNotPtr
+func (db *DB) setChirpFlagged(id int, flagged bool) (chirp, error) {
+	updated := chirp{}
+	err := db.Update(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Chirps[id]
+		if !ok {
+			return errChirpNotFound
+		}
+		val.Flagged = flagged
+		dbstruct.Chirps[id] = val
+		updated = val
+		return nil
+	})
+	return updated, err
+}
 
-	db.writeDB(dbstruct)
+func (db *DB) purgeDeletedChirps(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbstruct *DBStructure) error {
+		for id, val := range dbstruct.Chirps {
+			if val.Deleted_At != nil && val.Deleted_At.Before(before) {
+				delete(dbstruct.Chirps, id)
+				delete(dbstruct.Revisions, id)
+				delete(dbstruct.Reactions, id)
+				delete(dbstruct.Reports, id)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
 
-	return usrNotPtr, nil
+func (db *DB) updateChirpBody(id int, body string, entities []entity, flag bool, editedAt time.Time) (chirp, error) {
+	updated := chirp{}
+	err := db.Update(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Chirps[id]
+		if !ok {
+			return errChirpNotFound
+		}
+		dbstruct.Revisions[id] = append(dbstruct.Revisions[id], chirpRevision{
+			Chirp_ID:   id,
+			Revision:   len(dbstruct.Revisions[id]) + 1,
+			Chirp:      val.Chirp,
+			Created_At: val.Updated_At,
+		})
+		val.Chirp = body
+		val.Entities = entities
+		val.Edited = true
+		val.Flagged = val.Flagged || flag
+		val.Updated_At = editedAt
+		dbstruct.Chirps[id] = val
+		updated = val
+		return nil
+	})
+	return updated, err
 }
 
-func (db *DB) makeAndStoreRefreshToken(userID int) (DB_Refr_Token, error) {
-	newRefrTokenString, err := createRefreshToken(userID)
+func (db *DB) getChirpRevisions(id int) ([]chirpRevision, error) {
+	revisions := []chirpRevision{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Chirps[id]; !ok {
+			return errChirpNotFound
+		}
+		revisions = append(revisions, dbstruct.Revisions[id]...)
+		return nil
+	})
+	return revisions, err
+}
 
+func (db *DB) getReplies(id int) ([]chirp, error) {
+	replies := []chirp{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Chirps[id]; !ok {
+			return errChirpNotFound
+		}
+		for _, val := range dbstruct.Chirps {
+			if val.In_Reply_To == id {
+				replies = append(replies, val)
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return DB_Refr_Token{}, err
+		return []chirp{}, err
 	}
 
-	newRefrToken := DB_Refr_Token{
-		ID:            userID,
-		Expiry_Time:   time.Now().Add(1 * time.Hour),
-		Refresh_Token: newRefrTokenString.Refresh_Token,
-	}
+	sort.Slice(replies, func(i, j int) bool {
+		return chirpLess(replies[i], replies[j], sortByCreatedAt)
+	})
 
-	err = db.appendDBRefrToken(newRefrToken)
+	return replies, nil
+}
 
-	if err != nil {
-		return DB_Refr_Token{}, err
+// Copies the UUIDs of the chirp's author and parent onto it, so they're sent along with the IDs
+func fillChirpUUIDs(dbstruct *DBStructure, val *chirp) {
+	val.Author_UUID = dbstruct.Users[val.Author_ID].UUID
+	if parent, ok := dbstruct.Chirps[val.In_Reply_To]; ok && val.In_Reply_To != 0 {
+		val.In_Reply_To_UUID = parent.UUID
 	}
-
-	return newRefrToken, nil
 }
 
-func (db *DB) removeRefrToken(tokenstr string) error {
-	dbstruct, err := db.loadDB()
-
-	if err != nil {
-		return err
+// Counts a reply being added to or taken away from its parent, if the parent is still stored
+func adjustReplyCount(dbstruct *DBStructure, parentID int, delta int) {
+	parent, ok := dbstruct.Chirps[parentID]
+	if parentID == 0 || !ok {
+		return
 	}
+	parent.Reply_Count += delta
+	dbstruct.Chirps[parentID] = parent
+}
 
-	token, err := db.getRefrByToken(tokenstr)
-
-	if err != nil {
-		return err
-	}
-
-	ommitedTokenArr := dbstruct.Refresh_Tokens[:indexOfRefr(token, dbstruct.Refresh_Tokens)]
-	ommitedTokenArr = append(ommitedTokenArr, dbstruct.Refresh_Tokens[indexOfRefr(token, dbstruct.Refresh_Tokens)+1:]...)
-
-	dbstruct.Refresh_Tokens = ommitedTokenArr
+func (db *DB) updateUser(id int, fn func(*user) error) (user, error) {
+	updated := user{}
+	err := db.Update(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Users[id]
+		if !ok {
+			return errUserNotFound
+		}
+		if err := fn(&val); err != nil {
+			return err
+		}
+		for otherID, other := range dbstruct.Users {
+			if otherID != id && other.Email == val.Email {
+				return errEmailExists
+			}
+			if otherID != id && val.Handle != "" && other.Handle == val.Handle {
+				return errHandleExists
+			}
+		}
+		dbstruct.Users[id] = val
+		updated = val
+		return nil
+	})
+	return updated, err
+}
 
-	db.writeDB(dbstruct)
+func (db *DB) addFollow(followerID, followeeID int, followedAt time.Time) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Follows[followerID] {
+			if val.Followee_ID == followeeID {
+				return nil
+			}
+		}
+		dbstruct.Follows[followerID] = append(dbstruct.Follows[followerID], follow{
+			Follower_ID: followerID,
+			Followee_ID: followeeID,
+			Created_At:  followedAt,
+		})
+		return nil
+	})
+}
 
-	return nil
+func (db *DB) removeFollow(followerID, followeeID int) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		following := []follow{}
+		for _, val := range dbstruct.Follows[followerID] {
+			if val.Followee_ID != followeeID {
+				following = append(following, val)
+			}
+		}
+		if len(following) == 0 {
+			delete(dbstruct.Follows, followerID)
+		} else {
+			dbstruct.Follows[followerID] = following
+		}
+		return nil
+	})
 }
 
-func (db *DB) findAndDeleteRefrToken(header string) error {
-	if len(header) < 7 {
-		return errors.New("no header found")
-	}
+func (db *DB) getFollowers(userID int) ([]follow, error) {
+	followers := []follow{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, following := range dbstruct.Follows {
+			for _, val := range following {
+				if val.Followee_ID == userID {
+					followers = append(followers, val)
+				}
+			}
+		}
+		return nil
+	})
+	sortFollows(followers)
+	return followers, err
+}
 
-	refr_token_string := header[7:]
+func (db *DB) getFollowing(userID int) ([]follow, error) {
+	following := []follow{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		following = append(following, dbstruct.Follows[userID]...)
+		return nil
+	})
+	sortFollows(following)
+	return following, err
+}
 
-	fmt.Println(refr_token_string)
+func (db *DB) getAllFollows() ([]follow, error) {
+	follows := []follow{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, following := range dbstruct.Follows {
+			follows = append(follows, following...)
+		}
+		return nil
+	})
+	sortFollows(follows)
+	return follows, err
+}
 
-	Refr_TokenArr, err := db.getAllRefreshTokens()
+// Most recent first, the same order the sqlite store lists them in
+func sortFollows(follows []follow) {
+	sort.Slice(follows, func(i, j int) bool {
+		if !follows[i].Created_At.Equal(follows[j].Created_At) {
+			return follows[i].Created_At.After(follows[j].Created_At)
+		}
+		if follows[i].Follower_ID != follows[j].Follower_ID {
+			return follows[i].Follower_ID > follows[j].Follower_ID
+		}
+		return follows[i].Followee_ID > follows[j].Followee_ID
+	})
+}
 
-	if err != nil {
-		return err
-	}
+func (db *DB) addReaction(newReaction reaction) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Chirps[newReaction.Chirp_ID]; !ok {
+			return errChirpNotFound
+		}
+		for _, val := range dbstruct.Reactions[newReaction.Chirp_ID] {
+			if val.Kind == newReaction.Kind && val.User_ID == newReaction.User_ID {
+				return nil
+			}
+		}
+		dbstruct.Reactions[newReaction.Chirp_ID] = append(dbstruct.Reactions[newReaction.Chirp_ID], newReaction)
+		adjustReactionCount(dbstruct, newReaction, 1)
+		return nil
+	})
+}
 
-	for _, val := range Refr_TokenArr {
-		if val.Refresh_Token == refr_token_string && time.Now().Before(val.Expiry_Time) {
-			fmt.Println("token found")
-			db.removeRefrToken(val.Refresh_Token)
-			return nil
-		} else if time.Now().Before(val.Expiry_Time) {
-			db.removeRefrToken(val.Refresh_Token)
+func (db *DB) removeReaction(kind string, userID, chirpID int) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Chirps[chirpID]; !ok {
+			return errChirpNotFound
 		}
-	}
+		kept := []reaction{}
+		for _, val := range dbstruct.Reactions[chirpID] {
+			if val.Kind == kind && val.User_ID == userID {
+				adjustReactionCount(dbstruct, val, -1)
+				continue
+			}
+			kept = append(kept, val)
+		}
+		if len(kept) == 0 {
+			delete(dbstruct.Reactions, chirpID)
+		} else {
+			dbstruct.Reactions[chirpID] = kept
+		}
+		return nil
+	})
+}
 
-	return errors.New("token not found")
+func (db *DB) getUserReactions(kind string, userID int) ([]reaction, error) {
+	reactions := []reaction{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, chirpReactions := range dbstruct.Reactions {
+			for _, val := range chirpReactions {
+				if val.Kind == kind && val.User_ID == userID {
+					reactions = append(reactions, val)
+				}
+			}
+		}
+		return nil
+	})
+	sort.Slice(reactions, func(i, j int) bool {
+		if !reactions[i].Created_At.Equal(reactions[j].Created_At) {
+			return reactions[i].Created_At.After(reactions[j].Created_At)
+		}
+		return reactions[i].Chirp_ID > reactions[j].Chirp_ID
+	})
+	return reactions, err
 }
 
-func (db *DB) validateRefreshToken(refr_token_string_with_bearer string) (int, error) {
-	if len(refr_token_string_with_bearer) < 7 {
-		return -1, errors.New("no header found")
-	}
+func (db *DB) addReport(newReport report) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Chirps[newReport.Chirp_ID]; !ok {
+			return errChirpNotFound
+		}
+		reports := []report{newReport}
+		for _, val := range dbstruct.Reports[newReport.Chirp_ID] {
+			if val.Reporter_ID != newReport.Reporter_ID {
+				reports = append(reports, val)
+			}
+		}
+		dbstruct.Reports[newReport.Chirp_ID] = reports
+		return nil
+	})
+}
 
-	refr_token_string := refr_token_string_with_bearer[7:]
+func (db *DB) getOpenReports() ([]report, error) {
+	reports := []report{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, chirpReports := range dbstruct.Reports {
+			for _, val := range chirpReports {
+				if val.Resolved_At == nil {
+					reports = append(reports, val)
+				}
+			}
+		}
+		return nil
+	})
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].Created_At.Equal(reports[j].Created_At) {
+			return reports[i].Created_At.Before(reports[j].Created_At)
+		}
+		if reports[i].Chirp_ID != reports[j].Chirp_ID {
+			return reports[i].Chirp_ID < reports[j].Chirp_ID
+		}
+		return reports[i].Reporter_ID < reports[j].Reporter_ID
+	})
+	return reports, err
+}
 
-	dbstruct, err := db.loadDB()
+func (db *DB) resolveReports(chirpID int, resolvedAt time.Time) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		reports := []report{}
+		for _, val := range dbstruct.Reports[chirpID] {
+			if val.Resolved_At == nil {
+				val.Resolved_At = &resolvedAt
+			}
+			reports = append(reports, val)
+		}
+		if len(reports) > 0 {
+			dbstruct.Reports[chirpID] = reports
+		}
+		return nil
+	})
+}
 
+func (db *DB) appendAuditEntry(entry auditEntry) (auditEntry, error) {
+	err := db.Update(func(dbstruct *DBStructure) error {
+		dbstruct.Audit_Seq++
+		entry.ID = dbstruct.Audit_Seq
+		dbstruct.Audit_Log[entry.ID] = entry
+		return nil
+	})
 	if err != nil {
-		return -1, err
+		return auditEntry{}, err
 	}
+	return entry, nil
+}
 
-	for _, val := range dbstruct.Refresh_Tokens {
-		if val.Refresh_Token == refr_token_string && time.Now().Before(val.Expiry_Time) {
-			return val.ID, nil
+func (db *DB) getAuditLog() ([]auditEntry, error) {
+	entries := []auditEntry{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Audit_Log {
+			entries = append(entries, val)
 		}
-	}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+	return entries, err
+}
 
-	return -1, errors.New("refresh token not found")
+func (db *DB) addMedia(val media) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Media[val.ID]; !ok {
+			dbstruct.Media[val.ID] = val
+		}
+		return nil
+	})
 }
 
-func (db *DB) getUsrByID(id int) (user, error) {
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return user{}, err
-	}
-	usr, ok := dbstruct.Users[id]
-	if !ok {
-		return user{}, errors.New("user not found")
-	}
-	return usr, nil
+func (db *DB) getMedia(id string) (media, error) {
+	found := media{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Media[id]
+		if !ok {
+			return errMediaNotFound
+		}
+		found = val
+		return nil
+	})
+	return found, err
 }
 
-func (db *DB) getRefrByToken(tokenstr string) (DB_Refr_Token, error) {
-	dbstruct, err := db.loadDB()
-	if err != nil {
-		return DB_Refr_Token{}, err
+// Counts a like or re-chirp being added to or taken away from its chirp
+func adjustReactionCount(dbstruct *DBStructure, val reaction, delta int) {
+	target, ok := dbstruct.Chirps[val.Chirp_ID]
+	if !ok {
+		return
 	}
-
-	for _, val := range dbstruct.Refresh_Tokens {
-		if tokenstr == val.Refresh_Token {
-			return val, nil
-		}
+	switch val.Kind {
+	case reactionLike:
+		target.Like_Count += delta
+	case reactionRechirp:
+		target.Rechirp_Count += delta
 	}
+	dbstruct.Chirps[val.Chirp_ID] = target
+}
 
-	return DB_Refr_Token{}, errors.New("token not found")
+func (db *DB) appendDBRefrToken(refrToken DB_Refr_Token) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		dbstruct.Refresh_Tokens[refrToken.Token_Hash] = refrToken
+		return nil
+	})
 }
 
-func indexOfRefr(token DB_Refr_Token, refrArr []DB_Refr_Token) int {
-	for i, val := range refrArr {
-		if token.Refresh_Token == val.Refresh_Token {
-			return i
+func (db *DB) removeRefrToken(tokenHash string) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		if _, ok := dbstruct.Refresh_Tokens[tokenHash]; !ok {
+			return errTokenNotFound
 		}
-	}
-	return -1
+		delete(dbstruct.Refresh_Tokens, tokenHash)
+		return nil
+	})
 }
 
-func (db *DB) getByEmail(email string) (user, bool) {
-	dbstruct, err := db.loadDB()
-
-	if err != nil {
-		return user{}, false
-	}
+func (db *DB) rotateRefrToken(tokenHash string, next DB_Refr_Token) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		old, ok := dbstruct.Refresh_Tokens[tokenHash]
+		if !ok {
+			return errTokenNotFound
+		}
+		if old.Rotated_At != nil {
+			return errTokenReused
+		}
+		now := time.Now().UTC()
+		old.Rotated_At = &now
+		dbstruct.Refresh_Tokens[tokenHash] = old
+		// Rotated tokens live as long as the family does, so reuse is caught for as long as it matters
+		for hash, val := range dbstruct.Refresh_Tokens {
+			if val.Family_ID == next.Family_ID {
+				val.Expiry_Time = next.Expiry_Time
+				dbstruct.Refresh_Tokens[hash] = val
+			}
+		}
+		dbstruct.Refresh_Tokens[next.Token_Hash] = next
+		return nil
+	})
+}
 
-	for _, val := range dbstruct.Users {
-		if val.Email == email {
-			return val, true
+func (db *DB) revokeRefrFamily(familyID string) error {
+	return db.Update(func(dbstruct *DBStructure) error {
+		for hash, val := range dbstruct.Refresh_Tokens {
+			if val.Family_ID == familyID {
+				delete(dbstruct.Refresh_Tokens, hash)
+			}
 		}
-	}
+		return nil
+	})
+}
 
-	return user{}, false
+func (db *DB) getSession(familyID string) (DB_Refr_Token, error) {
+	token := DB_Refr_Token{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Refresh_Tokens[db.sessions[familyID]]
+		if !ok {
+			return errTokenNotFound
+		}
+		token = val
+		return nil
+	})
+	return token, err
 }
 
-func (db *DB) upgradeUser(id int) error {
-	dbstruct, err := db.loadDB()
-	
-	if err != nil {
-		return err
-	}
+func (db *DB) getUserSessions(userID int) ([]DB_Refr_Token, error) {
+	sessions := []DB_Refr_Token{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Refresh_Tokens {
+			if val.ID == userID && val.Rotated_At == nil {
+				sessions = append(sessions, val)
+			}
+		}
+		return nil
+	})
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Last_Used_At.After(sessions[j].Last_Used_At)
+	})
+	return sessions, err
+}
 
-	if dbUser, ok := dbstruct.Users[id]; ok{
-		dbUser.Is_Chirpy_Red = true
+func (db *DB) purgeExpiredRefrTokens(before time.Time) (int, error) {
+	purged := 0
+	err := db.Update(func(dbstruct *DBStructure) error {
+		for hash, val := range dbstruct.Refresh_Tokens {
+			if val.Expiry_Time.Before(before) {
+				delete(dbstruct.Refresh_Tokens, hash)
+				purged++
+			}
+		}
+		return nil
+	})
+	return purged, err
+}
 
-		dbstruct.Users[id] = dbUser
-		
-		db.writeDB(dbstruct)
+func (db *DB) getUsrByID(id int) (user, error) {
+	usr := user{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Users[id]
+		if !ok {
+			return errUserNotFound
+		}
+		usr = val
 		return nil
-	}
+	})
+	return usr, err
+}
 
-	return errors.New("user does not exist")
+func (db *DB) getUsrByUUID(userUUID string) (user, error) {
+	usr := user{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Users {
+			if val.UUID == userUUID {
+				usr = val
+				return nil
+			}
+		}
+		return errUserNotFound
+	})
+	return usr, err
 }
 
-func (db *DB) decodeWebhook(data io.ReadCloser) error {
-	webhook := webhookBody{}
+func (db *DB) getRefrByHash(tokenHash string) (DB_Refr_Token, error) {
+	token := DB_Refr_Token{}
+	err := db.View(func(dbstruct *DBStructure) error {
+		val, ok := dbstruct.Refresh_Tokens[tokenHash]
+		if !ok {
+			return errTokenNotFound
+		}
+		token = val
+		return nil
+	})
+	return token, err
+}
 
-	var err error
+func (db *DB) getByHandle(handle string) (user, bool) {
+	usr := user{}
+	found := false
 
-	json.NewDecoder(data).Decode(&webhook)
+	if handle == "" {
+		return usr, found
+	}
 
-	fmt.Println(webhook)
+	db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Users {
+			if val.Handle == handle {
+				usr, found = val, true
+				return nil
+			}
+		}
+		return nil
+	})
 
-	defer data.Close()
+	return usr, found
+}
 
-	if webhook.Event == "user.upgraded" {
-		err = db.upgradeUser(webhook.Data.ID)
-	}
+func (db *DB) getByEmail(email string) (user, bool) {
+	usr := user{}
+	found := false
+
+	db.View(func(dbstruct *DBStructure) error {
+		for _, val := range dbstruct.Users {
+			if val.Email == email {
+				usr, found = val, true
+				return nil
+			}
+		}
+		return nil
+	})
 
-	return err
+	return usr, found
 }
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const stressWorkers = 50
+
+// Each backend the stress tests run against, opened fresh. Reopen gives back
+// a second handle on the same data, nil for backends that only live in memory.
+func stressStores(t *testing.T) map[string]func() (Store, func() Store) {
+	return map[string]func() (Store, func() Store){
+		"memory": func() (Store, func() Store) {
+			return newMemDB(), nil
+		},
+		"json": func() (Store, func() Store) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			open := func() Store {
+				db, err := newDB(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return db
+			}
+
+			return open(), open
+		},
+		"sqlite": func() (Store, func() Store) {
+			path := filepath.Join(t.TempDir(), "database.db")
+			open := func() Store {
+				db, err := newSQLiteDB(path)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				t.Cleanup(func() { db.db.Close() })
+
+				return db
+			}
+
+			return open(), open
+		},
+	}
+}
+
+// Runs fn on stressWorkers goroutines at once, failing the test with the first error
+func runConcurrently(t *testing.T, fn func(i int) error) {
+	t.Helper()
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, stressWorkers)
+
+	for i := 0; i < stressWorkers; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			if err := fn(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentChirpInserts(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			ids := make([]int, stressWorkers)
+
+			runConcurrently(t, func(i int) error {
+				inserted, err := db.insertChirp(chirp{UUID: uuid.NewString(), Chirp: "stress", Author_ID: 1, Created_At: time.Now().UTC()})
+				ids[i] = inserted.ID
+				return err
+			})
+
+			seen := map[int]bool{}
+
+			for _, id := range ids {
+				if seen[id] {
+					t.Fatalf("chirp ID %d was handed out twice", id)
+				}
+
+				seen[id] = true
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				chirps, err := store.getAllChirps()
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(chirps) != stressWorkers {
+					t.Errorf("%d chirps stored, want %d", len(chirps), stressWorkers)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentUserUpdates(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+
+			usr, err := db.insertUser(user{UUID: uuid.NewString(), Email: "stress@example.com", Password: []byte{}, Role: roleUser})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Every worker adds a byte to the password, any update that's lost leaves it short.
+			// The last one also upgrades and bans the user, which mustn't undo the others.
+			runConcurrently(t, func(i int) error {
+				_, err := db.updateUser(usr.ID, func(val *user) error {
+					val.Password = append(val.Password, 'x')
+
+					switch i {
+					case 0:
+						val.Is_Chirpy_Red = true
+					case 1:
+						val.Is_Banned = true
+					}
+
+					return nil
+				})
+				return err
+			})
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				updated, err := store.getUsrByID(usr.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if len(updated.Password) != stressWorkers || !updated.Is_Chirpy_Red || !updated.Is_Banned {
+					t.Errorf("lost updates: password has %d of %d changes, red %v, banned %v",
+						len(updated.Password), stressWorkers, updated.Is_Chirpy_Red, updated.Is_Banned)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUserErrorLeavesUserAlone(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+
+			usr, err := db.insertUser(user{UUID: uuid.NewString(), Email: "unchanged@example.com", Password: []byte("password"), Role: roleUser})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = db.updateUser(usr.ID, func(val *user) error {
+				val.Role = roleAdmin
+				return errUnknownRole
+			})
+
+			if err != errUnknownRole {
+				t.Fatalf("got %v, want the error from fn", err)
+			}
+
+			if stored, _ := db.getUsrByID(usr.ID); stored.Role != roleUser {
+				t.Errorf("role changed to %s", stored.Role)
+			}
+
+			if _, err := db.updateUser(usr.ID+1, func(*user) error { return nil }); err != errUserNotFound {
+				t.Errorf("missing user: got %v, want errUserNotFound", err)
+			}
+		})
+	}
+}
+
+func TestUpdateUserKeepsEmailsUnique(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+
+			for _, email := range []string{"taken@example.com", "mover@example.com"} {
+				if _, err := db.insertUser(user{UUID: uuid.NewString(), Email: email, Password: []byte("password"), Role: roleUser}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := db.updateUser(2, func(val *user) error {
+				val.Email = "taken@example.com"
+				return nil
+			})
+
+			if err != errEmailExists {
+				t.Fatalf("moving onto a taken email: got %v, want errEmailExists", err)
+			}
+
+			// Keeping your own email isn't a clash
+			if _, err := db.updateUser(1, func(val *user) error {
+				val.Is_Chirpy_Red = true
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				if usr, _ := store.getUsrByID(2); usr.Email != "mover@example.com" {
+					t.Errorf("email changed to %s", usr.Email)
+				}
+
+				if usr, ok := store.getByEmail("taken@example.com"); !ok || usr.ID != 1 {
+					t.Errorf("taken@example.com belongs to user %d", usr.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestIDsAreNeverReused(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+
+			first, err := db.insertChirp(chirp{UUID: uuid.NewString(), Chirp: "first", Created_At: time.Now().UTC()})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := db.deleteChirp(first.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if reopen != nil {
+				db = reopen()
+			}
+
+			second, err := db.insertChirp(chirp{UUID: uuid.NewString(), Chirp: "second", Created_At: time.Now().UTC()})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if second.ID <= first.ID {
+				t.Errorf("chirp got ID %d after %d was deleted", second.ID, first.ID)
+			}
+		})
+	}
+}
+
+func TestAuditIDsSkipPastGaps(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	// Written before audit entries had their own sequence, with entry 2 missing
+	data := `{"audit_log":{"1":{"id":1,"action":"approve","body":"one"},"3":{"id":3,"action":"remove","body":"three"}}}`
+
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := newDB(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := db.appendAuditEntry(auditEntry{Action: reviewApprove, Chirp: "four"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entry.ID != 4 {
+		t.Errorf("new entry got ID %d, want 4", entry.ID)
+	}
+
+	entries, err := db.getAuditLog()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("%d entries in the log, want 3", len(entries))
+	}
+}
+
+// Writes a database.json from before refresh tokens were hashed, with a user
+// who has each of the given tokens
+func writeLegacyTokenFile(t *testing.T, path string, tokens ...string) {
+	t.Helper()
+
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	stored := []string{}
+
+	for _, token := range tokens {
+		stored = append(stored, `{"id":1,"expiry_time":"`+expiry+`","refresh_token":"`+token+`"}`)
+	}
+
+	data := `{"chirps":{},"users":{"1":{"id":1,"email":"old@example.com","password":"cGFzc3dvcmQ="}},"refresh_tokens":[` + strings.Join(stored, ",") + `]}`
+
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Fails if any file in dir still holds one of the plaintext tokens
+func checkNoPlaintextTokens(t *testing.T, dir string, tokens ...string) {
+	t.Helper()
+
+	files, err := os.ReadDir(dir)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, token := range tokens {
+			if bytes.Contains(data, []byte(token)) {
+				t.Errorf("%s still holds the plaintext token %s", file.Name(), token)
+			}
+		}
+	}
+}
+
+func TestJSONHashesLegacyRefreshTokens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	tokens := []string{"legacy-token-one", "legacy-token-two"}
+
+	writeLegacyTokenFile(t, path, tokens...)
+
+	db, err := newDB(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkNoPlaintextTokens(t, dir, tokens...)
+
+	if data, _ := os.ReadFile(path); bytes.Contains(data, []byte(`"refresh_tokens"`)) {
+		t.Errorf("legacy token list still written: %s", data)
+	}
+
+	families := map[string]bool{}
+
+	for _, token := range tokens {
+		stored, err := db.getRefrByHash(hashRefreshToken(token))
+
+		if err != nil {
+			t.Fatalf("%s: %v", token, err)
+		}
+
+		// Tokens from before rotation each start their own session
+		if stored.Family_ID == "" || families[stored.Family_ID] || stored.Created_At.IsZero() || stored.ID != 1 {
+			t.Errorf("%s migrated as %+v", token, stored)
+		}
+
+		families[stored.Family_ID] = true
+	}
+
+	// Opening it again leaves the migrated tokens as they are
+	reopened, err := newDB(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		before, _ := db.getRefrByHash(hashRefreshToken(token))
+		after, err := reopened.getRefrByHash(hashRefreshToken(token))
+
+		if err != nil || after.Family_ID != before.Family_ID || !after.Created_At.Equal(before.Created_At) {
+			t.Errorf("%s changed on reopening: %+v, was %+v", token, after, before)
+		}
+	}
+
+	// Users holding an old token stay logged in, and it rotates like any other
+	handler := newTestAPI(t, reopened).routes()
+
+	if code, _ := refresh(t, handler, tokens[0]); code != http.StatusOK {
+		t.Fatalf("refreshing with a migrated token: %d", code)
+	}
+
+	if code, _ := refresh(t, handler, tokens[0]); code != http.StatusUnauthorized {
+		t.Errorf("migrated token reused: got %d, want 401", code)
+	}
+
+	if code, _ := refresh(t, handler, tokens[1]); code != http.StatusOK {
+		t.Errorf("the other migrated token: got %d, want 200", code)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	entityMention = "mention"
+	entityHashtag = "hashtag"
+	entityURL     = "url"
+)
+
+var (
+	urlPattern     = regexp.MustCompile(`https?://[^\s<>"]+`)
+	hashtagPattern = regexp.MustCompile(`#[\p{L}\p{M}\p{N}_]+`)
+	// Users are mentioned by their handle, never by email, see handlePattern
+	mentionPattern = regexp.MustCompile(`@[A-Za-z0-9_]{1,30}`)
+)
+
+// entity is a mention, hashtag or link found in a chirp body
+type entity struct {
+	// One of mention, hashtag or url
+	Type string `json:"type"`
+	// The text as it appears in the body, including the @ or #
+	Text string `json:"text"`
+	// Offsets in Unicode code points, end exclusive, the same as search highlights
+	Start int `json:"start"`
+	End   int `json:"end"`
+	// The mentioned user, the ID is left out of responses when OPAQUE_IDS is set
+	User_ID   int    `json:"user_id,omitempty"`
+	User_UUID string `json:"user_uuid,omitempty"`
+	// The hashtag without the #, normalised so #Café and #cafe are the same tag
+	Tag string `json:"tag,omitempty"`
+}
+
+// Whether the rune before a match joins it to the previous word, like the
+// # in "a#b" or the @ in an email address, in which case it's not an entity
+func joinedToPrevious(body string, start int) bool {
+	if start == 0 {
+		return false
+	}
+
+	prev, _ := utf8.DecodeLastRuneInString(body[:start])
+
+	return unicode.IsLetter(prev) || unicode.IsDigit(prev) || unicode.Is(unicode.M, prev) || strings.ContainsRune("_&@#/", prev)
+}
+
+// Whether a mention runs on into more of a word, like "@bob@example.com" or a
+// handle that's too long, in which case it's not a mention
+func joinedToNext(body string, end int) bool {
+	next, size := utf8.DecodeRuneInString(body[end:])
+
+	return size > 0 && (unicode.IsLetter(next) || unicode.IsDigit(next) || strings.ContainsRune("_@", next))
+}
+
+// Finds the mentions, hashtags and links in a body, ordered by where they
+// start. Mentions still need resolving to users, see resolveMentions.
+func parseEntities(body string) []entity {
+	entities := []entity{}
+	// Byte ranges already taken by links, so a #fragment in a URL isn't a hashtag
+	taken := [][]int{}
+
+	overlaps := func(loc []int) bool {
+		for _, val := range taken {
+			if loc[0] < val[1] && val[0] < loc[1] {
+				return true
+			}
+		}
+		return false
+	}
+
+	add := func(kind string, loc []int) {
+		taken = append(taken, loc)
+		entities = append(entities, entity{
+			Type:  kind,
+			Text:  body[loc[0]:loc[1]],
+			Start: utf8.RuneCountInString(body[:loc[0]]),
+			End:   utf8.RuneCountInString(body[:loc[1]]),
+		})
+	}
+
+	for _, loc := range urlPattern.FindAllStringIndex(body, -1) {
+		// Punctuation at the end usually belongs to the sentence, not the link
+		loc[1] = loc[0] + len(strings.TrimRight(body[loc[0]:loc[1]], ".,;:!?)]}'"))
+		add(entityURL, loc)
+	}
+
+	for _, loc := range mentionPattern.FindAllStringIndex(body, -1) {
+		if !overlaps(loc) && !joinedToPrevious(body, loc[0]) && !joinedToNext(body, loc[1]) {
+			add(entityMention, loc)
+		}
+	}
+
+	for _, loc := range hashtagPattern.FindAllStringIndex(body, -1) {
+		if overlaps(loc) || joinedToPrevious(body, loc[0]) {
+			continue
+		}
+
+		tag := body[loc[0]+1 : loc[1]]
+
+		// #1 is a number, not a tag
+		if strings.IndexFunc(tag, unicode.IsLetter) == -1 {
+			continue
+		}
+
+		add(entityHashtag, loc)
+		entities[len(entities)-1].Tag = normaliseWord(tag)
+	}
+
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].Start < entities[j].Start
+	})
+
+	return entities
+}
+
+// Fills in the user each mention refers to, mentions of handles nobody has are dropped.
+// Handles are public, so this tells the author nothing they couldn't find out anyway.
+func resolveMentions(entities []entity, lookup func(handle string) (user, bool)) []entity {
+	resolved := []entity{}
+
+	for _, val := range entities {
+		if val.Type == entityMention {
+			usr, ok := lookup(strings.ToLower(strings.TrimPrefix(val.Text, "@")))
+
+			if !ok {
+				continue
+			}
+
+			val.User_ID = usr.ID
+			val.User_UUID = usr.UUID
+		}
+
+		resolved = append(resolved, val)
+	}
+
+	return resolved
+}
+
+// Fills in the UUID of users mentioned before mentions carried one, reporting whether anything changed
+func fillMentionUUIDs(entities []entity, lookup func(id int) (user, bool)) bool {
+	changed := false
+
+	for i, val := range entities {
+		if val.Type != entityMention || val.User_UUID != "" {
+			continue
+		}
+
+		if usr, ok := lookup(val.User_ID); ok {
+			entities[i].User_UUID = usr.UUID
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// The normalised tags in a chirp, each once
+func chirpHashtags(val chirp) []string {
+	tags := []string{}
+
+	for _, ent := range val.Entities {
+		if ent.Type == entityHashtag && !containsString(tags, ent.Tag) {
+			tags = append(tags, ent.Tag)
+		}
+	}
+
+	return tags
+}
+
+func containsString(arr []string, val string) bool {
+	for _, s := range arr {
+		if s == val {
+			return true
+		}
+	}
+	return false
+}
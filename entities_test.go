@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes entities as "type text start-end", with the tag of hashtags on the end
+func describeEntities(entities []entity) []string {
+	out := []string{}
+
+	for _, val := range entities {
+		desc := fmt.Sprintf("%s %s %d-%d", val.Type, val.Text, val.Start, val.End)
+
+		if val.Tag != "" {
+			desc += " " + val.Tag
+		}
+
+		out = append(out, desc)
+	}
+
+	return out
+}
+
+func TestParseEntities(t *testing.T) {
+	cases := []struct {
+		body string
+		want []string
+	}{
+		{
+			"hi @alice and #Go https://x.com/a#frag.",
+			[]string{"mention @alice 3-9", "hashtag #Go 14-17 go", "url https://x.com/a#frag 18-38"},
+		},
+		// Offsets count code points, so the emoji is one and the accent is part of its letter
+		{
+			"héllo \U0001F44B @Bob_1 #Café",
+			[]string{"mention @Bob_1 8-14", "hashtag #Café 15-20 cafe"},
+		},
+		{
+			"(@alice), #お茶!",
+			[]string{"mention @alice 1-7", "hashtag #お茶 10-13 お茶"},
+		},
+		// Emails aren't mentions however they're written, and neither is a handle that's too long
+		{"bob@example.com @bob@example.com @" + strings.Repeat("a", 31), []string{}},
+		{"a#b #1 #_", []string{}},
+	}
+
+	for _, tc := range cases {
+		if got := describeEntities(parseEntities(tc.body)); !slices.Equal(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestMentionsResolveHandles(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			handler := newTestAPI(t, db).routes()
+
+			alice := displayUser{}
+			creds := map[string]string{"email": "alice@example.com", "password": "password", "handle": "Alice"}
+
+			if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, &alice); code != http.StatusCreated {
+				t.Fatalf("creating alice: %d", code)
+			}
+
+			if alice.Handle != "alice" {
+				t.Errorf("handle stored as %q, want alice", alice.Handle)
+			}
+
+			bob := signup(t, handler, "bob@example.com")
+
+			mentions := func(body string) []string {
+				t.Helper()
+
+				created := chirp{}
+
+				if code := doRequest(t, handler, http.MethodPost, "/api/chirps", bob.Token, map[string]string{"body": body}, &created); code != http.StatusCreated {
+					t.Fatalf("chirping %q: %d", body, code)
+				}
+
+				users := []string{}
+
+				for _, val := range created.Entities {
+					users = append(users, val.Text+" "+val.User_UUID)
+				}
+
+				return users
+			}
+
+			if got := mentions("hi @ALICE and @nobody"); !slices.Equal(got, []string{"@ALICE " + alice.UUID}) {
+				t.Errorf("got %v, want only alice", got)
+			}
+
+			// Whether an email is registered can't be told from what becomes of a chirp mentioning it
+			registered := mentions("hi @alice@example.com")
+			unregistered := mentions("hi @carol@example.com")
+
+			if len(registered) != 0 || len(unregistered) != 0 {
+				t.Errorf("emails were resolved: %v and %v", registered, unregistered)
+			}
+
+			// Users without a handle can't be mentioned until they pick one
+			if got := mentions("@bob"); len(got) != 0 {
+				t.Errorf("bob has no handle yet, got %v", got)
+			}
+
+			update := func(body map[string]string, out any) int {
+				return doRequest(t, handler, http.MethodPut, "/api/users", bob.Token, body, out)
+			}
+
+			if code := update(map[string]string{"email": "bob@example.com", "password": "password", "handle": "ALICE"}, nil); code != http.StatusConflict {
+				t.Errorf("taking alice's handle: got %d, want 409", code)
+			}
+
+			resp := errResponse{}
+
+			if code := update(map[string]string{"email": "bob@example.com", "password": "password", "handle": "bob smith"}, &resp); code != http.StatusBadRequest || resp.Code != errInvalidHandle.Code {
+				t.Errorf("invalid handle: got %d %+v", code, resp)
+			}
+
+			if code := update(map[string]string{"email": "bob@example.com", "password": "password", "handle": "bob"}, nil); code != http.StatusOK {
+				t.Fatalf("picking a handle: %d", code)
+			}
+
+			// Leaving the handle out of an update keeps it
+			updated := displayUser{}
+
+			if code := update(map[string]string{"email": "bob@example.com", "password": "password"}, &updated); code != http.StatusOK || updated.Handle != "bob" {
+				t.Errorf("update without a handle: got %d with handle %q", code, updated.Handle)
+			}
+
+			if got := mentions("@bob"); !slices.Equal(got, []string{"@bob " + bob.UUID}) {
+				t.Errorf("got %v, want bob", got)
+			}
+
+			if reopen == nil {
+				return
+			}
+
+			stored, ok := reopen().getByHandle("bob")
+
+			if !ok || stored.UUID != bob.UUID {
+				t.Errorf("after reopening, bob's handle finds %+v", stored)
+			}
+		})
+	}
+}
+
+func TestHashtagListing(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	author := newThreadAuthor(t, handler, "author@example.com")
+
+	author.post("#Café one", chirp{})
+	author.post("two #cafe", chirp{})
+	trashed := author.post("gone #CAFE", chirp{})
+	// A tag used twice in a chirp lists it once
+	author.post("#CAFE three #cafe", chirp{})
+	author.post("#other", chirp{})
+
+	if code := doRequest(t, handler, http.MethodDelete, "/api/chirps/"+trashed.UUID, author.token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("trashing: %d", code)
+	}
+
+	want := []string{"#CAFE three #cafe", "two #cafe", "#Café one"}
+
+	// The tag can be asked for in any form it folds to, with or without the #
+	for _, tag := range []string{"cafe", "Café", "#CAFE"} {
+		path := "/api/hashtags/" + url.PathEscape(tag) + "?limit=2"
+
+		if got := readAllPages(t, handler, path, nil); !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", tag, got, want)
+		}
+	}
+
+	if got := readAllPages(t, handler, "/api/hashtags/missing?limit=2", nil); len(got) != 0 {
+		t.Errorf("unused tag: got %q", got)
+	}
+}
+
+func TestTrendingWindow(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	now := time.Now().UTC()
+	ages := []struct {
+		tag  string
+		ages []time.Duration
+	}{
+		{"recent", []time.Duration{time.Minute, 10 * time.Minute}},
+		{"steady", []time.Duration{time.Minute, 2 * time.Hour, 3 * time.Hour, 5 * time.Hour}},
+		{"old", []time.Duration{30 * time.Hour, 40 * time.Hour, 50 * time.Hour}},
+		{"tied", []time.Duration{20 * time.Minute, 2 * time.Hour}},
+	}
+
+	id := 0
+
+	for _, val := range ages {
+		for _, age := range val.ages {
+			id++
+			apicfg.hashtags.add(chirp{ID: id, Created_At: now.Add(-age), Entities: parseEntities("#" + val.tag)})
+		}
+	}
+
+	trending := func(query string) []string {
+		t.Helper()
+
+		tags := []trendingTag{}
+
+		if code := doRequest(t, handler, http.MethodGet, "/api/trending"+query, "", nil, &tags); code != http.StatusOK {
+			t.Fatalf("%s: %d", query, code)
+		}
+
+		out := []string{}
+
+		for _, val := range tags {
+			out = append(out, fmt.Sprintf("%s:%d", val.Tag, val.Count))
+		}
+
+		return out
+	}
+
+	cases := []struct {
+		query string
+		want  []string
+	}{
+		// The default window is a day
+		{"", []string{"steady:4", "recent:2", "tied:2"}},
+		{"?window=1h", []string{"recent:2", "steady:1", "tied:1"}},
+		{"?window=15m", []string{"recent:2", "steady:1"}},
+		{"?window=72h", []string{"steady:4", "old:3", "recent:2", "tied:2"}},
+		{"?window=72h&limit=2", []string{"steady:4", "old:3"}},
+		{"?window=1ns", []string{}},
+	}
+
+	for _, tc := range cases {
+		if got := trending(tc.query); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.query, got, tc.want)
+		}
+	}
+
+	// Taking a chirp down takes it out of the counts, ties are in tag order
+	apicfg.hashtags.remove(1)
+
+	if got := trending("?window=15m"); !slices.Equal(got, []string{"recent:1", "steady:1"}) {
+		t.Errorf("after removing a chirp: got %v", got)
+	}
+
+	for _, query := range []string{"?window=0s", "?window=-1h", "?window=soon", "?limit=0", "?limit=x"} {
+		if code := doRequest(t, handler, http.MethodGet, "/api/trending"+query, "", nil, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, code)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errCannotFollowSelf = errors.New("users can't follow themselves")
+
+// follow is one user following another
+type follow struct {
+	Follower_ID int       `json:"follower_id"`
+	Followee_ID int       `json:"followee_id"`
+	Created_At  time.Time `json:"created_at"`
+}
+
+// A user in a follower or following listing
+type followedUser struct {
+	displayUser
+	Followed_At time.Time `json:"followed_at"`
+}
+
+// Resolves the user a follow request is about, making sure they exist
+func (apicfg *apiConfig) followTarget(followerID int, param string) (int, error) {
+	followeeID, err := apicfg.userIDFromParam(param)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if _, err := apicfg.db.getUsrByID(followeeID); err != nil {
+		return -1, err
+	}
+
+	if followeeID == followerID {
+		return -1, errCannotFollowSelf
+	}
+
+	return followeeID, nil
+}
+
+func (apicfg *apiConfig) followUser(followerID int, param string) error {
+	followeeID, err := apicfg.followTarget(followerID, param)
+
+	if err != nil {
+		return err
+	}
+
+	if err := apicfg.db.addFollow(followerID, followeeID, time.Now().UTC()); err != nil {
+		return err
+	}
+
+	return apicfg.timelines.followed(followerID, followeeID)
+}
+
+func (apicfg *apiConfig) unfollowUser(followerID int, param string) error {
+	followeeID, err := apicfg.followTarget(followerID, param)
+
+	if err != nil {
+		return err
+	}
+
+	if err := apicfg.db.removeFollow(followerID, followeeID); err != nil {
+		return err
+	}
+
+	return apicfg.timelines.unfollowed(followerID, followeeID)
+}
+
+// Looks up the users on the other side of each follow, pick returns which one that is
+func (apicfg *apiConfig) followListing(follows []follow, pick func(follow) int) ([]followedUser, error) {
+	listing := []followedUser{}
+
+	for _, val := range follows {
+		usr, err := apicfg.db.getUsrByID(pick(val))
+
+		if err != nil {
+			return []followedUser{}, err
+		}
+
+		listing = append(listing, followedUser{displayUser: apicfg.publicUser(usr), Followed_At: val.Created_At})
+	}
+
+	return listing, nil
+}
+
+// Everyone following the user named by param
+func (apicfg *apiConfig) getFollowers(param string) ([]followedUser, error) {
+	userID, err := apicfg.userIDFromParam(param)
+
+	if err != nil {
+		return []followedUser{}, err
+	}
+
+	if _, err := apicfg.db.getUsrByID(userID); err != nil {
+		return []followedUser{}, err
+	}
+
+	follows, err := apicfg.db.getFollowers(userID)
+
+	if err != nil {
+		return []followedUser{}, err
+	}
+
+	return apicfg.followListing(follows, func(val follow) int { return val.Follower_ID })
+}
+
+// Everyone the user named by param follows
+func (apicfg *apiConfig) getFollowing(param string) ([]followedUser, error) {
+	userID, err := apicfg.userIDFromParam(param)
+
+	if err != nil {
+		return []followedUser{}, err
+	}
+
+	if _, err := apicfg.db.getUsrByID(userID); err != nil {
+		return []followedUser{}, err
+	}
+
+	follows, err := apicfg.db.getFollowing(userID)
+
+	if err != nil {
+		return []followedUser{}, err
+	}
+
+	return apicfg.followListing(follows, func(val follow) int { return val.Followee_ID })
+}
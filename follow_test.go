@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func followingEmails(t *testing.T, handler http.Handler, path string) []string {
+	t.Helper()
+
+	listing := []followedUser{}
+
+	if code := doRequest(t, handler, http.MethodGet, path, "", nil, &listing); code != http.StatusOK {
+		t.Fatalf("GET %s: %d", path, code)
+	}
+
+	emails := []string{}
+
+	for _, val := range listing {
+		emails = append(emails, val.Email)
+	}
+
+	return emails
+}
+
+func TestFollowAndUnfollow(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+			handler := newTestAPI(t, db).routes()
+
+			a := signup(t, handler, "a@example.com")
+			b := signup(t, handler, "b@example.com")
+			c := signup(t, handler, "c@example.com")
+
+			follow := func(method string, token string, target jwtResponse) int {
+				t.Helper()
+				return doRequest(t, handler, method, "/api/users/"+target.UUID+"/follow", token, nil, nil)
+			}
+
+			for _, target := range []jwtResponse{b, c, b} {
+				// Following twice is a no-op
+				if code := follow(http.MethodPost, a.Token, target); code != http.StatusNoContent {
+					t.Fatalf("following %s: %d", target.Email, code)
+				}
+			}
+
+			if code := follow(http.MethodPost, c.Token, b); code != http.StatusNoContent {
+				t.Fatalf("c following b: %d", code)
+			}
+
+			if got := followingEmails(t, handler, "/api/users/"+a.UUID+"/following"); !slices.Equal(got, []string{"c@example.com", "b@example.com"}) {
+				t.Errorf("a follows %v", got)
+			}
+
+			if got := followingEmails(t, handler, fmt.Sprintf("/api/users/%d/followers", b.ID)); !slices.Equal(got, []string{"c@example.com", "a@example.com"}) {
+				t.Errorf("b's followers %v", got)
+			}
+
+			if code := follow(http.MethodPost, a.Token, a); code != http.StatusBadRequest {
+				t.Errorf("following yourself: got %d, want 400", code)
+			}
+
+			if code := follow(http.MethodPost, "", b); code != http.StatusUnauthorized {
+				t.Errorf("following without a token: got %d, want 401", code)
+			}
+
+			missing := jwtResponse{UUID: "5f0c7d1e-0000-4000-8000-000000000000"}
+
+			if code := follow(http.MethodPost, a.Token, missing); code != http.StatusNotFound {
+				t.Errorf("following a missing user: got %d, want 404", code)
+			}
+
+			if code := doRequest(t, handler, http.MethodGet, "/api/users/"+missing.UUID+"/followers", "", nil, nil); code != http.StatusNotFound {
+				t.Errorf("followers of a missing user: got %d, want 404", code)
+			}
+
+			for i := 0; i < 2; i++ {
+				// Unfollowing someone you don't follow is a no-op too
+				if code := follow(http.MethodDelete, a.Token, b); code != http.StatusNoContent {
+					t.Fatalf("unfollowing b: %d", code)
+				}
+			}
+
+			if got := followingEmails(t, handler, "/api/users/"+a.UUID+"/following"); !slices.Equal(got, []string{"c@example.com"}) {
+				t.Errorf("a follows %v after unfollowing b", got)
+			}
+
+			if got := followingEmails(t, handler, "/api/users/"+b.UUID+"/followers"); !slices.Equal(got, []string{"c@example.com"}) {
+				t.Errorf("b's followers %v after a unfollowed", got)
+			}
+		})
+	}
+}
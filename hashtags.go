@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrendingWindow = 24 * time.Hour
+	defaultTrendingLimit  = 10
+)
+
+// hashtagIndex maps tags to the live chirps using them. Like the search index
+// it's built from the store at startup and kept up to date as chirps are
+// published and taken down.
+type hashtagIndex struct {
+	mux *sync.RWMutex
+	// Normalised tag -> chirps using it, newest first
+	tags map[string][]timelineEntry
+	// Chirp ID -> its tags, kept to remove it again
+	chirps map[int][]string
+}
+
+type trendingTag struct {
+	Tag string `json:"tag"`
+	// Chirps using the tag within the window
+	Count int `json:"count"`
+}
+
+func newHashtagIndex() *hashtagIndex {
+	return &hashtagIndex{
+		mux:    &sync.RWMutex{},
+		tags:   map[string][]timelineEntry{},
+		chirps: map[int][]string{},
+	}
+}
+
+func buildHashtagIndex(db Store) (*hashtagIndex, error) {
+	index := newHashtagIndex()
+
+	chirpArr, err := db.getAllChirps()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, val := range chirpArr {
+		index.add(val)
+	}
+
+	return index, nil
+}
+
+// Indexes a chirp under its tags, replacing what was there for it before
+func (index *hashtagIndex) add(val chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(val.ID)
+
+	tags := chirpHashtags(val)
+
+	for _, tag := range tags {
+		entries := index.tags[tag]
+		entry := newTimelineEntry(val)
+
+		i := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].newerThan(entry)
+		})
+
+		entries = append(entries, timelineEntry{})
+		copy(entries[i+1:], entries[i:])
+		entries[i] = entry
+
+		index.tags[tag] = entries
+	}
+
+	if len(tags) > 0 {
+		index.chirps[val.ID] = tags
+	}
+}
+
+func (index *hashtagIndex) remove(id int) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(id)
+}
+
+func (index *hashtagIndex) removeLocked(id int) {
+	for _, tag := range index.chirps[id] {
+		kept := []timelineEntry{}
+
+		for _, entry := range index.tags[tag] {
+			if entry.Chirp_ID != id {
+				kept = append(kept, entry)
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(index.tags, tag)
+		} else {
+			index.tags[tag] = kept
+		}
+	}
+
+	delete(index.chirps, id)
+}
+
+// Up to limit IDs of chirps with the tag, newest first, after the cursor
+func (index *hashtagIndex) page(tag string, after *chirpCursor, limit int) []int {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	entries := index.tags[normaliseWord(tag)]
+	start := 0
+
+	if after != nil {
+		cursor := timelineEntry{Chirp_ID: after.ID, Created_At: after.Created_At}
+
+		start = sort.Search(len(entries), func(i int) bool {
+			return cursor.newerThan(entries[i])
+		})
+	}
+
+	ids := []int{}
+
+	for _, entry := range entries[start:] {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, entry.Chirp_ID)
+	}
+
+	return ids
+}
+
+// The tags used by the most chirps created since the start of the window, most used first
+func (index *hashtagIndex) trending(window time.Duration, limit int) []trendingTag {
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	since := time.Now().UTC().Add(-window)
+	trending := []trendingTag{}
+
+	for tag, entries := range index.tags {
+		// Newest first, so the count is where the window ends
+		count := sort.Search(len(entries), func(i int) bool {
+			return entries[i].Created_At.Before(since)
+		})
+
+		if count > 0 {
+			trending = append(trending, trendingTag{Tag: tag, Count: count})
+		}
+	}
+
+	sort.Slice(trending, func(i, j int) bool {
+		if trending[i].Count != trending[j].Count {
+			return trending[i].Count > trending[j].Count
+		}
+		return trending[i].Tag < trending[j].Tag
+	})
+
+	if len(trending) > limit {
+		trending = trending[:limit]
+	}
+
+	return trending
+}
+
+// Chirps with a tag, newest first, the page after the cursor
+func (apicfg *apiConfig) hashtagChirps(tag string, after *chirpCursor, limit int) ([]chirp, error) {
+	chirpArr := []chirp{}
+
+	for _, id := range apicfg.hashtags.page(tag, after, limit) {
+		val, err := apicfg.db.getChirp(id)
+
+		// Gone since it was indexed
+		if errors.Is(err, errChirpNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return []chirp{}, err
+		}
+
+		if val.Deleted_At != nil || val.Flagged {
+			continue
+		}
+
+		chirpArr = append(chirpArr, val)
+	}
+
+	return chirpArr, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Every transaction on the JSON database is first appended to the journal as
+// the set of keys it changed and fsync'd, then the full snapshot is rewritten
+// atomically and the journal is cleared. If chirpy dies in between, the
+// entries left in the journal are replayed over the snapshot on the next start.
+//
+// A transaction is a single line holding a JSON array of its entries, written
+// in one go. A line is only complete once its newline is there, so a crash
+// part way through writing one drops the whole transaction and never half of it.
+//
+// Entries work on the JSON form of DBStructure, so new collections added to it
+// are journaled without any extra code: maps are diffed per key, anything else
+// is replaced whole.
+
+type journalEntry struct {
+	Field  string          `json:"field"`
+	Key    string          `json:"key,omitempty"`
+	Value  json.RawMessage `json:"value,omitempty"`
+	Delete bool            `json:"delete,omitempty"`
+}
+
+func splitSnapshot(data []byte) (map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+
+	if len(data) == 0 {
+		return fields, nil
+	}
+
+	err := json.Unmarshal(data, &fields)
+
+	return fields, err
+}
+
+func isJSONObject(data json.RawMessage) bool {
+	trimmed := bytes.TrimSpace(data)
+	return len(trimmed) > 0 && trimmed[0] == '{'
+}
+
+// Works out the journal entries that turn the old snapshot into the new one
+func diffSnapshots(oldData, newData []byte) ([]journalEntry, error) {
+	oldFields, err := splitSnapshot(oldData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	newFields, err := splitSnapshot(newData)
+
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []journalEntry{}
+
+	for field, newVal := range newFields {
+		oldVal, ok := oldFields[field]
+
+		if ok && bytes.Equal(oldVal, newVal) {
+			continue
+		}
+
+		if !ok || !isJSONObject(oldVal) || !isJSONObject(newVal) {
+			entries = append(entries, journalEntry{Field: field, Value: newVal})
+			continue
+		}
+
+		oldMap := map[string]json.RawMessage{}
+		newMap := map[string]json.RawMessage{}
+
+		if err := json.Unmarshal(oldVal, &oldMap); err != nil {
+			return nil, err
+		}
+
+		if err := json.Unmarshal(newVal, &newMap); err != nil {
+			return nil, err
+		}
+
+		for key, val := range newMap {
+			if oldKeyVal, ok := oldMap[key]; !ok || !bytes.Equal(oldKeyVal, val) {
+				entries = append(entries, journalEntry{Field: field, Key: key, Value: val})
+			}
+		}
+
+		for key := range oldMap {
+			if _, ok := newMap[key]; !ok {
+				entries = append(entries, journalEntry{Field: field, Key: key, Delete: true})
+			}
+		}
+	}
+
+	for field := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			entries = append(entries, journalEntry{Field: field, Delete: true})
+		}
+	}
+
+	return entries, nil
+}
+
+// Applies journal entries to a snapshot, returning the new snapshot
+func applyJournal(data []byte, entries []journalEntry) ([]byte, error) {
+	fields, err := splitSnapshot(data)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.Key == "" {
+			if entry.Delete {
+				delete(fields, entry.Field)
+			} else {
+				fields[entry.Field] = entry.Value
+			}
+			continue
+		}
+
+		keyed := map[string]json.RawMessage{}
+
+		if existing, ok := fields[entry.Field]; ok && isJSONObject(existing) {
+			if err := json.Unmarshal(existing, &keyed); err != nil {
+				return nil, err
+			}
+		}
+
+		if entry.Delete {
+			delete(keyed, entry.Key)
+		} else {
+			keyed[entry.Key] = entry.Value
+		}
+
+		fields[entry.Field], err = json.Marshal(keyed)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(fields)
+}
+
+func (db *DB) journalPath() string {
+	return db.path + ".journal"
+}
+
+func (db *DB) appendJournal(entries []journalEntry) error {
+	data, err := json.Marshal(entries)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(db.journalPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func (db *DB) clearJournal() error {
+	err := os.Truncate(db.journalPath(), 0)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Applies whatever is left in the journal on top of the snapshot, then folds it in
+func (db *DB) replayJournal() error {
+	entries, err := db.readJournal()
+
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	snapshot, err := os.ReadFile(db.path)
+
+	if err != nil {
+		return err
+	}
+
+	snapshot, err = applyJournal(snapshot, entries)
+
+	if err != nil {
+		return fmt.Errorf("database file %s is corrupt: %w", db.path, err)
+	}
+
+	if err := writeFileAtomic(db.path, snapshot, os.FileMode(0644)); err != nil {
+		return err
+	}
+
+	return db.clearJournal()
+}
+
+// The entries in the journal that haven't been folded into the snapshot yet
+func (db *DB) readJournal() ([]journalEntry, error) {
+	data, err := os.ReadFile(db.journalPath())
+
+	if os.IsNotExist(err) || len(data) == 0 {
+		return []journalEntry{}, nil
+	}
+
+	if err != nil {
+		return []journalEntry{}, err
+	}
+
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n"))
+
+	entries := []journalEntry{}
+
+	for i, line := range lines {
+		last := i == len(lines)-1
+
+		// A final line without its newline is a transaction that was never acknowledged
+		if last && !bytes.HasSuffix(data, []byte("\n")) {
+			break
+		}
+
+		tx := []journalEntry{}
+
+		if err := json.Unmarshal(line, &tx); err != nil {
+			// Nor was one that didn't reach the disk whole, even if its newline did
+			if last {
+				break
+			}
+			return []journalEntry{}, fmt.Errorf("journal %s is corrupt at transaction %d: %w", db.journalPath(), i+1, err)
+		}
+
+		entries = append(entries, tx...)
+	}
+
+	return entries, nil
+}
+
+// Writes to a temp file in the same directory and renames it over path, so
+// readers only ever see the old or the new contents
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// fsync the directory so the rename itself survives a crash
+	d, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Two users added in one transaction, as the journal records it
+func twoUserTransaction(t *testing.T) []journalEntry {
+	t.Helper()
+
+	before := []byte(`{"users":{}}`)
+	after := []byte(`{"users":{"1":{"id":1,"email":"one@example.com"},"2":{"id":2,"email":"two@example.com"}}}`)
+
+	entries, err := diffSnapshots(before, after)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("diff has %d entries, want 2", len(entries))
+	}
+
+	return entries
+}
+
+func TestJournalWritesATransactionPerLine(t *testing.T) {
+	db := &DB{path: filepath.Join(t.TempDir(), "database.json")}
+
+	if err := db.appendJournal(twoUserTransaction(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(db.journalPath())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if lines := bytes.Count(data, []byte("\n")); lines != 1 {
+		t.Errorf("transaction written as %d lines, want 1", lines)
+	}
+}
+
+func TestReplayDropsTornTransactions(t *testing.T) {
+	entries := twoUserTransaction(t)
+
+	// Written in full, then cut off part way through the second entry
+	full := &DB{path: filepath.Join(t.TempDir(), "full.json")}
+
+	if err := full.appendJournal(entries); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := os.ReadFile(full.journalPath())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cut := bytes.Index(line, []byte("two@example.com"))
+
+	cases := map[string][]byte{
+		"cut short":        line[:cut],
+		"cut at a newline": append(append([]byte{}, line[:cut]...), '\n'),
+		"missing newline":  bytes.TrimSuffix(line, []byte("\n")),
+	}
+
+	for name, torn := range cases {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+
+			if err := os.WriteFile(path, []byte(`{"users":{}}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			committed := []byte(`[{"field":"users","key":"3","value":{"id":3,"email":"three@example.com"}}]` + "\n")
+
+			if err := os.WriteFile(path+".journal", append(committed, torn...), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := newDB(path)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.getUsrByID(3); err != nil {
+				t.Errorf("committed transaction lost: %v", err)
+			}
+
+			for _, id := range []int{1, 2} {
+				if _, err := db.getUsrByID(id); err == nil {
+					t.Errorf("user %d from the torn transaction was replayed", id)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Smaller RSA keys can be factored, they're refused
+	minRSAKeyBits = 2048
+	// Short enough that a key added for rotation is picked up well before it signs anything
+	jwksCacheControl = "public, max-age=300"
+	// HS256 tokens last an hour, so there's no reason to keep accepting them for longer
+	// than this after switching to a signing key
+	maxLegacyWindow = 24 * time.Hour
+)
+
+var errUnknownKey = errors.New("token signed with an unknown key")
+
+// jwtKey is an RS256 or EdDSA key loaded from a PEM file
+type jwtKey struct {
+	// RFC 7638 thumbprint of the public key, sent as the kid header
+	ID     string
+	Method jwt.SigningMethod
+	// Nil for keys only used to verify
+	Private crypto.PrivateKey
+	Public  crypto.PublicKey
+}
+
+// keyRing holds the key new JWTs are signed with and every key they're still
+// accepted from. Keeping the old and next keys in the ring while the signing
+// key is swapped means tokens keep working through a rotation.
+type keyRing struct {
+	// Nil when JWTs are signed with JWT_SECRET instead
+	signing *jwtKey
+	byID    map[string]*jwtKey
+	// In the order they were configured, for the JWKS
+	keys []*jwtKey
+	// Until when HS256 tokens signed with JWT_SECRET are still accepted alongside
+	// the signing key, zero when they aren't
+	legacyUntil time.Time
+}
+
+// A public key in JWK form, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA modulus and exponent
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519 curve and public key
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// Loads the signing key and the comma separated verification keys. With no
+// signing key JWTs are signed with JWT_SECRET, as they were before.
+func loadKeyRing(signingPath, verifyPaths string) (*keyRing, error) {
+	ring := &keyRing{byID: map[string]*jwtKey{}}
+
+	if signingPath != "" {
+		key, err := loadJWTKey(signingPath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if key.Private == nil {
+			return nil, fmt.Errorf("signing key %s is a public key, it needs the private key", signingPath)
+		}
+
+		ring.signing = key
+		ring.add(key)
+	}
+
+	for _, path := range strings.Split(verifyPaths, ",") {
+		path = strings.TrimSpace(path)
+
+		if path == "" {
+			continue
+		}
+
+		key, err := loadJWTKey(path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ring.add(key)
+	}
+
+	return ring, nil
+}
+
+// Parses JWT_LEGACY_HS256_UNTIL, the RFC 3339 time HS256 tokens stop being accepted
+// once there's a signing key. It has to be within a day, so the opt-in can't be
+// left on by accident.
+func parseLegacyDeadline(val string, now time.Time) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	}
+
+	deadline, err := time.Parse(time.RFC3339, val)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("JWT_LEGACY_HS256_UNTIL: %w", err)
+	}
+
+	if deadline.After(now.Add(maxLegacyWindow)) {
+		return time.Time{}, fmt.Errorf("JWT_LEGACY_HS256_UNTIL is more than %s away", maxLegacyWindow)
+	}
+
+	return deadline, nil
+}
+
+func (ring *keyRing) add(key *jwtKey) {
+	if _, ok := ring.byID[key.ID]; ok {
+		return
+	}
+
+	ring.byID[key.ID] = key
+	ring.keys = append(ring.keys, key)
+}
+
+// Reads a private or public RS256 or Ed25519 key from a PEM file
+func loadJWTKey(path string) (*jwtKey, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+
+	if block == nil {
+		return nil, fmt.Errorf("%s is not a PEM file", path)
+	}
+
+	var parsed any
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := &jwtKey{}
+
+	switch val := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodRS256, val, &val.PublicKey
+	case *rsa.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodRS256, val
+	case ed25519.PrivateKey:
+		key.Method, key.Private, key.Public = jwt.SigningMethodEdDSA, val, val.Public()
+	case ed25519.PublicKey:
+		key.Method, key.Public = jwt.SigningMethodEdDSA, val
+	default:
+		return nil, fmt.Errorf("%s: only RSA and Ed25519 keys are supported", path)
+	}
+
+	if pub, ok := key.Public.(*rsa.PublicKey); ok && pub.N.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("%s: RSA keys need at least %d bits", path, minRSAKeyBits)
+	}
+
+	key.ID = jwkThumbprint(key.jwk())
+
+	return key, nil
+}
+
+func (key *jwtKey) jwk() jwk {
+	val := jwk{Kid: key.ID, Use: "sig", Alg: key.Method.Alg()}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		val.Kty = "RSA"
+		val.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		val.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		val.Kty = "OKP"
+		val.Crv = "Ed25519"
+		val.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return val
+}
+
+// RFC 7638, the SHA-256 of the required members of the JWK in lexical order
+func jwkThumbprint(val jwk) string {
+	var members string
+
+	if val.Kty == "RSA" {
+		members = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, val.E, val.N)
+	} else {
+		members = fmt.Sprintf(`{"crv":%q,"kty":"OKP","x":%q}`, val.Crv, val.X)
+	}
+
+	sum := sha256.Sum256([]byte(members))
+
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// The public half of every key in the ring, for other services to verify our JWTs with
+func (ring *keyRing) jwks() jwkSet {
+	set := jwkSet{Keys: []jwk{}}
+
+	for _, key := range ring.keys {
+		set.Keys = append(set.Keys, key.jwk())
+	}
+
+	return set
+}
+
+// Signs claims with the signing key, or with JWT_SECRET when there isn't one
+func (apicfg *apiConfig) signJWT(claims jwt.Claims) (string, error) {
+	key := apicfg.jwtKeys.signing
+
+	if key == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(apicfg.jwtSecret))
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.Private)
+}
+
+// Finds the key a JWT was signed with. Tokens without a kid are HS256 ones
+// signed with JWT_SECRET. Once there's a signing key they're only accepted
+// until JWT_LEGACY_HS256_UNTIL, so switching doesn't have to log everyone out
+// but the shared secret can't go on issuing valid tokens.
+func (apicfg *apiConfig) jwtKeyFunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	if kid == "" {
+		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() || apicfg.jwtSecret == "" {
+			return nil, errUnknownKey
+		}
+
+		if apicfg.jwtKeys.signing != nil && !time.Now().Before(apicfg.jwtKeys.legacyUntil) {
+			return nil, errUnknownKey
+		}
+
+		return []byte(apicfg.jwtSecret), nil
+	}
+
+	key, ok := apicfg.jwtKeys.byID[kid]
+
+	// The algorithm has to be the key's, so a token can't pick a weaker one
+	if !ok || token.Method.Alg() != key.Method.Alg() {
+		return nil, errUnknownKey
+	}
+
+	return key.Public, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Writes key to a PEM file in dir, private keys as PKCS #8 and public ones as PKIX
+func writePEMKey(t *testing.T, dir, name string, key any) string {
+	t.Helper()
+
+	var block *pem.Block
+
+	switch val := key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey, *ecdsa.PrivateKey:
+		der, err := x509.MarshalPKCS8PrivateKey(val)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		der, err := x509.MarshalPKIXPublicKey(val)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	}
+
+	path := filepath.Join(dir, name)
+
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Keys shared by the tests, RSA ones are slow to generate
+var testKeys = struct {
+	rsa     *rsa.PrivateKey
+	ed      ed25519.PrivateKey
+	otherEd ed25519.PrivateKey
+}{}
+
+func init() {
+	var err error
+
+	if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, minRSAKeyBits); err != nil {
+		panic(err)
+	}
+
+	if _, testKeys.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		panic(err)
+	}
+
+	if _, testKeys.otherEd, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+// A ring signing with the Ed25519 key, which also accepts the RSA key and the
+// public half of the other Ed25519 key
+func testKeyRing(t *testing.T) *keyRing {
+	t.Helper()
+
+	dir := t.TempDir()
+	verify := []string{
+		writePEMKey(t, dir, "rsa.pem", testKeys.rsa),
+		writePEMKey(t, dir, "other.pub", testKeys.otherEd.Public()),
+	}
+
+	ring, err := loadKeyRing(writePEMKey(t, dir, "ed.pem", testKeys.ed), strings.Join(verify, ", "))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ring
+}
+
+// Signs a JWT for user 1 with the given method and key, with kid in the header if it isn't empty
+func signTestJWT(t *testing.T, method jwt.SigningMethod, key any, kid string) string {
+	t.Helper()
+
+	claims := jwt.MapClaims{
+		"iss": "chirpy",
+		"exp": jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		"sub": "1",
+	}
+
+	token := jwt.NewWithClaims(method, claims)
+
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	signed, err := token.SignedString(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestLoadJWTKey(t *testing.T) {
+	dir := t.TempDir()
+
+	small, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PKCS #1, as openssl genrsa writes it
+	pkcs1 := filepath.Join(dir, "rsa1.pem")
+
+	if err := os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(testKeys.rsa)}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		path    string
+		alg     string
+		private bool
+	}{
+		{"rsa private", writePEMKey(t, dir, "rsa.pem", testKeys.rsa), "RS256", true},
+		{"rsa public", writePEMKey(t, dir, "rsa.pub", &testKeys.rsa.PublicKey), "RS256", false},
+		{"ed25519 private", writePEMKey(t, dir, "ed.pem", testKeys.ed), "EdDSA", true},
+		{"ed25519 public", writePEMKey(t, dir, "ed.pub", testKeys.ed.Public()), "EdDSA", false},
+		{"rsa pkcs1", pkcs1, "RS256", true},
+	}
+
+	for _, tc := range cases {
+		key, err := loadJWTKey(tc.path)
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		if key.Method.Alg() != tc.alg || (key.Private != nil) != tc.private {
+			t.Errorf("%s: got %s with private key %t", tc.name, key.Method.Alg(), key.Private != nil)
+		}
+	}
+
+	// The private and public halves of a key have the same kid
+	private, _ := loadJWTKey(cases[0].path)
+	public, _ := loadJWTKey(cases[1].path)
+
+	if private.ID != public.ID {
+		t.Errorf("kid of the private key %s differs from the public key's %s", private.ID, public.ID)
+	}
+
+	notPEM := filepath.Join(dir, "key.txt")
+
+	if err := os.WriteFile(notPEM, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	refused := []struct {
+		name string
+		path string
+		want string
+	}{
+		{"short rsa private", writePEMKey(t, dir, "small.pem", small), "at least 2048 bits"},
+		{"short rsa public", writePEMKey(t, dir, "small.pub", &small.PublicKey), "at least 2048 bits"},
+		{"ecdsa", writePEMKey(t, dir, "ec.pem", ec), "only RSA and Ed25519"},
+		{"not pem", notPEM, "not a PEM file"},
+		{"missing", filepath.Join(dir, "missing.pem"), "no such file"},
+	}
+
+	for _, tc := range refused {
+		if _, err := loadJWTKey(tc.path); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error about %q", tc.name, err, tc.want)
+		}
+	}
+
+	// Only private keys can sign
+	if _, err := loadKeyRing(cases[3].path, ""); err == nil {
+		t.Errorf("a public key was accepted as the signing key")
+	}
+
+	if _, err := loadKeyRing("", cases[0].path+","+refused[0].path); err == nil {
+		t.Errorf("a short RSA key was accepted as a verification key")
+	}
+}
+
+func TestJWTKeyLookup(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.jwtKeys = testKeyRing(t)
+	handler := apicfg.routes()
+
+	user := signup(t, handler, "user@example.com")
+
+	// New tokens are signed with the signing key and name it
+	token, _, err := jwt.NewParser().ParseUnverified(user.Token, jwt.MapClaims{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Method.Alg() != "EdDSA" || token.Header["kid"] != apicfg.jwtKeys.signing.ID {
+		t.Errorf("new token is %s with kid %v", token.Method.Alg(), token.Header["kid"])
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/sessions", user.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("token from the signing key: got %d", code)
+	}
+
+	rsaKey, _ := loadJWTKey(writePEMKey(t, t.TempDir(), "rsa.pub", &testKeys.rsa.PublicKey))
+	otherKey, _ := loadJWTKey(writePEMKey(t, t.TempDir(), "other.pub", testKeys.otherEd.Public()))
+
+	accepted := map[string]string{
+		"verification rsa key":     signTestJWT(t, jwt.SigningMethodRS256, testKeys.rsa, rsaKey.ID),
+		"verification ed25519 key": signTestJWT(t, jwt.SigningMethodEdDSA, testKeys.otherEd, otherKey.ID),
+	}
+
+	for name, token := range accepted {
+		claims, err := apicfg.parseJWT("Bearer " + token)
+
+		if err != nil || claims.Subject != "1" {
+			t.Errorf("%s: got %+v, %v", name, claims, err)
+		}
+	}
+
+	_, stranger, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refused := map[string]string{
+		"unknown kid": signTestJWT(t, jwt.SigningMethodEdDSA, stranger, "unknown"),
+		// The kid of one key with the signature of another
+		"wrong key for kid":         signTestJWT(t, jwt.SigningMethodEdDSA, testKeys.otherEd, apicfg.jwtKeys.signing.ID),
+		"stranger's key":            signTestJWT(t, jwt.SigningMethodEdDSA, stranger, otherKey.ID),
+		"signing key without a kid": signTestJWT(t, jwt.SigningMethodEdDSA, testKeys.ed, ""),
+	}
+
+	for name, token := range refused {
+		if _, err := apicfg.parseJWT("Bearer " + token); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+	}
+}
+
+func TestJWTAlgorithmMustMatchKey(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.jwtKeys = testKeyRing(t)
+	signing := apicfg.jwtKeys.signing.ID
+
+	rsaKey, _ := loadJWTKey(writePEMKey(t, t.TempDir(), "rsa.pub", &testKeys.rsa.PublicKey))
+	publicDER, _ := x509.MarshalPKIXPublicKey(&testKeys.rsa.PublicKey)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	none := func(kid string) string {
+		return signTestJWT(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, kid)
+	}
+
+	refused := map[string]string{
+		// The public key is public, so HMACing with it would let anyone sign
+		"hs256 with the rsa key's pem":  signTestJWT(t, jwt.SigningMethodHS256, publicPEM, rsaKey.ID),
+		"hs256 with the rsa key's der":  signTestJWT(t, jwt.SigningMethodHS256, publicDER, rsaKey.ID),
+		"hs256 with the ed25519 key":    signTestJWT(t, jwt.SigningMethodHS256, []byte(testKeys.ed.Public().(ed25519.PublicKey)), signing),
+		"rs256 under the ed25519 kid":   signTestJWT(t, jwt.SigningMethodRS256, testKeys.rsa, signing),
+		"rs512 under the rsa kid":       signTestJWT(t, jwt.SigningMethodRS512, testKeys.rsa, rsaKey.ID),
+		"ps256 under the rsa kid":       signTestJWT(t, jwt.SigningMethodPS256, testKeys.rsa, rsaKey.ID),
+		"none":                          none(""),
+		"none under the signing kid":    none(signing),
+		"none under the rsa kid":        none(rsaKey.ID),
+		"hs512 with the secret":         signTestJWT(t, jwt.SigningMethodHS512, []byte(apicfg.jwtSecret), ""),
+		"hs256 with the secret and kid": signTestJWT(t, jwt.SigningMethodHS256, []byte(apicfg.jwtSecret), signing),
+	}
+
+	handler := apicfg.routes()
+	signup(t, handler, "user@example.com")
+
+	for name, token := range refused {
+		if _, err := apicfg.parseJWT("Bearer " + token); err == nil {
+			t.Errorf("%s was accepted", name)
+		}
+
+		if code := doRequest(t, handler, http.MethodGet, "/api/sessions", token, nil, nil); code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want 401", name, code)
+		}
+	}
+}
+
+func TestLegacyHS256Tokens(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		signing bool
+		secret  string
+		until   time.Time
+		ok      bool
+	}{
+		{"secret only", false, "test", time.Time{}, true},
+		{"no secret", false, "", time.Time{}, false},
+		// Loading a signing key ends them, unless they're explicitly kept for a while
+		{"signing key", true, "test", time.Time{}, false},
+		{"signing key, before the deadline", true, "test", now.Add(time.Hour), true},
+		{"signing key, after the deadline", true, "test", now.Add(-time.Second), false},
+		{"signing key, deadline without a secret", true, "", now.Add(time.Hour), false},
+	}
+
+	for _, tc := range cases {
+		apicfg := newTestAPI(t, newMemDB())
+		handler := apicfg.routes()
+		signup(t, handler, "user@example.com")
+
+		// Signed the way tokens were before there were signing keys
+		legacy := signTestJWT(t, jwt.SigningMethodHS256, []byte("test"), "")
+
+		apicfg.jwtSecret = tc.secret
+
+		if tc.signing {
+			apicfg.jwtKeys = testKeyRing(t)
+		}
+
+		apicfg.jwtKeys.legacyUntil = tc.until
+
+		_, err := apicfg.parseJWT("Bearer " + legacy)
+
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want accepted %t", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestParseLegacyDeadline(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	if deadline, err := parseLegacyDeadline("", now); err != nil || !deadline.IsZero() {
+		t.Errorf("unset: got %s, %v", deadline, err)
+	}
+
+	deadline, err := parseLegacyDeadline("2026-10-17T13:00:00Z", now)
+
+	if err != nil || !deadline.Equal(now.Add(time.Hour)) {
+		t.Errorf("an hour away: got %s, %v", deadline, err)
+	}
+
+	if _, err := parseLegacyDeadline("2026-10-18T12:00:00Z", now); err != nil {
+		t.Errorf("a day away: %v", err)
+	}
+
+	for _, val := range []string{"2026-10-18T12:00:01Z", "2099-01-01T00:00:00Z", "tomorrow", "2026-10-17"} {
+		if _, err := parseLegacyDeadline(val, now); err == nil {
+			t.Errorf("%s was accepted", val)
+		}
+	}
+}
+
+func TestJWKSEndpoint(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	get := func() jwkSet {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+		if rec.Code != http.StatusOK || rec.Header().Get("Cache-Control") != jwksCacheControl {
+			t.Fatalf("got %d with Cache-Control %q", rec.Code, rec.Header().Get("Cache-Control"))
+		}
+
+		// Never anything private
+		for _, member := range []string{`"d"`, `"p"`, `"q"`, `"dp"`, `"dq"`, `"qi"`} {
+			if strings.Contains(rec.Body.String(), member) {
+				t.Errorf("JWKS has a %s member: %s", member, rec.Body.String())
+			}
+		}
+
+		set := jwkSet{}
+		doRequest(t, handler, http.MethodGet, "/.well-known/jwks.json", "", nil, &set)
+
+		return set
+	}
+
+	// Signing with JWT_SECRET, there's nothing to publish
+	if set := get(); set.Keys == nil || len(set.Keys) != 0 {
+		t.Errorf("without keys: got %+v, want an empty set", set)
+	}
+
+	apicfg.jwtKeys = testKeyRing(t)
+	set := get()
+
+	if len(set.Keys) != 3 {
+		t.Fatalf("got %d keys, want 3", len(set.Keys))
+	}
+
+	// In the order they were configured, signing key first
+	signing, rsaKey, other := set.Keys[0], set.Keys[1], set.Keys[2]
+
+	edPub := testKeys.ed.Public().(ed25519.PublicKey)
+	otherPub := testKeys.otherEd.Public().(ed25519.PublicKey)
+
+	if signing.Kty != "OKP" || signing.Crv != "Ed25519" || signing.Alg != "EdDSA" || signing.X != base64.RawURLEncoding.EncodeToString(edPub) {
+		t.Errorf("signing key: %+v", signing)
+	}
+
+	if other.Kty != "OKP" || other.X != base64.RawURLEncoding.EncodeToString(otherPub) {
+		t.Errorf("verification ed25519 key: %+v", other)
+	}
+
+	n, _ := base64.RawURLEncoding.DecodeString(rsaKey.N)
+	e, _ := base64.RawURLEncoding.DecodeString(rsaKey.E)
+
+	if rsaKey.Kty != "RSA" || rsaKey.Alg != "RS256" || new(big.Int).SetBytes(n).Cmp(testKeys.rsa.N) != 0 || new(big.Int).SetBytes(e).Int64() != int64(testKeys.rsa.E) {
+		t.Errorf("verification rsa key: %+v", rsaKey)
+	}
+
+	for _, val := range set.Keys {
+		if val.Use != "sig" || val.Kid != jwkThumbprint(val) || apicfg.jwtKeys.byID[val.Kid] == nil {
+			t.Errorf("key %s: use %q, thumbprint %s", val.Kid, val.Use, jwkThumbprint(val))
+		}
+	}
+}
+
+func TestJWKThumbprint(t *testing.T) {
+	// The example from RFC 7638 section 3.1
+	val := jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+
+	if got := jwkThumbprint(val); got != "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs" {
+		t.Errorf("got %s", got)
+	}
+}
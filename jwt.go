@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"net/http"
 	"strconv"
 	"time"
 
@@ -9,28 +10,46 @@ import (
 )
 
 type jwtResponse struct {
-	ID            int    `json:"id"`
+	// Left out when OPAQUE_IDS is set
+	ID            int    `json:"id,omitempty"`
+	UUID          string `json:"uuid"`
 	Email         string `json:"email"`
 	Token         string `json:"token"`
 	Refresh_Token string `json:"refresh_token"`
-	Is_Chirpy_Red bool `json:"is_chirpy_red"`
+	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
+	Role          string `json:"role"`
+}
+
+// The claims chirpy puts in its JWTs
+type userClaims struct {
+	// Role of the user when the token was issued, tokens from before roles existed have none
+	Role string `json:"role"`
+	// The session the token was issued to, see sessions.go
+	Session_ID string `json:"sid,omitempty"`
+	jwt.RegisteredClaims
 }
 
 type jwtOnlyToken struct {
 	Token string `json:"token"`
 }
 
-func (apicfg *apiConfig) createJWT(r user) (jwtOnlyToken, error) {
+// What /api/refresh returns, the refresh token that was sent can't be used again
+type refreshResponse struct {
+	Token         string `json:"token"`
+	Refresh_Token string `json:"refresh_token"`
+}
+
+func (apicfg *apiConfig) createJWT(r user, sessionID string) (jwtOnlyToken, error) {
 	claims := jwt.MapClaims{
-		"iss": "chirpy",
-		"iat": jwt.NewNumericDate(time.Now()),
-		"exp": jwt.NewNumericDate(time.Now().Add(time.Duration(1) * time.Hour)),
-		"sub": strconv.Itoa(r.ID),
+		"iss":  "chirpy",
+		"iat":  jwt.NewNumericDate(time.Now()),
+		"exp":  jwt.NewNumericDate(time.Now().Add(time.Duration(1) * time.Hour)),
+		"sub":  strconv.Itoa(r.ID),
+		"role": r.Role,
+		"sid":  sessionID,
 	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	token, err := jwtToken.SignedString([]byte(apicfg.jwtSecret))
+	token, err := apicfg.signJWT(claims)
 
 	if err != nil {
 		return jwtOnlyToken{}, err
@@ -41,64 +60,133 @@ func (apicfg *apiConfig) createJWT(r user) (jwtOnlyToken, error) {
 	return respToken, nil
 }
 
-func (apicfg *apiConfig) createJWTWithResponse(r user) (jwtResponse, error) {
-	claims := jwt.MapClaims{
-		"iss": "chirpy",
-		"iat": jwt.NewNumericDate(time.Now()),
-		"exp": jwt.NewNumericDate(time.Now().Add(time.Duration(1) * time.Hour)),
-		"sub": strconv.Itoa(r.ID),
-	}
-
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-
-	token, err := jwtToken.SignedString([]byte(apicfg.jwtSecret))
+func (apicfg *apiConfig) createJWTWithResponse(r user, dev device) (jwtResponse, error) {
+	dbRefrToken, err := apicfg.makeAndStoreRefreshToken(r.ID, dev)
 
 	if err != nil {
 		return jwtResponse{}, err
 	}
 
-	DB, err := newDB(pathToDB)
-
-	if err != nil {
-		return jwtResponse{}, nil
+	claims := jwt.MapClaims{
+		"iss":  "chirpy",
+		"iat":  jwt.NewNumericDate(time.Now()),
+		"exp":  jwt.NewNumericDate(time.Now().Add(time.Duration(1) * time.Hour)),
+		"sub":  strconv.Itoa(r.ID),
+		"role": r.Role,
+		"sid":  dbRefrToken.Family_ID,
 	}
 
-	dbRefrToken, err := DB.makeAndStoreRefreshToken(r.ID)
+	token, err := apicfg.signJWT(claims)
 
 	if err != nil {
-		return jwtResponse{}, nil
+		return jwtResponse{}, err
 	}
 
-	return jwtResponse{
+	resp := jwtResponse{
 		ID:            r.ID,
+		UUID:          r.UUID,
 		Email:         r.Email,
 		Token:         token,
 		Refresh_Token: dbRefrToken.Refresh_Token,
 		Is_Chirpy_Red: r.Is_Chirpy_Red,
-	}, nil
+		Role:          r.Role,
+	}
+
+	if apicfg.opaqueIDs {
+		resp.ID = 0
+	}
+
+	return resp, nil
 }
 
-func (apicfg *apiConfig) validateJWT(header string) (string, error) {
-	//"Bearer " needs to be stripped from the header
-	if len(header) < 7 {
-		return "", errors.New("no header found")
+// Answers a request whose JWT was refused by userIDFromRequest or claimsFromRequest.
+// A banned user is who they say they are, so they get a 403 rather than being
+// asked to log in again.
+func respondWithAuthError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUserBanned) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
 	}
 
-	tokenString := header[7:]
+	respondWithError(w, http.StatusUnauthorized, err.Error())
+}
 
-	token, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(apicfg.jwtSecret), nil
-	})
+// Validates the JWT in the Authorization header and returns the ID of the user it was issued to
+func (apicfg *apiConfig) userIDFromRequest(r *http.Request) (int, error) {
+	userID, _, err := apicfg.claimsFromRequest(r)
+
+	return userID, err
+}
+
+// Validates the JWT in the Authorization header and returns the user ID and role it carries
+func (apicfg *apiConfig) claimsFromRequest(r *http.Request) (int, string, error) {
+	hdr := r.Header.Get("Authorization")
+
+	if hdr == "" {
+		return -1, "", errors.New("header(s) not present")
+	}
+
+	claims, err := apicfg.parseJWT(hdr)
+
+	if err != nil {
+		return -1, "", errors.New("error validating token")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+
+	if err != nil {
+		return -1, "", errors.New("error validating token")
+	}
+
+	usr, err := apicfg.db.getUsrByID(userID)
 
 	if err != nil {
-		return "", err
+		return -1, "", errors.New("error validating token")
+	}
+
+	// Bans take effect straight away
+	if usr.Is_Banned {
+		return -1, "", errUserBanned
 	}
 
-	userID, err := token.Claims.GetSubject()
+	// So is logging a session out, its JWTs stop working along with its refresh token
+	if claims.Session_ID != "" {
+		live, err := apicfg.sessionLive(claims.Session_ID)
+
+		if err != nil {
+			return -1, "", errors.New("error validating token")
+		}
+
+		if !live {
+			return -1, "", errSessionEnded
+		}
+	}
+
+	// So do role changes, the role claim is only what the user had when the token was issued
+	role := usr.Role
+
+	if role == "" {
+		role = roleUser
+	}
+
+	return userID, role, nil
+}
+
+func (apicfg *apiConfig) parseJWT(header string) (*userClaims, error) {
+	//"Bearer " needs to be stripped from the header
+	if len(header) < 7 {
+		return nil, errors.New("no header found")
+	}
+
+	tokenString := header[7:]
+
+	claims := &userClaims{}
+
+	_, err := jwt.ParseWithClaims(tokenString, claims, apicfg.jwtKeyFunc)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return userID, nil
+	return claims, nil
 }
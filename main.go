@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -21,6 +29,15 @@ const metricsTemplate = `
 
 const pathToDB = "./database.json"
 
+const pathToSQLiteDB = "./chirpy.db"
+
+const pathToModerationConfig = "./moderation.json"
+
+const pathToMedia = "./media"
+
+// How long requests in flight get to finish once a shutdown signal arrives
+const shutdownTimeout = 10 * time.Second
+
 func (apicfg *apiConfig) handleUpgradeWebhook(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
@@ -39,90 +56,657 @@ func (apicfg *apiConfig) handleUpgradeWebhook(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	DB, err := newDB(pathToDB)
+	err := apicfg.decodeWebhook(r.Body)
+
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (apicfg *apiConfig) handleDeleteChirp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
+		return
+	}
+
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirp, err := apicfg.visibleChirpFromParam(r, r.PathValue("chirpID"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusBadRequest, "chirp not found")
+		return
+	}
+
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error loading database")
+		return
+	}
+
+	if chirp.Author_ID != userID {
+		respondWithError(w, http.StatusForbidden, "authorised user not author of chirp")
+		return
+	}
+
+	err = apicfg.trashChirp(chirp.ID)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error deleting chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// Takes a chirp back out of the trash, only for its author and within the restore window
+func (apicfg *apiConfig) handleRestoreChirp(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirp, err := apicfg.visibleChirpFromParam(r, r.PathValue("chirpID"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "chirp not found")
+		return
+	}
+
+	if err != nil && !errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusInternalServerError, "error loading database")
+		return
+	}
+
+	if chirp.Author_ID != userID {
+		respondWithError(w, http.StatusForbidden, "authorised user not author of chirp")
+		return
+	}
+
+	restored, err := apicfg.restoreChirp(chirp)
+
+	if errors.Is(err, errRestoreWindowPassed) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error restoring chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, apicfg.publicChirp(restored))
+}
+
+// Lists the chirps the logged in user has deleted that are still in the trash
+func (apicfg *apiConfig) handleGetTrash(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirpArr, err := apicfg.db.listChirps(chirpQuery{Author_ID: userID, Sort_By: sortByCreatedAt, Desc: true, Trashed: true})
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting chirps from database")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, apicfg.publicChirps(chirpArr))
+}
+
+// Lets the author replace the body of their chirp, for PUT and PATCH
+func (apicfg *apiConfig) handleEditChirp(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	chirp, err := apicfg.visibleChirpFromParam(r, r.PathValue("chirpID"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "chirp not found")
+		return
+	}
+
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error loading database")
+		return
+	}
+
+	if chirp.Author_ID != userID {
+		respondWithError(w, http.StatusForbidden, "authorised user not author of chirp")
+		return
+	}
+
+	edited, err := apicfg.editChirp(r.Body, chirp)
+
+	var invalid *validationError
+
+	if errors.As(err, &invalid) {
+		respondWithValidationError(w, invalid)
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error editing chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, apicfg.publicChirp(edited))
+}
+
+func (apicfg *apiConfig) handleGetChirpRevisions(w http.ResponseWriter, r *http.Request) {
+	chirp, err := apicfg.visibleChirpFromParam(r, r.PathValue("id"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "id not found")
+		return
+	}
+
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting chirps")
+		return
+	}
+
+	revisions, err := apicfg.db.getChirpRevisions(chirp.ID)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting revisions")
+		return
+	}
+
+	if apicfg.opaqueIDs {
+		for i := range revisions {
+			revisions[i].Chirp_ID = 0
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, revisions)
+}
+
+// The tree of replies under a chirp, ?depth levels deep
+func (apicfg *apiConfig) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	depth, err := parseThreadDepth(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := parseThreadLimit(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var after *chirpCursor
+
+	if strCursor := r.URL.Query().Get("cursor"); strCursor != "" {
+		cursor, err := apicfg.decodeCursor(strCursor)
+
+		if errors.Is(err, errInvalidCursor) {
+			respondWithError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "error getting chirps")
+			return
+		}
+
+		after = &cursor
+	}
+
+	root, err := apicfg.visibleChirpFromParam(r, r.PathValue("id"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "id not found")
+		return
+	}
+
+	if err != nil && !errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusInternalServerError, "error getting chirps")
+		return
+	}
+
+	thread, err := apicfg.buildThread(root, depth, limit, after)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting replies")
+		return
+	}
+
+	// A deleted chirp is only worth showing while the conversation under it is still there
+	if root.Deleted_At != nil && len(thread.Replies) == 0 && !thread.More_Replies {
+		respondWithError(w, http.StatusGone, errChirpGone.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, thread)
+}
+
+func (apicfg *apiConfig) handleFollowUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
 
 	if err != nil {
-		respondWithError(w, http.StatusMethodNotAllowed, "error connecting to database")
+		respondWithAuthError(w, err)
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		err = apicfg.unfollowUser(userID, r.PathValue("id"))
+	} else {
+		err = apicfg.followUser(userID, r.PathValue("id"))
+	}
+
+	if errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
 		return
 	}
 
-	err = DB.decodeWebhook(r.Body)
+	if errors.Is(err, errCannotFollowSelf) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error updating follows")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+func (apicfg *apiConfig) handleGetFollowers(w http.ResponseWriter, r *http.Request) {
+	listing, err := apicfg.getFollowers(r.PathValue("id"))
+
+	if errors.Is(err, errUserNotFound) {
 		respondWithError(w, http.StatusNotFound, err.Error())
 		return
 	}
-	
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting followers")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, listing)
+}
+
+func (apicfg *apiConfig) handleGetFollowing(w http.ResponseWriter, r *http.Request) {
+	listing, err := apicfg.getFollowing(r.PathValue("id"))
+
+	if errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting followed users")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, listing)
+}
+
+// Chirps by everyone the logged in user follows, newest first. Always paginated.
+func (apicfg *apiConfig) handleGetTimeline(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	limit, after, paginated, err := apicfg.parsePageParams(r.URL.Query())
+
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if !paginated {
+		limit = defaultPageLimit
+	}
+
+	chirpArr, err := apicfg.homeTimeline(userID, limit+1, after)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting timeline")
+		return
+	}
+
+	apicfg.respondWithChirpPage(w, r, chirpArr, limit)
+}
+
+// The chirps the logged in user has liked, most recent first
+func (apicfg *apiConfig) handleGetLikes(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	liked, err := apicfg.getLikes(userID)
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting likes")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, liked)
+}
+
+func (apicfg *apiConfig) handleReportChirp(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	err = apicfg.reportChirp(r, userID, r.PathValue("chirpID"))
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "chirp not found")
+		return
+	}
+
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error reporting chirp")
+		return
+	}
+
 	respondWithJSON(w, http.StatusNoContent, "")
 }
 
-func (apicfg *apiConfig) handleDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
+// The devices the user is logged in on
+func (apicfg *apiConfig) handleGetSessions(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID, err := apicfg.sessionFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
 		return
 	}
 
-	hdr := r.Header.Get("Authorization")
+	sessions, err := apicfg.listSessions(userID, sessionID)
 
-	if hdr == "" {
-		respondWithError(w, http.StatusUnauthorized, "header(s) not present")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting sessions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+func (apicfg *apiConfig) handleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	err = apicfg.revokeSession(userID, r.PathValue("id"))
+
+	if errors.Is(err, errSessionNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error revoking session")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// Logs out everywhere but the device making the request
+func (apicfg *apiConfig) handleRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID, sessionID, err := apicfg.sessionFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	if err := apicfg.revokeOtherSessions(userID, sessionID); err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error revoking sessions")
+		return
+	}
+
+	respondWithJSON(w, http.StatusNoContent, "")
+}
+
+// Chirps held by moderation or reported by users, oldest first
+func (apicfg *apiConfig) handleGetReviewQueue(w http.ResponseWriter, r *http.Request) {
+	queue, err := apicfg.reviewQueue()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting review queue")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, queue)
+}
+
+// Approves, removes or bans the author of a chirp in the review queue
+func (apicfg *apiConfig) handleReviewChirp(w http.ResponseWriter, r *http.Request) {
+	entry, err := apicfg.reviewChirp(r.Body, userIDFromContext(r.Context()), r.PathValue("chirpID"), r.PathValue("action"))
+
+	if errors.Is(err, errUnknownReviewAction) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if errors.Is(err, errAuthorOutranks) {
+		respondWithError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "chirp not found")
+		return
+	}
+
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error reviewing chirp")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entry)
+}
+
+func (apicfg *apiConfig) handleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := apicfg.db.getAuditLog()
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting audit log")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
+
+func (apicfg *apiConfig) handleSetUserRole(w http.ResponseWriter, r *http.Request) {
+	updated, err := apicfg.setUserRole(r.Body, r.PathValue("id"))
+
+	if errors.Is(err, errUnknownRole) {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if errors.Is(err, errUserNotFound) {
+		respondWithError(w, http.StatusNotFound, "user not found")
+		return
+	}
+
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error updating role")
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, apicfg.publicUser(updated))
+}
+
+// Takes a multipart upload with the image in the file field
+func (apicfg *apiConfig) handleUploadMedia(w http.ResponseWriter, r *http.Request) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		respondWithAuthError(w, err)
+		return
+	}
+
+	// Leave some room for the rest of the multipart body
+	r.Body = http.MaxBytesReader(w, r.Body, apicfg.mediaMaxSize+1<<20)
+
+	file, _, err := r.FormFile("file")
+
+	var tooLarge *http.MaxBytesError
+
+	if errors.As(err, &tooLarge) {
+		respondWithValidationError(w, errMediaTooLarge)
+		return
+	}
+
+	if err != nil {
+		respondWithValidationError(w, errMediaMissing)
 		return
 	}
 
-	strUserID, err := apicfg.validateJWT(hdr)
+	defer file.Close()
 
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "error validating token")
+	uploaded, err := apicfg.uploadMedia(file, userID)
+
+	var invalid *validationError
+
+	if errors.As(err, &invalid) {
+		respondWithValidationError(w, invalid)
 		return
 	}
 
-	userID, err := strconv.Atoi(strUserID)
-
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error parsing id to string")
+		respondWithError(w, http.StatusInternalServerError, "error storing media")
 		return
 	}
 
-	strID := r.PathValue("chirpID")
+	respondWithJSON(w, http.StatusCreated, apicfg.publicMedia(uploaded))
+}
 
-	chirpID, err := strconv.Atoi(strID)
+func (apicfg *apiConfig) handleGetMedia(w http.ResponseWriter, r *http.Request) {
+	found, err := apicfg.db.getMedia(r.PathValue("id"))
 
-	if err != nil {
-		log.Fatal(err)
+	if errors.Is(err, errMediaNotFound) {
+		respondWithError(w, http.StatusNotFound, err.Error())
+		return
 	}
 
-	DB, err := newDB(pathToDB)
-
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+		respondWithError(w, http.StatusInternalServerError, "error getting media")
 		return
 	}
 
-	dbstruct, err := DB.loadDB()
+	respondWithJSON(w, http.StatusOK, apicfg.publicMedia(found))
+}
+
+// Chirps with a hashtag, newest first. Always paginated like the timeline.
+func (apicfg *apiConfig) handleGetHashtag(w http.ResponseWriter, r *http.Request) {
+	limit, after, paginated, err := apicfg.parsePageParams(r.URL.Query())
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error loading database")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	chirp, ok := dbstruct.Chirps[chirpID]
+	if !paginated {
+		limit = defaultPageLimit
+	}
+
+	chirpArr, err := apicfg.hashtagChirps(strings.TrimPrefix(r.PathValue("tag"), "#"), after, limit+1)
 
-	if !ok {
-		respondWithError(w, http.StatusBadRequest, "chirp not found")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, "error getting chirps")
 		return
 	}
 
-	if chirp.Author_ID != userID {
-		respondWithError(w, http.StatusForbidden, "authorised user not author of chirp")
-		return
+	apicfg.respondWithChirpPage(w, r, chirpArr, limit)
+}
+
+// The most used hashtags over ?window (default TRENDING_WINDOW)
+func (apicfg *apiConfig) handleGetTrending(w http.ResponseWriter, r *http.Request) {
+	window := apicfg.trendingWindow
+
+	if strWindow := r.URL.Query().Get("window"); strWindow != "" {
+		var err error
+		window, err = time.ParseDuration(strWindow)
+
+		if err != nil || window <= 0 {
+			respondWithError(w, http.StatusBadRequest, "invalid window")
+			return
+		}
 	}
 
-	delete(dbstruct.Chirps, chirpID)
+	limit := defaultTrendingLimit
 
-	respondWithJSON(w, http.StatusNoContent, "")
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(strLimit)
+
+		if err != nil || limit < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+
+		limit = min(limit, maxPageLimit)
+	}
+
+	respondWithJSON(w, http.StatusOK, apicfg.hashtags.trending(window, limit))
 }
 
-func handleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+func (apicfg *apiConfig) handleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
 		return
@@ -135,14 +719,7 @@ func handleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	DB, err := newDB(pathToDB)
-
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
-		return
-	}
-
-	err = DB.findAndDeleteRefrToken(hdr)
+	err := apicfg.findAndDeleteRefrToken(hdr)
 
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
@@ -159,13 +736,6 @@ func (apicfg *apiConfig) handleVerifyAccessToken(w http.ResponseWriter, r *http.
 		return
 	}
 
-	DB, err := newDB(pathToDB)
-
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
-		return
-	}
-
 	hdr := r.Header.Get("Authorization")
 
 	if hdr == "" {
@@ -173,28 +743,38 @@ func (apicfg *apiConfig) handleVerifyAccessToken(w http.ResponseWriter, r *http.
 		return
 	}
 
-	userID, err := DB.validateRefreshToken(hdr)
+	refrToken, err := apicfg.rotateRefreshToken(hdr, deviceFromRequest(r))
+
+	if errors.Is(err, errTokenReused) {
+		respondWithError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
 
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, "error validating refresh token")
 		return
 	}
 
-	user, err := DB.getUsrByID(userID)
+	user, err := apicfg.db.getUsrByID(refrToken.ID)
 
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, "error finding user")
 		return
 	}
 
-	newJWT, err := apicfg.createJWT(user)
+	if user.Is_Banned {
+		respondWithError(w, http.StatusForbidden, errUserBanned.Error())
+		return
+	}
+
+	newJWT, err := apicfg.createJWT(user, refrToken.Family_ID)
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "error creating a new refresh token")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, newJWT)
+	respondWithJSON(w, http.StatusOK, refreshResponse{Token: newJWT.Token, Refresh_Token: refrToken.Refresh_Token})
 }
 
 // Handles updating user info with a jwt, nothing else
@@ -204,49 +784,38 @@ func (apicfg *apiConfig) handleVerifyJWT(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	hdr := r.Header.Get("Authorization")
-	
-	if hdr == "" {
-		respondWithError(w, http.StatusUnauthorized, "header(s) not present")
-		return
-	}
-
-	strID, err := apicfg.validateJWT(r.Header.Get("Authorization"))
+	userID, err := apicfg.userIDFromRequest(r)
 
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "error validating token")
+		respondWithAuthError(w, err)
 		return
 	}
 
-	userID, err := strconv.Atoi(strID)
+	userDetailsInRequest, err := createTempUser(r.Body)
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error parsing id to int")
+	if errors.Is(err, errInvalidHandle) {
+		respondWithValidationError(w, errInvalidHandle)
 		return
 	}
 
-	DB, err := newDB(pathToDB)
-
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	userDetailsInRequest, err := DB.createTempUser(r.Body)
+	userInDB, err := apicfg.updateUser(&userDetailsInRequest, userID)
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if errors.Is(err, errEmailExists) || errors.Is(err, errHandleExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
 		return
 	}
 
-	userInDB, err := DB.updateUser(&userDetailsInRequest, userID)
-
 	if err != nil {
 		respondWithError(w, http.StatusUnauthorized, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, userInDB.omitPassword())
+	respondWithJSON(w, http.StatusOK, apicfg.publicUser(userInDB))
 }
 
 // Handles creating a JWT and a refresh token to login in future. The refr token is just used to make a new JWT to log in again.
@@ -256,21 +825,19 @@ func (apicfg *apiConfig) handleCreateJWT(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	DB, err := newDB(pathToDB)
+	createdUser, err := apicfg.validatePotential(r.Body)
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+	if errors.Is(err, errUserBanned) {
+		respondWithError(w, http.StatusForbidden, err.Error())
 		return
 	}
 
-	createdUser, err := DB.validatePotential(r.Body)
-
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	jwtResp, err := apicfg.createJWTWithResponse(createdUser)
+	jwtResp, err := apicfg.createJWTWithResponse(createdUser, deviceFromRequest(r))
 
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "error creating JWT")
@@ -280,119 +847,176 @@ func (apicfg *apiConfig) handleCreateJWT(w http.ResponseWriter, r *http.Request)
 	respondWithJSON(w, 200, jwtResp)
 }
 
-func handleCreateUser(w http.ResponseWriter, r *http.Request) {
+func (apicfg *apiConfig) handleCreateUser(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
 		return
 	}
 
-	DB, err := newDB(pathToDB)
+	createdUser, err := apicfg.createUser(r.Body)
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+	if errors.Is(err, errInvalidHandle) {
+		respondWithValidationError(w, errInvalidHandle)
 		return
 	}
 
-	createdUser, err := DB.createUser(r.Body)
-
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, err.Error())
+	if errors.Is(err, errHandleExists) {
+		respondWithError(w, http.StatusConflict, err.Error())
 		return
 	}
 
-	err = DB.appendDBUser(createdUser)
-
 	if err != nil {
 		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, createdUser.omitPassword())
+	respondWithJSON(w, http.StatusCreated, apicfg.publicUser(createdUser))
 }
 
-func handleGetSingleChirp(w http.ResponseWriter, r *http.Request) {
+func (apicfg *apiConfig) handleGetSingleChirp(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		respondWithError(w, http.StatusMethodNotAllowed, "invalid request method")
 		return
 	}
 
-	strId := r.PathValue("id")
-
-	id, err := strconv.Atoi(strId)
+	chirp, err := apicfg.visibleChirpFromParam(r, r.PathValue("id"))
 
-	if err != nil {
-		log.Fatal(err)
+	if errors.Is(err, errChirpNotFound) {
+		respondWithError(w, http.StatusNotFound, "id not found")
+		return
 	}
 
-	DB, err := newDB(pathToDB)
+	if errors.Is(err, errChirpGone) {
+		respondWithError(w, http.StatusGone, err.Error())
+		return
+	}
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+		respondWithError(w, http.StatusInternalServerError, "error getting chirps")
 		return
 	}
 
-	chirpArr, err := DB.getAllChirps()
+	respondWithJSON(w, http.StatusOK, apicfg.publicChirp(chirp))
+}
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error getting chirps")
+// Ranked full-text search over chirp bodies. Words must all match, "quoted words"
+// match as a phrase and a trailing * matches any word starting with what's before it.
+func (apicfg *apiConfig) handleSearchChirps(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query().Get("q")
+
+	if strings.TrimSpace(q) == "" {
+		respondWithError(w, http.StatusBadRequest, "missing query parameter q")
 		return
 	}
 
-	if id > len(chirpArr) || id < 1 {
-		respondWithError(w, http.StatusNotFound, "id not found")
-	} else {
-		respondWithJSON(w, http.StatusOK, chirpArr[id-1])
+	limit := defaultPageLimit
+
+	if strLimit := r.URL.Query().Get("limit"); strLimit != "" {
+		var err error
+		limit, err = strconv.Atoi(strLimit)
+
+		if err != nil || limit < 1 {
+			respondWithError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+
+		limit = min(limit, maxPageLimit)
 	}
 
-}
+	results := []searchResult{}
+
+	// The index can't tell which chirps are visible, so the limit is applied after filtering
+	for _, result := range apicfg.search.search(q, 0) {
+		if len(results) == limit {
+			break
+		}
+
+		chirp, err := apicfg.db.getChirp(result.Chirp.ID)
 
-func handleGetChirps(w http.ResponseWriter, r *http.Request) {
-	DB, err := newDB(pathToDB)
+		// Deleted since it was indexed
+		if errors.Is(err, errChirpNotFound) {
+			continue
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "error getting chirps from database")
+			return
+		}
+
+		if chirp.Deleted_At != nil || chirp.Flagged {
+			continue
+		}
+
+		result.Chirp = apicfg.publicChirp(chirp)
+		results = append(results, result)
+	}
+
+	respondWithJSON(w, http.StatusOK, results)
+}
 
+// Without limit or cursor every chirp is returned as a plain array, with either
+// of them the response is a page with a next_cursor
+func (apicfg *apiConfig) handleGetChirps(w http.ResponseWriter, r *http.Request) {
 	author_id := r.URL.Query().Get("author_id")
 	
 	sortType := r.URL.Query().Get("sort")
 
-	
-	if err != nil {
-		log.Fatal(err)
+	if sortType != "" && sortType != "asc" && sortType != "desc" {
+		respondWithError(w, http.StatusBadRequest, "sort must be asc or desc")
+		return
+	}
+
+	sortBy := r.URL.Query().Get("sort_by")
+
+	if sortBy == "" {
+		sortBy = sortByCreatedAt
+	}
+
+	if sortBy != sortByCreatedAt && sortBy != sortByID {
+		respondWithError(w, http.StatusBadRequest, "sort_by must be created_at or id")
 		return
 	}
 
-	chirpArr, err := DB.getAllChirps()
+	limit, after, paginated, err := apicfg.parsePageParams(r.URL.Query())
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error getting chirps from database")
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	respondArr := []chirp{}
+	query := chirpQuery{Sort_By: sortBy, Desc: sortType == "desc", After: after}
+
+	if paginated {
+		query.Limit = limit + 1
+	}
+
+	chirpArr := []chirp{}
 
 	if author_id != "" {
-		authorChirpArr := []chirp{}
-		intAuthorID, err := strconv.Atoi(author_id)
+		query.Author_ID, err = apicfg.userIDFromParam(author_id)
 
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, "error parsing the query parameter into an integer")
+		if err != nil && !errors.Is(err, errUserNotFound) {
+			respondWithError(w, http.StatusInternalServerError, "error looking up author")
 			return
 		}
+	}
+
+	// An unknown author just has no chirps
+	if err == nil {
+		chirpArr, err = apicfg.db.listChirps(query)
 
-		for _, val := range chirpArr {
-			if val.Author_ID == intAuthorID{
-				authorChirpArr = append(authorChirpArr, val)
-			}
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "error getting chirps from database")
+			return
 		}
-		
-		respondArr = authorChirpArr
-	} else {
-		respondArr = chirpArr
 	}
 
-	if sortType == "desc" {
-		respondArr = reverseOrder(respondArr)
+	if paginated {
+		apicfg.respondWithChirpPage(w, r, chirpArr, limit)
+		return
 	}
 
-	respondWithJSON(w, http.StatusOK, respondArr)
+	respondWithJSON(w, http.StatusOK, apicfg.publicChirps(chirpArr))
 }
 
 // For Posts
@@ -402,52 +1026,33 @@ func (apicfg *apiConfig) handleCreateChirp(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	DB, err := newDB(pathToDB)
+	userID, err := apicfg.userIDFromRequest(r)
 
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error creating database")
+		respondWithAuthError(w, err)
 		return
 	}
 
-	if r.Header.Get("Authorization") == "" {
-		respondWithError(w, http.StatusBadRequest, "header(s) not present")
-		return
-	}
-
-	strID, err := apicfg.validateJWT(r.Header.Get("Authorization"))
-
-	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "error validating token")
-		return
-	}
+	newChirp, err := apicfg.createChirp(r, userID)
 
-	userID, err := strconv.Atoi(strID)
+	var invalid *validationError
 
-	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "error parsing id to integer")
+	if errors.As(err, &invalid) {
+		respondWithValidationError(w, invalid)
 		return
 	}
 
-	newChirp, err := DB.createChirp(r.Body, userID)
-
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, "error creating chirp")
 		return
 	}
 
-	if len(newChirp.Chirp) > 140 || len(newChirp.Chirp) == 0 {
-		respondWithError(w, http.StatusBadRequest, "invalid message length")
-		return
-	}
-
-	DB.appendDBChirp(newChirp)
-
-	respondWithJSON(w, 201, newChirp)
+	respondWithJSON(w, 201, apicfg.publicChirp(newChirp))
 }
 
 func (cfg *apiConfig) handleMetrics(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(fmt.Sprintf("Hits: %d", cfg.fileserverHits)))
+	w.Write([]byte(fmt.Sprintf("Hits: %d\nRefresh tokens swept: %d", cfg.fileserverHits, cfg.refreshTokensSwept.Load())))
 }
 
 func (cfg *apiConfig) handleReset(w http.ResponseWriter, r *http.Request) {
@@ -476,58 +1081,274 @@ func (cfg *apiConfig) handleAdminMetrics(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// The public keys JWTs are signed with, so other services can verify them without a shared secret
+func (apicfg *apiConfig) handleGetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", jwksCacheControl)
+	respondWithJSON(w, http.StatusOK, apicfg.jwtKeys.jwks())
+}
+
 func handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(200)
 	w.Write([]byte("OK"))
 }
 
+// Every endpoint chirpy serves
+func (apicfg *apiConfig) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.Handle("/app/*", http.StripPrefix("/app/", apicfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
+
+	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
+
+	mux.Handle("/media/", http.StripPrefix("/media/", apicfg.media.handler()))
+
+	mux.HandleFunc("/admin/metrics", apicfg.requireRole(apicfg.handleAdminMetrics, roleAdmin))
+
+	mux.HandleFunc("/api/metrics", apicfg.requireRole(apicfg.handleMetrics, roleAdmin))
+
+	mux.HandleFunc("/api/reset", apicfg.requireRole(apicfg.handleReset, roleAdmin))
+
+	mux.HandleFunc("/api/healthz", handleHealth)
+
+	mux.HandleFunc("GET /.well-known/jwks.json", apicfg.handleGetJWKS)
+
+	mux.HandleFunc("/api/login", apicfg.handleCreateJWT)
+
+	mux.HandleFunc("/api/refresh", apicfg.handleVerifyAccessToken)
+
+	mux.HandleFunc("/api/users", apicfg.handleCreateUser)
+
+	mux.HandleFunc("PUT /api/users", apicfg.handleVerifyJWT)
+
+	mux.HandleFunc("POST /api/users/{id}/follow", apicfg.handleFollowUser)
+
+	mux.HandleFunc("DELETE /api/users/{id}/follow", apicfg.handleFollowUser)
+
+	mux.HandleFunc("GET /api/users/{id}/followers", apicfg.handleGetFollowers)
+
+	mux.HandleFunc("GET /api/users/{id}/following", apicfg.handleGetFollowing)
+
+	mux.HandleFunc("GET /api/timeline", apicfg.handleGetTimeline)
+
+	mux.HandleFunc("/api/revoke", apicfg.handleRevokeAccessToken)
+
+	mux.HandleFunc("GET /api/sessions", apicfg.handleGetSessions)
+
+	mux.HandleFunc("DELETE /api/sessions", apicfg.handleRevokeOtherSessions)
+
+	mux.HandleFunc("DELETE /api/sessions/{id}", apicfg.handleRevokeSession)
+
+	mux.HandleFunc("/api/polka/webhooks", apicfg.handleUpgradeWebhook)
+
+	mux.HandleFunc("/api/chirps", apicfg.handleCreateChirp)
+
+	mux.HandleFunc("GET /api/chirps", apicfg.handleGetChirps)
+
+	mux.HandleFunc("GET /api/chirps/search", apicfg.handleSearchChirps)
+
+	mux.HandleFunc("GET /api/chirps/trash", apicfg.handleGetTrash)
+
+	mux.HandleFunc("/api/chirps/{id}", apicfg.handleGetSingleChirp)
+
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apicfg.handleDeleteChirp)
+
+	mux.HandleFunc("PUT /api/chirps/{chirpID}", apicfg.handleEditChirp)
+
+	mux.HandleFunc("PATCH /api/chirps/{chirpID}", apicfg.handleEditChirp)
+
+	mux.HandleFunc("GET /api/chirps/{id}/revisions", apicfg.handleGetChirpRevisions)
+
+	mux.HandleFunc("GET /api/chirps/{id}/thread", apicfg.handleGetThread)
+
+	mux.HandleFunc("POST /api/chirps/{chirpID}/restore", apicfg.handleRestoreChirp)
+
+	mux.HandleFunc("POST /api/chirps/{chirpID}/like", apicfg.handleReaction(reactionLike))
+
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}/like", apicfg.handleReaction(reactionLike))
+
+	mux.HandleFunc("POST /api/chirps/{chirpID}/rechirp", apicfg.handleReaction(reactionRechirp))
+
+	mux.HandleFunc("DELETE /api/chirps/{chirpID}/rechirp", apicfg.handleReaction(reactionRechirp))
+
+	mux.HandleFunc("GET /api/likes", apicfg.handleGetLikes)
+
+	mux.HandleFunc("POST /api/chirps/{chirpID}/report", apicfg.handleReportChirp)
+
+	mux.HandleFunc("GET /api/hashtags/{tag}", apicfg.handleGetHashtag)
+
+	mux.HandleFunc("GET /api/trending", apicfg.handleGetTrending)
+
+	mux.HandleFunc("POST /api/media", apicfg.handleUploadMedia)
+
+	mux.HandleFunc("GET /api/media/{id}", apicfg.handleGetMedia)
+
+	mux.HandleFunc("GET /admin/moderation/queue", apicfg.requireRole(apicfg.handleGetReviewQueue, roleModerator, roleAdmin))
+
+	mux.HandleFunc("POST /admin/moderation/chirps/{chirpID}/{action}", apicfg.requireRole(apicfg.handleReviewChirp, roleModerator, roleAdmin))
+
+	mux.HandleFunc("GET /admin/moderation/audit", apicfg.requireRole(apicfg.handleGetAuditLog, roleModerator, roleAdmin))
+
+	mux.HandleFunc("PUT /admin/users/{id}/role", apicfg.requireRole(apicfg.handleSetUserRole, roleAdmin))
+
+	return mux
+}
+
 func main() {
+	importJSON := flag.String("import-json", "", "import a database.json file into the sqlite database and exit")
+	grantAdminTo := flag.String("grant-admin", "", "make the existing user with this ID or UUID an admin and exit")
+	flag.Parse()
+
 	godotenv.Load()
 
 	jwtSecret := os.Getenv("JWT_SECRET")
 	polkaApiKey := os.Getenv("POLKA_API_KEY")
 
-	apiCfg := &apiConfig{jwtSecret: jwtSecret, polkaApiKey: polkaApiKey}
+	jwtKeys, err := loadKeyRing(os.Getenv("JWT_SIGNING_KEY"), os.Getenv("JWT_VERIFY_KEYS"))
 
-	mux := http.NewServeMux()
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	mux.Handle("/app/*", http.StripPrefix("/app/", apiCfg.middlewareMetricsInc(http.FileServer(http.Dir(".")))))
+	jwtKeys.legacyUntil, err = parseLegacyDeadline(os.Getenv("JWT_LEGACY_HS256_UNTIL"), time.Now())
 
-	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("./assets"))))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if jwtKeys.signing != nil && jwtSecret != "" && jwtKeys.legacyUntil.IsZero() {
+		log.Println("JWT_SIGNING_KEY is set, HS256 tokens signed with JWT_SECRET are no longer accepted")
+	}
+
+	db, err := openStore(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"))
 
-	mux.HandleFunc("/admin/metrics", apiCfg.handleAdminMetrics)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *importJSON != "" {
+		sqlite, ok := db.(*sqliteDB)
 
-	mux.HandleFunc("/api/metrics", apiCfg.handleMetrics)
+		if !ok {
+			log.Fatal("-import-json needs DB_DRIVER=sqlite")
+		}
 
-	mux.HandleFunc("/api/reset", apiCfg.handleReset)
+		if err := sqlite.importJSON(*importJSON); err != nil {
+			log.Fatal(err)
+		}
 
-	mux.HandleFunc("/api/healthz", handleHealth)
+		log.Println("imported", *importJSON)
+		return
+	}
+
+	if *grantAdminTo != "" {
+		admin, err := grantAdmin(db, *grantAdminTo)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("user %d (%s) is now an admin", admin.ID, admin.UUID)
+		return
+	}
 
-	mux.HandleFunc("/api/login", apiCfg.handleCreateJWT)
+	if os.Getenv("ADMIN_EMAILS") != "" {
+		log.Println("ADMIN_EMAILS is no longer used, existing admins keep their role; make new ones with -grant-admin")
+	}
+
+	search, err := buildSearchIndex(db)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	hashtags, err := buildHashtagIndex(db)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	moderation, err := newModerator(envOr("MODERATION_CONFIG", pathToModerationConfig))
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	mux.HandleFunc("/api/refresh", apiCfg.handleVerifyAccessToken)
+	// Cancelled on SIGINT or SIGTERM, which stops the server and the background jobs
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	mux.HandleFunc("/api/users", handleCreateUser)
+	// Background jobs that write to the store, waited for so a sweep isn't cut off halfway
+	workers := sync.WaitGroup{}
 
-	mux.HandleFunc("PUT /api/users", apiCfg.handleVerifyJWT)
+	go moderation.watch(ctx, durationFromEnv("MODERATION_RELOAD_INTERVAL", defaultModerationReload))
 
-	mux.HandleFunc("/api/revoke", handleRevokeAccessToken)
+	timelines, err := buildTimelineCache(db, intFromEnv("TIMELINE_SIZE", defaultTimelineSize), intFromEnv("TIMELINE_FANOUT_LIMIT", defaultTimelineFanoutLimit))
 
-	mux.HandleFunc("/api/polka/webhooks", apiCfg.handleUpgradeWebhook)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	mediaStore, err := newBlobStore(envOr("MEDIA_DIR", pathToMedia))
+
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	mux.HandleFunc("/api/chirps", apiCfg.handleCreateChirp)
+	apiCfg := &apiConfig{
+		jwtSecret:     jwtSecret,
+		jwtKeys:       jwtKeys,
+		polkaApiKey:   polkaApiKey,
+		db:            db,
+		search:        search,
+		hashtags:      hashtags,
+		opaqueIDs:     os.Getenv("OPAQUE_IDS") == "true",
+		restoreWindow: durationFromEnv("CHIRP_RESTORE_WINDOW", defaultRestoreWindow),
+		timelines:     timelines,
+		moderation:    moderation,
+		chirpLimits: chirpLimits{
+			Standard: intFromEnv("CHIRP_MAX_LENGTH", defaultChirpLength),
+			Red:      intFromEnv("CHIRP_MAX_LENGTH_RED", defaultRedChirpLength),
+		},
+		media:          mediaStore,
+		mediaMaxSize:   int64(intFromEnv("MEDIA_MAX_SIZE", defaultMediaMaxSize)),
+		trendingWindow: durationFromEnv("TRENDING_WINDOW", defaultTrendingWindow),
+		refreshTTL:     durationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTTL),
+	}
 
-	mux.HandleFunc("GET /api/chirps", handleGetChirps)
+	workers.Add(2)
 
-	mux.HandleFunc("/api/chirps/{id}", handleGetSingleChirp)
+	go func() {
+		defer workers.Done()
+		apiCfg.runChirpPurger(ctx, durationFromEnv("CHIRP_PURGE_INTERVAL", defaultPurgeInterval))
+	}()
 
-	mux.HandleFunc("DELETE /api/chirps/{chirpID}", apiCfg.handleDeleteChirp)
+	go func() {
+		defer workers.Done()
+		apiCfg.runRefreshTokenSweeper(ctx, durationFromEnv("REFRESH_SWEEP_INTERVAL", defaultSweepInterval))
+	}()
 
 	srv := &http.Server{
 		Addr:    ":8080",
-		Handler: mux,
+		Handler: apiCfg.routes(),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	log.Println("Shutting down")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Error shutting down:", err)
 	}
 
-	srv.ListenAndServe()
+	workers.Wait()
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	defaultMediaMaxSize = 5 << 20
+	maxMediaPerChirp    = 4
+	// Thumbnails fit in a square this many pixels wide
+	thumbnailSize = 320
+	// Images any wider or taller are refused, so a small file can't decode into a huge bitmap
+	maxMediaDimension = 8000
+	// Blobs are named after their content, so a URL always serves the same bytes
+	mediaCacheControl = "public, max-age=31536000, immutable"
+)
+
+// The image types that can be uploaded and the extension they're stored with
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+var (
+	errMediaMissing  = &validationError{Code: "media_missing", Msg: "upload needs a file field"}
+	errMediaTooLarge = &validationError{Code: "media_too_large", Msg: "file is too large"}
+	errMediaType     = &validationError{Code: "media_unsupported_type", Msg: "only jpeg, png and gif images can be uploaded"}
+	errMediaInvalid  = &validationError{Code: "media_invalid", Msg: "file is not a valid image"}
+	errUnknownMedia  = &validationError{Code: "media_not_found", Msg: "attached media not found"}
+	errTooManyMedia  = &validationError{Code: "too_many_media", Msg: fmt.Sprintf("a chirp can have at most %d images", maxMediaPerChirp)}
+)
+
+// media is an uploaded image, its ID is the SHA-256 of the file so uploading
+// the same image twice gives the same media
+type media struct {
+	ID string `json:"id"`
+	// Who uploaded it first, left out of responses when OPAQUE_IDS is set
+	Uploader_ID  int       `json:"uploader_id,omitempty"`
+	Content_Type string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Created_At   time.Time `json:"created_at"`
+}
+
+// What clients get back for a media, with where to fetch it from
+type mediaResponse struct {
+	media
+	URL           string `json:"url"`
+	Thumbnail_URL string `json:"thumbnail_url"`
+}
+
+func (val media) fileName() string {
+	return val.ID + mediaExtensions[val.Content_Type]
+}
+
+// Thumbnails of JPEGs stay JPEGs, anything else becomes a PNG to keep transparency
+func (val media) thumbnailName() string {
+	if val.Content_Type == "image/jpeg" {
+		return filepath.Join("thumbs", val.ID+".jpg")
+	}
+	return filepath.Join("thumbs", val.ID+".png")
+}
+
+func (apicfg *apiConfig) publicMedia(val media) mediaResponse {
+	if apicfg.opaqueIDs {
+		val.Uploader_ID = 0
+	}
+
+	return mediaResponse{
+		media:         val,
+		URL:           "/media/" + val.fileName(),
+		Thumbnail_URL: "/media/" + filepath.ToSlash(val.thumbnailName()),
+	}
+}
+
+// blobStore keeps uploaded files in a directory, named after their content
+type blobStore struct {
+	dir string
+}
+
+func newBlobStore(dir string) (*blobStore, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "thumbs"), 0755); err != nil {
+		return nil, err
+	}
+
+	return &blobStore{dir: dir}, nil
+}
+
+// Writes a blob unless it's already there. The file only appears once it's
+// complete, so a half written blob is never served.
+func (bs *blobStore) put(name string, data []byte) error {
+	dest := filepath.Join(bs.dir, name)
+
+	if _, err := os.Stat(dest); err == nil {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".upload-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dest)
+}
+
+// Serves blobs like the /assets file server, with long lived cache headers and no directory listings
+func (bs *blobStore) handler() http.Handler {
+	files := http.FileServer(http.Dir(bs.dir))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" || strings.HasSuffix(r.URL.Path, "/") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Misses mustn't be cached, the blob may be uploaded later
+		info, err := os.Stat(filepath.Join(bs.dir, filepath.FromSlash(path.Clean("/"+r.URL.Path))))
+
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Cache-Control", mediaCacheControl)
+		files.ServeHTTP(w, r)
+	})
+}
+
+// Scales img down to fit in a thumbnailSize square, smaller images are kept as they are
+func makeThumbnail(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width > thumbnailSize || height > thumbnailSize {
+		if width > height {
+			width, height = thumbnailSize, max(1, height*thumbnailSize/width)
+		} else {
+			width, height = max(1, width*thumbnailSize/height), thumbnailSize
+		}
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Over, nil)
+
+	return thumb
+}
+
+func encodeThumbnail(val media, thumb image.Image) ([]byte, error) {
+	buf := bytes.Buffer{}
+
+	var err error
+
+	if val.Content_Type == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumb)
+	}
+
+	return buf.Bytes(), err
+}
+
+// Checks an uploaded file is an image chirpy accepts, then stores it and its thumbnail
+func (apicfg *apiConfig) uploadMedia(file io.Reader, uploaderID int) (media, error) {
+	data, err := io.ReadAll(io.LimitReader(file, apicfg.mediaMaxSize+1))
+
+	if err != nil {
+		return media{}, err
+	}
+
+	if int64(len(data)) > apicfg.mediaMaxSize {
+		return media{}, errMediaTooLarge
+	}
+
+	// Go by the file's contents, the type the client claims can't be trusted
+	contentType := http.DetectContentType(data)
+
+	if _, ok := mediaExtensions[contentType]; !ok {
+		return media{}, errMediaType
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+
+	if err != nil {
+		return media{}, errMediaInvalid
+	}
+
+	if config.Width > maxMediaDimension || config.Height > maxMediaDimension {
+		return media{}, &validationError{
+			Code: errMediaInvalid.Code,
+			Msg:  fmt.Sprintf("images can be at most %dx%d pixels", maxMediaDimension, maxMediaDimension),
+		}
+	}
+
+	sum := sha256.Sum256(data)
+
+	existing, err := apicfg.db.getMedia(hex.EncodeToString(sum[:]))
+
+	if err == nil {
+		return existing, nil
+	}
+
+	if !errors.Is(err, errMediaNotFound) {
+		return media{}, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+
+	if err != nil {
+		return media{}, errMediaInvalid
+	}
+
+	val := media{
+		ID:           hex.EncodeToString(sum[:]),
+		Uploader_ID:  uploaderID,
+		Content_Type: contentType,
+		Size:         int64(len(data)),
+		Width:        config.Width,
+		Height:       config.Height,
+		Created_At:   time.Now().UTC(),
+	}
+
+	thumb, err := encodeThumbnail(val, makeThumbnail(img))
+
+	if err != nil {
+		return media{}, err
+	}
+
+	// Blobs first, so stored media always has its files
+	if err := apicfg.media.put(val.fileName(), data); err != nil {
+		return media{}, err
+	}
+
+	if err := apicfg.media.put(val.thumbnailName(), thumb); err != nil {
+		return media{}, err
+	}
+
+	if err := apicfg.db.addMedia(val); err != nil {
+		return media{}, err
+	}
+
+	return val, nil
+}
+
+// Checks the media a new chirp wants to attach has been uploaded
+func (apicfg *apiConfig) checkAttachedMedia(ids []string) error {
+	if len(ids) > maxMediaPerChirp {
+		return errTooManyMedia
+	}
+
+	for _, id := range ids {
+		_, err := apicfg.db.getMedia(id)
+
+		if errors.Is(err, errMediaNotFound) {
+			return errUnknownMedia
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
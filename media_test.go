@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Uploads data as the file field, claiming it's of contentType. The response
+// is decoded into both a media and an error, whichever it turns out to be.
+func uploadFile(t *testing.T, handler http.Handler, token, name, contentType string, data []byte) (int, mediaResponse, errResponse) {
+	t.Helper()
+
+	body := bytes.Buffer{}
+	form := multipart.NewWriter(&body)
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="`+name+`"`)
+	header.Set("Content-Type", contentType)
+
+	part, err := form.CreatePart(header)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part.Write(data)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/media", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	uploaded := mediaResponse{}
+	resp := errResponse{}
+
+	json.Unmarshal(rec.Body.Bytes(), &uploaded)
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+
+	return rec.Code, uploaded, resp
+}
+
+func testImage(width, height int) *image.Paletted {
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.Black, color.White})
+
+	for x := 0; x < width; x += 2 {
+		img.SetColorIndex(x, 0, 1)
+	}
+
+	return img
+}
+
+func encodeTestImage(t *testing.T, format string, img image.Image) []byte {
+	t.Helper()
+
+	buf := bytes.Buffer{}
+
+	var err error
+
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "gif":
+		err = gif.Encode(&buf, img, nil)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// A PNG that's nothing but a header claiming the given size, it can't be decoded
+// but its size can be read
+func pngHeader(width, height uint32) []byte {
+	chunk := func(kind string, data []byte) []byte {
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		out = append(out, kind...)
+		out = append(out, data...)
+
+		return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(append([]byte(kind), data...)))
+	}
+
+	ihdr := binary.BigEndian.AppendUint32(nil, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	// 8 bit greyscale
+	ihdr = append(ihdr, 8, 0, 0, 0, 0)
+
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = append(out, chunk("IHDR", ihdr)...)
+
+	return append(out, chunk("IEND", nil)...)
+}
+
+func TestMediaTypeIsSniffed(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	uploader := signup(t, handler, "uploader@example.com")
+
+	img := testImage(40, 30)
+
+	cases := []struct {
+		name     string
+		claimed  string
+		data     []byte
+		wantType string
+		wantExt  string
+	}{
+		{"photo.jpg", "image/jpeg", encodeTestImage(t, "png", img), "image/png", ".png"},
+		{"photo.png", "image/png", encodeTestImage(t, "jpeg", img), "image/jpeg", ".jpg"},
+		{"anim.png", "application/octet-stream", encodeTestImage(t, "gif", img), "image/gif", ".gif"},
+	}
+
+	for _, tc := range cases {
+		code, uploaded, resp := uploadFile(t, handler, uploader.Token, tc.name, tc.claimed, tc.data)
+
+		if code != http.StatusCreated {
+			t.Fatalf("%s: got %d %+v", tc.wantType, code, resp)
+		}
+
+		if uploaded.Content_Type != tc.wantType || !strings.HasSuffix(uploaded.URL, tc.wantExt) {
+			t.Errorf("%s sent as %s: stored as %s at %s", tc.wantType, tc.claimed, uploaded.Content_Type, uploaded.URL)
+		}
+
+		if uploaded.Width != 40 || uploaded.Height != 30 || uploaded.Size != int64(len(tc.data)) {
+			t.Errorf("%s: got %dx%d and %d bytes", tc.wantType, uploaded.Width, uploaded.Height, uploaded.Size)
+		}
+
+		// The blob is served with the sniffed type, not the one the client sent
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uploaded.URL, nil))
+
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tc.wantType || !bytes.Equal(rec.Body.Bytes(), tc.data) {
+			t.Errorf("serving %s: got %d %s", uploaded.URL, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+
+	refused := []struct {
+		name    string
+		claimed string
+		data    []byte
+		code    string
+	}{
+		{"text", "image/png", []byte("just some text, honest"), errMediaType.Code},
+		{"html", "image/gif", []byte("<html><script>alert(1)</script></html>"), errMediaType.Code},
+		{"bmp", "image/bmp", append([]byte("BM"), make([]byte, 64)...), errMediaType.Code},
+		// Sniffed as a PNG from its signature, but there's no image behind it
+		{"truncated png", "image/png", []byte("\x89PNG\r\n\x1a\nnot really"), errMediaInvalid.Code},
+		{"empty", "image/png", nil, errMediaType.Code},
+	}
+
+	for _, tc := range refused {
+		code, _, resp := uploadFile(t, handler, uploader.Token, "upload", tc.claimed, tc.data)
+
+		if code != http.StatusBadRequest || resp.Code != tc.code {
+			t.Errorf("%s: got %d %+v, want 400 %s", tc.name, code, resp, tc.code)
+		}
+	}
+}
+
+func TestMediaDimensionCap(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	uploader := signup(t, handler, "uploader@example.com")
+
+	cases := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"at the cap wide", encodeTestImage(t, "png", testImage(maxMediaDimension, 1)), true},
+		{"at the cap tall", encodeTestImage(t, "png", testImage(1, maxMediaDimension)), true},
+		{"over the cap wide", encodeTestImage(t, "png", testImage(maxMediaDimension+1, 1)), false},
+		{"over the cap tall", encodeTestImage(t, "png", testImage(1, maxMediaDimension+1)), false},
+		// Refused from its header alone, decoding it would need gigabytes
+		{"decompression bomb", pngHeader(100000, 100000), false},
+	}
+
+	for _, tc := range cases {
+		code, uploaded, resp := uploadFile(t, handler, uploader.Token, "upload.png", "image/png", tc.data)
+
+		if tc.ok {
+			if code != http.StatusCreated {
+				t.Errorf("%s: got %d %+v, want 201", tc.name, code, resp)
+			}
+
+			// The thumbnail fits in its square without losing the aspect ratio entirely
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, uploaded.Thumbnail_URL, nil))
+
+			thumb, _, err := image.DecodeConfig(rec.Body)
+
+			if err != nil {
+				t.Fatalf("%s: thumbnail: %v", tc.name, err)
+			}
+
+			if max(thumb.Width, thumb.Height) != thumbnailSize || min(thumb.Width, thumb.Height) != 1 {
+				t.Errorf("%s: thumbnail is %dx%d", tc.name, thumb.Width, thumb.Height)
+			}
+
+			continue
+		}
+
+		if code != http.StatusBadRequest || resp.Code != errMediaInvalid.Code || !strings.Contains(resp.Error, "8000x8000") {
+			t.Errorf("%s: got %d %+v, want 400 %s", tc.name, code, resp, errMediaInvalid.Code)
+		}
+	}
+
+	// Nothing was kept of the refused uploads
+	blobs, err := filepath.Glob(filepath.Join(apicfg.media.dir, "*.png"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blobs) != 2 {
+		t.Errorf("got %d stored blobs, want 2", len(blobs))
+	}
+}
+
+func TestMediaSizeCap(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	uploader := signup(t, handler, "uploader@example.com")
+
+	data := encodeTestImage(t, "png", testImage(200, 200))
+	apicfg.mediaMaxSize = int64(len(data))
+
+	if code, _, resp := uploadFile(t, handler, uploader.Token, "fits.png", "image/png", data); code != http.StatusCreated {
+		t.Errorf("at the size cap: got %d %+v", code, resp)
+	}
+
+	apicfg.mediaMaxSize--
+
+	if code, _, resp := uploadFile(t, handler, uploader.Token, "big.png", "image/png", data); code != http.StatusBadRequest || resp.Code != errMediaTooLarge.Code {
+		t.Errorf("over the size cap: got %d %+v, want 400 %s", code, resp, errMediaTooLarge.Code)
+	}
+}
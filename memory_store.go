@@ -0,0 +1,14 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// newMemDB returns a DB that never touches the disk, everything is lost on
+// restart. Mainly useful for tests.
+func newMemDB() *DB {
+	db := &DB{mux: &sync.RWMutex{}, data: emptyDBStructure(), sessions: map[string]string{}}
+	db.raw, _ = json.Marshal(db.data)
+	return db
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	moderationMask   = "mask"
+	moderationFlag   = "flag"
+	moderationReject = "reject"
+
+	defaultModerationReload = 5 * time.Second
+)
+
+var errChirpRejected = &validationError{Code: "chirp_rejected", Msg: "chirp contains words that aren't allowed"}
+
+// Used when there's no config file, the words chirpy has always masked
+var defaultModerationConfig = moderationConfig{
+	Rules: []moderationRule{
+		{Words: []string{"kerfuffle", "sharbert", "fornax"}, Action: moderationMask},
+	},
+}
+
+// moderationConfig is the format of the moderation config file
+type moderationConfig struct {
+	Rules []moderationRule `json:"rules"`
+}
+
+type moderationRule struct {
+	Words []string `json:"words"`
+	// One of mask, flag or reject
+	Action string `json:"action"`
+}
+
+// moderator checks chirp bodies against the rules in a config file, which is
+// reloaded whenever it changes
+type moderator struct {
+	path string
+	mux  *sync.RWMutex
+	// Normalised word -> action, the strictest action wins when a word is in more than one rule
+	words   map[string]string
+	modTime time.Time
+}
+
+// What moderation made of a chirp body
+type moderationResult struct {
+	// The body with masked words replaced
+	Body string
+	// Held for a moderator to review
+	Flagged bool
+}
+
+// How strict each action is, for when a body or word matches more than one rule
+var moderationSeverity = map[string]int{moderationMask: 1, moderationFlag: 2, moderationReject: 3}
+
+// Folds case, compatibility forms and accents and drops invisible format
+// characters, so "Ｋér\u200Bfuffle" matches "kerfuffle"
+func normaliseWord(word string) string {
+	t := transform.Chain(runes.Remove(runes.In(unicode.Cf)), norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC, cases.Fold())
+
+	normalised, _, err := transform.String(t, word)
+
+	if err != nil {
+		return strings.ToLower(word)
+	}
+
+	return normalised
+}
+
+// A word in a chirp body, with its byte offsets so it can be masked in place
+type moderationToken struct {
+	Word  string
+	Start int
+	End   int
+}
+
+// Splits text into words, anything that isn't a letter, digit, combining mark or
+// format character separates them. Zero-width spaces and soft hyphens are format
+// characters, so they can't be slipped in to break a word up.
+func moderationTokens(text string) []moderationToken {
+	tokens := []moderationToken{}
+	start := -1
+
+	for i, r := range text {
+		inWord := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.In(r, unicode.Mn, unicode.Cf)
+
+		if inWord && start == -1 {
+			start = i
+		}
+
+		if !inWord && start != -1 {
+			tokens = append(tokens, moderationToken{Word: text[start:i], Start: start, End: i})
+			start = -1
+		}
+	}
+
+	if start != -1 {
+		tokens = append(tokens, moderationToken{Word: text[start:], Start: start, End: len(text)})
+	}
+
+	return tokens
+}
+
+func compileModerationConfig(config moderationConfig) (map[string]string, error) {
+	words := map[string]string{}
+
+	for i, rule := range config.Rules {
+		if _, ok := moderationSeverity[rule.Action]; !ok {
+			return nil, fmt.Errorf("rule %d: unknown action %q", i+1, rule.Action)
+		}
+
+		for _, word := range rule.Words {
+			tokens := moderationTokens(word)
+
+			if len(tokens) != 1 || tokens[0].Word != word {
+				return nil, fmt.Errorf("rule %d: %q is not a single word", i+1, word)
+			}
+
+			normalised := normaliseWord(word)
+
+			if moderationSeverity[rule.Action] > moderationSeverity[words[normalised]] {
+				words[normalised] = rule.Action
+			}
+		}
+	}
+
+	return words, nil
+}
+
+func newModerator(path string) (*moderator, error) {
+	mod := &moderator{path: path, mux: &sync.RWMutex{}}
+
+	if err := mod.reload(); err != nil {
+		return nil, err
+	}
+
+	return mod, nil
+}
+
+// Reads the config file again, keeping the current rules if it's invalid.
+// With no config file the default rules are used.
+func (mod *moderator) reload() error {
+	config := defaultModerationConfig
+	modTime := time.Time{}
+
+	info, err := os.Stat(mod.path)
+
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err == nil {
+		modTime = info.ModTime()
+	}
+
+	// Remember this version even if it's invalid, so it's only reported once
+	mod.mux.Lock()
+	mod.modTime = modTime
+	mod.mux.Unlock()
+
+	if !modTime.IsZero() {
+		data, err := os.ReadFile(mod.path)
+
+		if err != nil {
+			return err
+		}
+
+		config = moderationConfig{}
+
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("moderation config %s is invalid: %w", mod.path, err)
+		}
+	}
+
+	words, err := compileModerationConfig(config)
+
+	if err != nil {
+		return fmt.Errorf("moderation config %s is invalid: %w", mod.path, err)
+	}
+
+	mod.mux.Lock()
+	defer mod.mux.Unlock()
+
+	mod.words = words
+
+	return nil
+}
+
+func (mod *moderator) changed() bool {
+	mod.mux.RLock()
+	defer mod.mux.RUnlock()
+
+	info, err := os.Stat(mod.path)
+
+	if os.IsNotExist(err) {
+		return !mod.modTime.IsZero()
+	}
+
+	return err == nil && !info.ModTime().Equal(mod.modTime)
+}
+
+// Reloads the config file whenever it changes, until ctx is cancelled
+func (mod *moderator) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !mod.changed() {
+			continue
+		}
+
+		if err := mod.reload(); err != nil {
+			log.Println("Error reloading moderation config, keeping the old rules:", err)
+			continue
+		}
+
+		log.Println("Reloaded moderation config", mod.path)
+	}
+}
+
+// Runs a chirp body through the rules. Masked words are replaced with ****,
+// and errChirpRejected is returned if any word is rejected outright.
+func (mod *moderator) check(body string) (moderationResult, error) {
+	mod.mux.RLock()
+	defer mod.mux.RUnlock()
+
+	result := moderationResult{}
+	masked := strings.Builder{}
+	last := 0
+
+	for _, token := range moderationTokens(body) {
+		switch mod.words[normaliseWord(token.Word)] {
+		case moderationReject:
+			return moderationResult{}, errChirpRejected
+		case moderationFlag:
+			result.Flagged = true
+		case moderationMask:
+			masked.WriteString(body[last:token.Start])
+			masked.WriteString("****")
+			last = token.End
+		}
+	}
+
+	masked.WriteString(body[last:])
+	result.Body = masked.String()
+
+	return result, nil
+}
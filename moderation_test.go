@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormaliseWord(t *testing.T) {
+	cases := []struct {
+		name string
+		word string
+	}{
+		{"plain", "kerfuffle"},
+		{"upper case", "KERFUFFLE"},
+		{"fullwidth", "ｋｅｒｆｕｆｆｌｅ"},
+		{"fullwidth capitals", "ＫＥＲＦＵＦＦＬＥ"},
+		{"precomposed accent", "kérfuffle"},
+		{"combining accent", "ke\u0301rfu\u0308ffle"},
+		{"stacked combining marks", "ke\u0301\u0323\u0308rfuffle"},
+		{"zero-width space", "ker\u200Bfuffle"},
+		{"zero-width joiner", "ker\u200Dfuf\u200Dfle"},
+		{"zero-width non-joiner", "kerfu\u200Cffle"},
+		{"soft hyphen", "ker\u00ADfuf\u00ADfle"},
+		{"word joiner", "\u2060kerfuffle\u2060"},
+		{"all at once", "Ｋe\u0301r\u200Bf\u00ADＵffle"},
+	}
+
+	for _, tc := range cases {
+		if got := normaliseWord(tc.word); got != "kerfuffle" {
+			t.Errorf("%s: %q normalises to %q", tc.name, tc.word, got)
+		}
+	}
+}
+
+func TestModerationTokens(t *testing.T) {
+	cases := []struct {
+		text string
+		want []string
+	}{
+		{"hello world", []string{"hello", "world"}},
+		{"fornax-kerfuffle, sharbert!", []string{"fornax", "kerfuffle", "sharbert"}},
+		// Format characters and combining marks stay inside the word they're in
+		{"a ker\u200Bfuffle b", []string{"a", "ker\u200Bfuffle", "b"}},
+		{"ker\u00ADfuffle", []string{"ker\u00ADfuffle"}},
+		{"ke\u0301rfuffle", []string{"ke\u0301rfuffle"}},
+		{"", []string{}},
+		{"!!! ...", []string{}},
+	}
+
+	for _, tc := range cases {
+		tokens := moderationTokens(tc.text)
+		got := []string{}
+
+		for _, token := range tokens {
+			got = append(got, token.Word)
+
+			if tc.text[token.Start:token.End] != token.Word {
+				t.Errorf("%q: token %q has offsets %d-%d", tc.text, token.Word, token.Start, token.End)
+			}
+		}
+
+		if len(got) != len(tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.text, got, tc.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%q: got %q, want %q", tc.text, got, tc.want)
+				break
+			}
+		}
+	}
+}
+
+func writeModerationConfig(t *testing.T, path, config string) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModerationActions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+
+	writeModerationConfig(t, path, `{"rules": [
+		{"words": ["kerfuffle", "sharbert"], "action": "mask"},
+		{"words": ["fornax", "sharbert"], "action": "flag"},
+		{"words": ["forbidden"], "action": "reject"}
+	]}`)
+
+	mod, err := newModerator(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		body     string
+		want     string
+		flagged  bool
+		rejected bool
+	}{
+		{"clean", "nothing to see here", "nothing to see here", false, false},
+		{"mask", "what a kerfuffle!", "what a ****!", false, false},
+		{"mask keeps the punctuation", "kerfuffle,kerfuffle.", "****,****.", false, false},
+		{"mask only whole words", "kerfuffles and kerfuffled", "kerfuffles and kerfuffled", false, false},
+		{"mask zero-width space", "a ker\u200Bfuffle here", "a **** here", false, false},
+		{"mask soft hyphen", "a ker\u00ADfuf\u00ADfle here", "a **** here", false, false},
+		{"mask zero-width joiner", "ker\u200Dfuffle", "****", false, false},
+		{"mask fullwidth", "ｋｅｒｆｕｆｆｌｅ time", "**** time", false, false},
+		{"mask combining marks", "ke\u0301rfuffle time", "**** time", false, false},
+		{"flag", "look at fornax", "look at fornax", true, false},
+		{"flag disguised", "FOR\u200Bnáx", "FOR\u200Bnáx", true, false},
+		// In both a mask and a flag rule, the stricter one wins
+		{"strictest action", "sharbert", "sharbert", true, false},
+		{"mask and flag", "kerfuffle at fornax", "**** at fornax", true, false},
+		{"reject", "this is forbidden", "", false, true},
+		{"reject disguised", "for\u00ADbid\u200Bden", "", false, true},
+		{"reject wins over mask", "kerfuffle forbidden", "", false, true},
+	}
+
+	for _, tc := range cases {
+		result, err := mod.check(tc.body)
+
+		if tc.rejected {
+			if err != errChirpRejected {
+				t.Errorf("%s: got %v, want errChirpRejected", tc.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+
+		if result.Body != tc.want || result.Flagged != tc.flagged {
+			t.Errorf("%s: got %q flagged %t, want %q flagged %t", tc.name, result.Body, result.Flagged, tc.want, tc.flagged)
+		}
+	}
+}
+
+func TestModerationConfigValidation(t *testing.T) {
+	dir := t.TempDir()
+
+	cases := []struct {
+		name   string
+		config string
+		valid  bool
+	}{
+		{"default words", `{"rules": [{"words": ["kerfuffle"], "action": "mask"}]}`, true},
+		{"no rules", `{"rules": []}`, true},
+		{"unknown action", `{"rules": [{"words": ["kerfuffle"], "action": "delete"}]}`, false},
+		{"two words", `{"rules": [{"words": ["two words"], "action": "mask"}]}`, false},
+		{"punctuation", `{"rules": [{"words": ["bad!"], "action": "mask"}]}`, false},
+		{"not json", `rules: kerfuffle`, false},
+	}
+
+	for i, tc := range cases {
+		path := filepath.Join(dir, "moderation"+string(rune('a'+i))+".json")
+		writeModerationConfig(t, path, tc.config)
+
+		_, err := newModerator(path)
+
+		if tc.valid && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+
+		if !tc.valid && err == nil {
+			t.Errorf("%s: loaded without an error", tc.name)
+		}
+	}
+
+	// Without a config file the words chirpy always masked are used
+	mod, err := newModerator(filepath.Join(dir, "missing.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := mod.check("kerfuffle sharbert fornax"); result.Body != "**** **** ****" {
+		t.Errorf("default rules: got %q", result.Body)
+	}
+}
+
+func TestModerationHotReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "moderation.json")
+	writeModerationConfig(t, path, `{"rules": [{"words": ["kerfuffle"], "action": "mask"}]}`)
+
+	mod, err := newModerator(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		mod.watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// File times can be coarse, so each version is given a time of its own
+	version := time.Now()
+
+	rewrite := func(config string) {
+		t.Helper()
+
+		writeModerationConfig(t, path, config)
+		version = version.Add(time.Minute)
+
+		if err := os.Chtimes(path, version, version); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	waitFor := func(body string, want string, flagged bool) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+
+		for {
+			result, err := mod.check(body)
+
+			if err == nil && result.Body == want && result.Flagged == flagged {
+				return
+			}
+
+			if time.Now().After(deadline) {
+				t.Fatalf("%q: got %q flagged %t (%v), want %q flagged %t", body, result.Body, result.Flagged, err, want, flagged)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	rewrite(`{"rules": [{"words": ["kerfuffle"], "action": "flag"}, {"words": ["sharbert"], "action": "mask"}]}`)
+	waitFor("kerfuffle sharbert", "kerfuffle ****", true)
+
+	// A broken config is reported and the rules already loaded are kept
+	rewrite(`{"rules": [{"words": ["kerfuffle"], "action": "explode"}]}`)
+	time.Sleep(100 * time.Millisecond)
+	waitFor("kerfuffle sharbert", "kerfuffle ****", true)
+
+	// Removing the file goes back to the defaults
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor("kerfuffle sharbert fornax", "**** **** ****", false)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// chirpCursor marks the last chirp of a page. Clients only ever see it base64
+// encoded, so what's inside can change without breaking them.
+type chirpCursor struct {
+	ID int `json:"id,omitempty"`
+	// Sent instead of the ID when OPAQUE_IDS is set, and looked up when the cursor comes back
+	UUID       string    `json:"uuid,omitempty"`
+	Created_At time.Time `json:"created_at"`
+}
+
+func cursorAfter(val chirp) *chirpCursor {
+	return &chirpCursor{ID: val.ID, Created_At: val.Created_At}
+}
+
+type chirpPage struct {
+	Chirps      []chirp `json:"chirps"`
+	Next_Cursor string  `json:"next_cursor,omitempty"`
+}
+
+func (cursor chirpCursor) encode() string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// The cursor clients are given for the page ending with val
+func (apicfg *apiConfig) encodeCursorAfter(val chirp) string {
+	cursor := cursorAfter(val)
+
+	if apicfg.opaqueIDs {
+		cursor.ID, cursor.UUID = 0, val.UUID
+	}
+
+	return cursor.encode()
+}
+
+func decodeChirpCursor(str string) (chirpCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(str)
+
+	if err != nil {
+		return chirpCursor{}, errInvalidCursor
+	}
+
+	cursor := chirpCursor{}
+
+	if err := json.Unmarshal(data, &cursor); err != nil || (cursor.ID < 1 && cursor.UUID == "") {
+		return chirpCursor{}, errInvalidCursor
+	}
+
+	return cursor, nil
+}
+
+// Decodes a cursor from a client. With opaque IDs it has to name its chirp by
+// UUID, a chirp purged since the cursor was handed out makes it invalid.
+func (apicfg *apiConfig) decodeCursor(str string) (chirpCursor, error) {
+	cursor, err := decodeChirpCursor(str)
+
+	if err != nil {
+		return chirpCursor{}, err
+	}
+
+	if cursor.UUID == "" {
+		if apicfg.opaqueIDs {
+			return chirpCursor{}, errInvalidCursor
+		}
+
+		return cursor, nil
+	}
+
+	val, err := apicfg.db.getChirpByUUID(cursor.UUID)
+
+	if errors.Is(err, errChirpNotFound) {
+		return chirpCursor{}, errInvalidCursor
+	}
+
+	if err != nil {
+		return chirpCursor{}, err
+	}
+
+	cursor.ID = val.ID
+
+	return cursor, nil
+}
+
+// Reads limit and cursor from the query string. paginated is false when the
+// client asked for neither, in which case every chirp is returned as before.
+func (apicfg *apiConfig) parsePageParams(query url.Values) (limit int, after *chirpCursor, paginated bool, err error) {
+	strLimit := query.Get("limit")
+	strCursor := query.Get("cursor")
+
+	if strLimit == "" && strCursor == "" {
+		return 0, nil, false, nil
+	}
+
+	limit = defaultPageLimit
+
+	if strLimit != "" {
+		limit, err = strconv.Atoi(strLimit)
+
+		if err != nil || limit < 1 {
+			return 0, nil, false, errors.New("invalid limit")
+		}
+
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	if strCursor != "" {
+		cursor, err := apicfg.decodeCursor(strCursor)
+
+		if err != nil {
+			return 0, nil, false, err
+		}
+
+		after = &cursor
+	}
+
+	return limit, after, true, nil
+}
+
+// Sends a page of chirps fetched with one more than limit, so we know whether
+// there's a next page. The next page is also advertised in a Link header.
+func (apicfg *apiConfig) respondWithChirpPage(w http.ResponseWriter, r *http.Request, chirpArr []chirp, limit int) {
+	page := chirpPage{Chirps: chirpArr}
+
+	if len(chirpArr) > limit {
+		page.Chirps = chirpArr[:limit]
+		page.Next_Cursor = apicfg.encodeCursorAfter(page.Chirps[limit-1])
+
+		query := r.URL.Query()
+		query.Set("limit", strconv.Itoa(limit))
+		query.Set("cursor", page.Next_Cursor)
+
+		next := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+
+		w.Header().Set("Link", "<"+next.String()+`>; rel="next"`)
+	}
+
+	page.Chirps = apicfg.publicChirps(page.Chirps)
+
+	respondWithJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stores a chirp straight in the database, created the given number of minutes after base
+func seedChirp(t *testing.T, db Store, base time.Time, minutes int, body string) chirp {
+	t.Helper()
+
+	at := base.Add(time.Duration(minutes) * time.Minute)
+
+	val, err := db.insertChirp(chirp{UUID: uuid.NewString(), Author_ID: 1, Chirp: body, Created_At: at, Updated_At: at})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return val
+}
+
+// Follows next_cursor from the first page to the last, returning the bodies in order
+func readAllPages(t *testing.T, handler http.Handler, path string, between func(page int)) []string {
+	t.Helper()
+
+	bodies := []string{}
+	cursor := ""
+
+	for page := 0; ; page++ {
+		url := path
+
+		if cursor != "" {
+			url += "&cursor=" + cursor
+		}
+
+		resp := chirpPage{}
+
+		if code := doRequest(t, handler, http.MethodGet, url, "", nil, &resp); code != http.StatusOK {
+			t.Fatalf("GET %s: %d", url, code)
+		}
+
+		for _, val := range resp.Chirps {
+			bodies = append(bodies, val.Chirp)
+		}
+
+		if resp.Next_Cursor == "" {
+			return bodies
+		}
+
+		cursor = resp.Next_Cursor
+
+		if between != nil {
+			between(page)
+		}
+	}
+}
+
+func TestCursorsAreStableAcrossInserts(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		sort string
+		want []string
+	}{
+		// New chirps sort after the cursor, so later pages pick them up
+		{"asc", []string{"a", "b", "c", "d", "e", "new"}},
+		// New chirps sort before the cursor, so they're left for the next read from the top
+		{"desc", []string{"e", "d", "c", "b", "a"}},
+	}
+
+	for name, open := range stressStores(t) {
+		for _, tc := range cases {
+			t.Run(name+"/"+tc.sort, func(t *testing.T) {
+				db, _ := open()
+				handler := newTestAPI(t, db).routes()
+
+				for i, body := range []string{"a", "b", "c", "d", "e"} {
+					seedChirp(t, db, base, i, body)
+				}
+
+				got := readAllPages(t, handler, "/api/chirps?limit=2&sort="+tc.sort, func(page int) {
+					if page == 0 {
+						seedChirp(t, db, base, 10, "new")
+					}
+				})
+
+				if !slices.Equal(got, tc.want) {
+					t.Errorf("read %v, want %v", got, tc.want)
+				}
+			})
+		}
+	}
+}
+
+func TestCursorsSurviveDeletes(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := newMemDB()
+	handler := newTestAPI(t, db).routes()
+
+	seeded := []chirp{}
+
+	for i, body := range []string{"a", "b", "c", "d"} {
+		seeded = append(seeded, seedChirp(t, db, base, i, body))
+	}
+
+	// The chirp the cursor points at goes away between pages
+	got := readAllPages(t, handler, "/api/chirps?limit=2", func(int) {
+		if err := db.deleteChirp(seeded[1].ID); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if want := []string{"a", "b", "c", "d"}; !slices.Equal(got, want) {
+		t.Errorf("read %v, want %v", got, want)
+	}
+}
+
+func TestInvalidPageParams(t *testing.T) {
+	handler := newTestAPI(t, newMemDB()).routes()
+
+	for _, query := range []string{"limit=0", "limit=-1", "limit=abc", "cursor=not-base64!", "cursor=e30"} {
+		if code := doRequest(t, handler, http.MethodGet, "/api/chirps?"+query, "", nil, nil); code != http.StatusBadRequest {
+			t.Errorf("?%s: got %d, want 400", query, code)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	reactionLike    = "like"
+	reactionRechirp = "rechirp"
+)
+
+// reaction is a user liking or re-chirping a chirp
+type reaction struct {
+	Kind       string    `json:"kind"`
+	User_ID    int       `json:"user_id"`
+	Chirp_ID   int       `json:"chirp_id"`
+	Created_At time.Time `json:"created_at"`
+}
+
+// A chirp in a listing of the user's likes
+type likedChirp struct {
+	Chirp    chirp     `json:"chirp"`
+	Liked_At time.Time `json:"liked_at"`
+}
+
+// Adds or takes away the user's reaction to the chirp named by param, returning the chirp with its new counts
+func (apicfg *apiConfig) react(r *http.Request, kind string, userID int, param string, add bool) (chirp, error) {
+	target, err := apicfg.visibleChirpFromParam(r, param)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if add {
+		err = apicfg.db.addReaction(reaction{Kind: kind, User_ID: userID, Chirp_ID: target.ID, Created_At: time.Now().UTC()})
+	} else {
+		err = apicfg.db.removeReaction(kind, userID, target.ID)
+	}
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	return apicfg.db.getChirp(target.ID)
+}
+
+// The chirps the user liked, most recent like first. Chirps in the trash are
+// left out, and so are held ones unless the user wrote them.
+func (apicfg *apiConfig) getLikes(userID int) ([]likedChirp, error) {
+	likes, err := apicfg.db.getUserReactions(reactionLike, userID)
+
+	if err != nil {
+		return []likedChirp{}, err
+	}
+
+	liked := []likedChirp{}
+
+	for _, val := range likes {
+		target, err := apicfg.db.getChirp(val.Chirp_ID)
+
+		if errors.Is(err, errChirpNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return []likedChirp{}, err
+		}
+
+		if target.Deleted_At != nil || (target.Flagged && target.Author_ID != userID) {
+			continue
+		}
+
+		liked = append(liked, likedChirp{Chirp: apicfg.publicChirp(target), Liked_At: val.Created_At})
+	}
+
+	return liked, nil
+}
+
+// Likes or re-chirps on POST and undoes it on DELETE
+func (apicfg *apiConfig) handleReaction(kind string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := apicfg.userIDFromRequest(r)
+
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		updated, err := apicfg.react(r, kind, userID, r.PathValue("chirpID"), r.Method == http.MethodPost)
+
+		if errors.Is(err, errChirpNotFound) {
+			respondWithError(w, http.StatusNotFound, "chirp not found")
+			return
+		}
+
+		if errors.Is(err, errChirpGone) {
+			respondWithError(w, http.StatusGone, err.Error())
+			return
+		}
+
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, "error saving "+kind)
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, apicfg.publicChirp(updated))
+	}
+}
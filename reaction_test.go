@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestReactionsAreIdempotent(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			handler := newTestAPI(t, db).routes()
+
+			author := newThreadAuthor(t, handler, "author@example.com")
+			a := signup(t, handler, "a@example.com")
+			b := signup(t, handler, "b@example.com")
+			target := author.post("popular", chirp{})
+			path := "/api/chirps/" + target.UUID
+
+			steps := []struct {
+				method   string
+				kind     string
+				token    string
+				likes    int
+				rechirps int
+			}{
+				{http.MethodPost, reactionLike, a.Token, 1, 0},
+				{http.MethodPost, reactionLike, a.Token, 1, 0},
+				{http.MethodPost, reactionLike, b.Token, 2, 0},
+				{http.MethodPost, reactionRechirp, a.Token, 2, 1},
+				{http.MethodPost, reactionRechirp, a.Token, 2, 1},
+				{http.MethodDelete, reactionLike, a.Token, 1, 1},
+				{http.MethodDelete, reactionLike, a.Token, 1, 1},
+				{http.MethodDelete, reactionRechirp, b.Token, 1, 1},
+				{http.MethodPost, reactionLike, author.token, 2, 1},
+			}
+
+			for i, step := range steps {
+				updated := chirp{}
+
+				if code := doRequest(t, handler, step.method, path+"/"+step.kind, step.token, nil, &updated); code != http.StatusOK {
+					t.Fatalf("step %d: %s %s: %d", i, step.method, step.kind, code)
+				}
+
+				if updated.Like_Count != step.likes || updated.Rechirp_Count != step.rechirps {
+					t.Errorf("step %d: %s %s left %d likes and %d rechirps, want %d and %d", i, step.method, step.kind, updated.Like_Count, updated.Rechirp_Count, step.likes, step.rechirps)
+				}
+			}
+
+			stores := []Store{db}
+
+			if reopen != nil {
+				stores = append(stores, reopen())
+			}
+
+			for _, store := range stores {
+				stored, err := store.getChirp(target.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if stored.Like_Count != 2 || stored.Rechirp_Count != 1 {
+					t.Errorf("stored counts: %d likes and %d rechirps, want 2 and 1", stored.Like_Count, stored.Rechirp_Count)
+				}
+			}
+
+			if code := doRequest(t, handler, http.MethodPost, path+"/like", "", nil, nil); code != http.StatusUnauthorized {
+				t.Errorf("liking without a token: got %d, want 401", code)
+			}
+
+			if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+a.UUID+"/like", a.Token, nil, nil); code != http.StatusNotFound {
+				t.Errorf("liking a missing chirp: got %d, want 404", code)
+			}
+		})
+	}
+}
+
+func TestConcurrentReactionsKeepCounts(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+			target := seedChirp(t, db, time.Now().UTC(), 0, "popular")
+
+			// Every user reacts twice at once, only the first of each counts
+			runConcurrently(t, func(i int) error {
+				for _, kind := range []string{reactionLike, reactionLike, reactionRechirp} {
+					err := db.addReaction(reaction{Kind: kind, User_ID: i + 1, Chirp_ID: target.ID, Created_At: time.Now().UTC()})
+
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+
+			check := func(db Store, likes, rechirps int) {
+				t.Helper()
+
+				stored, err := db.getChirp(target.ID)
+
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if stored.Like_Count != likes || stored.Rechirp_Count != rechirps {
+					t.Errorf("got %d likes and %d rechirps, want %d and %d", stored.Like_Count, stored.Rechirp_Count, likes, rechirps)
+				}
+			}
+
+			check(db, stressWorkers, stressWorkers)
+
+			// Half take their like back, twice over
+			runConcurrently(t, func(i int) error {
+				if i%2 == 1 {
+					return nil
+				}
+
+				for j := 0; j < 2; j++ {
+					if err := db.removeReaction(reactionLike, i+1, target.ID); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+
+			check(db, stressWorkers/2, stressWorkers)
+
+			if reopen != nil {
+				check(reopen(), stressWorkers/2, stressWorkers)
+			}
+		})
+	}
+}
+
+func TestLikesListing(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	author := newThreadAuthor(t, handler, "author@example.com")
+	fan := signup(t, handler, "fan@example.com")
+
+	chirps := []chirp{}
+
+	for _, body := range []string{"one", "two", "three"} {
+		chirps = append(chirps, author.post(body, chirp{}))
+	}
+
+	likes := func() []string {
+		t.Helper()
+
+		liked := []likedChirp{}
+
+		if code := doRequest(t, handler, http.MethodGet, "/api/likes", fan.Token, nil, &liked); code != http.StatusOK {
+			t.Fatalf("listing likes: %d", code)
+		}
+
+		bodies := []string{}
+
+		for _, val := range liked {
+			bodies = append(bodies, val.Chirp.Chirp)
+		}
+
+		return bodies
+	}
+
+	// Liked out of order, listed by when they were liked
+	for _, i := range []int{1, 0, 2} {
+		if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+chirps[i].UUID+"/like", fan.Token, nil, nil); code != http.StatusOK {
+			t.Fatalf("liking %s: %d", chirps[i].Chirp, code)
+		}
+	}
+
+	// Liking again doesn't move it up
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+chirps[1].UUID+"/like", fan.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("liking two again: %d", code)
+	}
+
+	if got := likes(); !slices.Equal(got, []string{"three", "one", "two"}) {
+		t.Errorf("got %v, want [three one two]", got)
+	}
+
+	if code := doRequest(t, handler, http.MethodDelete, "/api/chirps/"+chirps[0].UUID+"/like", fan.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("unliking one: %d", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodDelete, "/api/chirps/"+chirps[2].UUID, author.token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("trashing three: %d", code)
+	}
+
+	if got := likes(); !slices.Equal(got, []string{"two"}) {
+		t.Errorf("after unliking one and trashing three: got %v, want [two]", got)
+	}
+
+	// The like is kept while the chirp is in the trash
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+chirps[2].UUID+"/restore", author.token, nil, nil); code != http.StatusOK {
+		t.Fatalf("restoring three: %d", code)
+	}
+
+	if got := likes(); !slices.Equal(got, []string{"three", "two"}) {
+		t.Errorf("after restoring three: got %v, want [three two]", got)
+	}
+}
@@ -8,6 +8,25 @@ import (
 
 type errResponse struct {
 	Error string `json:"error"`
+	// Set for validation errors, so clients don't have to match on the message
+	Code string `json:"code,omitempty"`
+}
+
+// validationError is a problem with what the client sent, answered with a 400
+// and a code clients can switch on
+type validationError struct {
+	Code string
+	Msg  string
+}
+
+func (e *validationError) Error() string {
+	return e.Msg
+}
+
+// Errors with the same code match, so errors.Is works when the message has details filled in
+func (e *validationError) Is(target error) bool {
+	t, ok := target.(*validationError)
+	return ok && t.Code == e.Code
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -32,3 +51,10 @@ func respondWithError(w http.ResponseWriter, code int, msg string) {
 		Error: msg,
 	})
 }
+
+func respondWithValidationError(w http.ResponseWriter, err *validationError) {
+	respondWithJSON(w, http.StatusBadRequest, errResponse{
+		Error: err.Msg,
+		Code:  err.Code,
+	})
+}
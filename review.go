@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	reviewApprove = "approve"
+	reviewRemove  = "remove"
+	reviewBan     = "ban"
+)
+
+var (
+	errUserBanned          = errors.New("account has been banned")
+	errUnknownReviewAction = errors.New("action must be approve, remove or ban")
+	errAuthorOutranks      = errors.New("only admins can remove or ban chirps by moderators and admins")
+)
+
+// report is a user asking moderators to look at a chirp
+type report struct {
+	Chirp_ID    int       `json:"chirp_id"`
+	Reporter_ID int       `json:"reporter_id"`
+	Reason      string    `json:"reason"`
+	Created_At  time.Time `json:"created_at"`
+	// Set once a moderator has acted on the chirp
+	Resolved_At *time.Time `json:"resolved_at,omitempty"`
+}
+
+// auditEntry records a moderator's decision on a chirp
+type auditEntry struct {
+	ID           int    `json:"id"`
+	Moderator_ID int    `json:"moderator_id"`
+	Action       string `json:"action"`
+	Chirp_ID     int    `json:"chirp_id"`
+	Author_ID    int    `json:"author_id"`
+	// The body at the time, as removed chirps are gone for good
+	Chirp      string    `json:"body"`
+	Note       string    `json:"note,omitempty"`
+	Created_At time.Time `json:"created_at"`
+}
+
+// A chirp waiting for a moderator, either held by moderation or reported by users
+type reviewItem struct {
+	Chirp   chirp    `json:"chirp"`
+	Reports []report `json:"reports"`
+}
+
+// Held chirps can only be seen by their author and moderators until they're approved
+func (apicfg *apiConfig) canSeeChirp(r *http.Request, val chirp) bool {
+	if !val.Flagged {
+		return true
+	}
+
+	if r.Header.Get("Authorization") == "" {
+		return false
+	}
+
+	userID, role, err := apicfg.claimsFromRequest(r)
+
+	if err != nil {
+		return false
+	}
+
+	return userID == val.Author_ID || role == roleModerator || role == roleAdmin
+}
+
+func (apicfg *apiConfig) reportChirp(r *http.Request, reporterID int, param string) error {
+	defer r.Body.Close()
+
+	params := struct {
+		Reason string `json:"reason"`
+	}{}
+
+	// The reason is optional, so an empty body is fine
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	target, err := apicfg.visibleChirpFromParam(r, param)
+
+	if err != nil {
+		return err
+	}
+
+	return apicfg.db.addReport(report{
+		Chirp_ID:    target.ID,
+		Reporter_ID: reporterID,
+		Reason:      params.Reason,
+		Created_At:  time.Now().UTC(),
+	})
+}
+
+// Every chirp waiting for review, oldest first
+func (apicfg *apiConfig) reviewQueue() ([]reviewItem, error) {
+	held, err := apicfg.db.listChirps(chirpQuery{Sort_By: sortByCreatedAt, Held: true})
+
+	if err != nil {
+		return []reviewItem{}, err
+	}
+
+	reports, err := apicfg.db.getOpenReports()
+
+	if err != nil {
+		return []reviewItem{}, err
+	}
+
+	items := map[int]*reviewItem{}
+
+	for _, val := range held {
+		items[val.ID] = &reviewItem{Chirp: val, Reports: []report{}}
+	}
+
+	for _, val := range reports {
+		if items[val.Chirp_ID] == nil {
+			reported, err := apicfg.db.getChirp(val.Chirp_ID)
+
+			if errors.Is(err, errChirpNotFound) {
+				continue
+			}
+
+			if err != nil {
+				return []reviewItem{}, err
+			}
+
+			// Nothing left to review once the author has deleted it
+			if reported.Deleted_At != nil {
+				continue
+			}
+
+			items[val.Chirp_ID] = &reviewItem{Chirp: reported, Reports: []report{}}
+		}
+
+		items[val.Chirp_ID].Reports = append(items[val.Chirp_ID].Reports, val)
+	}
+
+	queue := []reviewItem{}
+
+	for _, item := range items {
+		queue = append(queue, *item)
+	}
+
+	sort.Slice(queue, func(i, j int) bool {
+		return chirpLess(queue[i].Chirp, queue[j].Chirp, sortByCreatedAt)
+	})
+
+	return queue, nil
+}
+
+// Acts on a chirp in the review queue and records the decision in the audit log
+func (apicfg *apiConfig) reviewChirp(data io.ReadCloser, moderatorID int, param, action string) (auditEntry, error) {
+	defer data.Close()
+
+	if action != reviewApprove && action != reviewRemove && action != reviewBan {
+		return auditEntry{}, errUnknownReviewAction
+	}
+
+	params := struct {
+		Note string `json:"note"`
+	}{}
+
+	if err := json.NewDecoder(data).Decode(&params); err != nil && !errors.Is(err, io.EOF) {
+		return auditEntry{}, err
+	}
+
+	target, err := apicfg.chirpFromParam(param)
+
+	if err != nil {
+		return auditEntry{}, err
+	}
+
+	if action == reviewRemove || action == reviewBan {
+		if err := apicfg.checkCanRemove(moderatorID, target.Author_ID); err != nil {
+			return auditEntry{}, err
+		}
+	}
+
+	now := time.Now().UTC()
+
+	switch action {
+	case reviewApprove:
+		err = apicfg.approveChirp(target, now)
+	case reviewRemove:
+		err = apicfg.removeChirp(target)
+	case reviewBan:
+		err = apicfg.banAuthor(target, now)
+	}
+
+	if err != nil {
+		return auditEntry{}, err
+	}
+
+	return apicfg.db.appendAuditEntry(auditEntry{
+		Moderator_ID: moderatorID,
+		Action:       action,
+		Chirp_ID:     target.ID,
+		Author_ID:    target.Author_ID,
+		Chirp:        target.Chirp,
+		Note:         params.Note,
+		Created_At:   now,
+	})
+}
+
+// Moderators can only remove and ban regular users, so they can't take out
+// each other or the admins above them. Admins can act on anyone.
+func (apicfg *apiConfig) checkCanRemove(moderatorID, authorID int) error {
+	moderator, err := apicfg.db.getUsrByID(moderatorID)
+
+	if err != nil {
+		return err
+	}
+
+	if moderator.Role == roleAdmin {
+		return nil
+	}
+
+	author, err := apicfg.db.getUsrByID(authorID)
+
+	// Chirps by accounts that are gone can be cleaned up by anyone
+	if errors.Is(err, errUserNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if author.Role == roleModerator || author.Role == roleAdmin {
+		return errAuthorOutranks
+	}
+
+	return nil
+}
+
+// Releases a held chirp and closes its reports
+func (apicfg *apiConfig) approveChirp(target chirp, now time.Time) error {
+	if target.Flagged {
+		approved, err := apicfg.db.setChirpFlagged(target.ID, false)
+
+		if err != nil {
+			return err
+		}
+
+		if err := apicfg.publishChirp(approved); err != nil {
+			return err
+		}
+	}
+
+	return apicfg.db.resolveReports(target.ID, now)
+}
+
+// Deletes a chirp for good, unlike authors deleting their own it can't be restored
+func (apicfg *apiConfig) removeChirp(target chirp) error {
+	if err := apicfg.unpublishChirp(target); err != nil {
+		return err
+	}
+
+	return apicfg.db.deleteChirp(target.ID)
+}
+
+// Removes the chirp and stops its author from logging in or posting
+func (apicfg *apiConfig) banAuthor(target chirp, now time.Time) error {
+	if err := apicfg.removeChirp(target); err != nil {
+		return err
+	}
+
+	_, err := apicfg.db.updateUser(target.Author_ID, func(author *user) error {
+		author.Is_Banned = true
+		author.Updated_At = now
+		return nil
+	})
+
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHeldChirpsAreHiddenFromOthers(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	for _, email := range []string{"author@example.com", "other@example.com"} {
+		creds := map[string]string{"email": email, "password": "password"}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d", email, code)
+		}
+	}
+
+	author := login(t, handler, "author@example.com")
+	other := login(t, handler, "other@example.com")
+
+	held := chirp{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "held"}, &held); code != http.StatusCreated {
+		t.Fatalf("chirping: %d", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+held.UUID+"/like", other.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("liking before the chirp is held: %d", code)
+	}
+
+	if _, err := apicfg.db.setChirpFlagged(held.ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	routes := []struct {
+		method string
+		path   string
+		body   any
+	}{
+		{http.MethodGet, "/api/chirps/" + held.UUID, nil},
+		{http.MethodGet, "/api/chirps/" + held.UUID + "/revisions", nil},
+		{http.MethodGet, "/api/chirps/" + held.UUID + "/thread", nil},
+		{http.MethodPost, "/api/chirps/" + held.UUID + "/like", nil},
+		{http.MethodDelete, "/api/chirps/" + held.UUID + "/like", nil},
+		{http.MethodPost, "/api/chirps/" + held.UUID + "/rechirp", nil},
+		{http.MethodDelete, "/api/chirps/" + held.UUID + "/rechirp", nil},
+		{http.MethodPost, "/api/chirps/" + held.UUID + "/report", nil},
+	}
+
+	for _, route := range routes {
+		if code := doRequest(t, handler, route.method, route.path, other.Token, route.body, nil); code != http.StatusNotFound {
+			t.Errorf("%s %s on a held chirp: got %d, want 404", route.method, route.path, code)
+		}
+
+		if code := doRequest(t, handler, route.method, route.path, "", route.body, nil); route.method == http.MethodGet && code != http.StatusNotFound {
+			t.Errorf("%s %s on a held chirp signed out: got %d, want 404", route.method, route.path, code)
+		}
+	}
+
+	reply := map[string]string{"body": "reply", "in_reply_to": held.UUID}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", other.Token, reply, nil); code == http.StatusCreated {
+		t.Error("replied to a held chirp")
+	}
+
+	likes := []likedChirp{}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/likes", other.Token, nil, &likes); code != http.StatusOK {
+		t.Fatalf("listing likes: %d", code)
+	}
+
+	if len(likes) != 0 {
+		t.Errorf("likes include %d held chirps", len(likes))
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps/"+held.UUID+"/revisions", author.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("author reading revisions of their held chirp: got %d, want 200", code)
+	}
+}
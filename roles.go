@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+var (
+	errMissingRole = errors.New("you don't have permission to do that")
+	errUnknownRole = errors.New("role must be user, moderator or admin")
+)
+
+type contextKey int
+
+// The ID of the user requireRole let through
+const ctxUserID contextKey = iota
+
+func validRole(role string) bool {
+	return role == roleUser || role == roleModerator || role == roleAdmin
+}
+
+// Only lets requests through with a valid JWT from a user who currently has one
+// of roles. The user's ID is put in the request context for the handler, see userIDFromContext.
+func (apicfg *apiConfig) requireRole(next http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, role, err := apicfg.claimsFromRequest(r)
+
+		if err != nil {
+			respondWithAuthError(w, err)
+			return
+		}
+
+		for _, allowed := range roles {
+			if role == allowed {
+				next(w, r.WithContext(context.WithValue(r.Context(), ctxUserID, userID)))
+				return
+			}
+		}
+
+		respondWithError(w, http.StatusForbidden, errMissingRole.Error())
+	}
+}
+
+func userIDFromContext(ctx context.Context) int {
+	userID, ok := ctx.Value(ctxUserID).(int)
+
+	if !ok {
+		return -1
+	}
+
+	return userID
+}
+
+// Makes an existing account an admin, so there's someone to hand out roles. Run
+// with -grant-admin, which names the account by ID or UUID: anyone can sign up
+// with any email address, so an email isn't proof of who owns the account.
+func grantAdmin(db Store, ref string) (user, error) {
+	var usr user
+	var err error
+
+	if _, parseErr := uuid.Parse(ref); parseErr == nil {
+		usr, err = db.getUsrByUUID(ref)
+	} else if id, atoiErr := strconv.Atoi(ref); atoiErr == nil {
+		usr, err = db.getUsrByID(id)
+	} else {
+		err = errUserNotFound
+	}
+
+	if err != nil {
+		return user{}, err
+	}
+
+	return db.updateUser(usr.ID, func(usr *user) error {
+		usr.Role = roleAdmin
+		usr.Updated_At = time.Now().UTC()
+		return nil
+	})
+}
+
+// Changes a user's role, it applies to tokens issued from then on
+func (apicfg *apiConfig) setUserRole(data io.ReadCloser, param string) (user, error) {
+	defer data.Close()
+
+	params := struct {
+		Role string `json:"role"`
+	}{}
+
+	if err := json.NewDecoder(data).Decode(&params); err != nil || !validRole(params.Role) {
+		return user{}, errUnknownRole
+	}
+
+	userID, err := apicfg.userIDFromParam(param)
+
+	if err != nil {
+		return user{}, err
+	}
+
+	return apicfg.db.updateUser(userID, func(usr *user) error {
+		usr.Role = params.Role
+		usr.Updated_At = time.Now().UTC()
+		return nil
+	})
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestSignupNeverGrantsAdmin(t *testing.T) {
+	// Left over from when admins were picked by email, it mustn't do anything
+	t.Setenv("ADMIN_EMAILS", "boss@example.com")
+
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	boss := signup(t, handler, "boss@example.com")
+
+	if boss.Role != roleUser {
+		t.Errorf("signing up with an admin's email gave role %q", boss.Role)
+	}
+
+	usr, _ := apicfg.db.getByEmail("boss@example.com")
+
+	if usr.Role != roleUser {
+		t.Errorf("stored role %q, want %q", usr.Role, roleUser)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/admin/moderation/queue", boss.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("moderation queue: got %d, want 403", code)
+	}
+}
+
+func TestGrantAdmin(t *testing.T) {
+	db := newMemDB()
+	handler := newTestAPI(t, db).routes()
+
+	first := signup(t, handler, "first@example.com")
+	second := signup(t, handler, "second@example.com")
+
+	for _, ref := range []string{fmt.Sprint(first.ID), second.UUID} {
+		granted, err := grantAdmin(db, ref)
+
+		if err != nil {
+			t.Fatalf("%s: %v", ref, err)
+		}
+
+		if granted.Role != roleAdmin {
+			t.Errorf("%s: got role %q", ref, granted.Role)
+		}
+	}
+
+	// Emails don't name an account, and only accounts that exist can be promoted
+	for _, ref := range []string{"first@example.com", "99", "5f0c7d1e-0000-4000-8000-000000000000", ""} {
+		if _, err := grantAdmin(db, ref); err != errUserNotFound {
+			t.Errorf("%q: got %v, want errUserNotFound", ref, err)
+		}
+	}
+}
+
+func TestRoleChangesApplyImmediately(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	admin := signup(t, handler, "admin@example.com")
+
+	if _, err := grantAdmin(apicfg.db, admin.UUID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Issued while they were still a user
+	member := signup(t, handler, "member@example.com")
+
+	setRole := func(role string) {
+		t.Helper()
+
+		path := fmt.Sprintf("/admin/users/%d/role", member.ID)
+
+		if code := doRequest(t, handler, http.MethodPut, path, admin.Token, map[string]string{"role": role}, nil); code != http.StatusOK {
+			t.Fatalf("setting role %s: %d", role, code)
+		}
+	}
+
+	queue := func() int {
+		return doRequest(t, handler, http.MethodGet, "/admin/moderation/queue", member.Token, nil, nil)
+	}
+
+	if code := queue(); code != http.StatusForbidden {
+		t.Errorf("as a user: got %d, want 403", code)
+	}
+
+	setRole(roleModerator)
+
+	if code := queue(); code != http.StatusOK {
+		t.Errorf("promoted, same token: got %d, want 200", code)
+	}
+
+	setRole(roleUser)
+
+	if code := queue(); code != http.StatusForbidden {
+		t.Errorf("demoted, same token: got %d, want 403", code)
+	}
+
+	// A token claiming more than the stored role gets nothing for it
+	forged, err := apicfg.createJWT(user{ID: member.ID, Role: roleAdmin}, "")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/admin/metrics", forged.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("admin claim on a user: got %d, want 403", code)
+	}
+}
+
+func TestModeratorsCantRemoveTheirPeers(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	roles := map[string]string{"admin": roleAdmin, "mod": roleModerator, "peer": roleModerator, "member": roleUser}
+	users := map[string]threadAuthor{}
+	chirps := map[string]chirp{}
+
+	for _, name := range []string{"admin", "mod", "peer", "member"} {
+		users[name] = newThreadAuthor(t, handler, name+"@example.com")
+		usr, _ := apicfg.db.getByEmail(name + "@example.com")
+
+		if _, err := apicfg.db.updateUser(usr.ID, func(usr *user) error {
+			usr.Role = roles[name]
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		chirps[name] = users[name].post("by "+name, chirp{})
+	}
+
+	review := func(as, target, action string) int {
+		t.Helper()
+
+		path := "/admin/moderation/chirps/" + chirps[target].UUID + "/" + action
+
+		return doRequest(t, handler, http.MethodPost, path, users[as].token, nil, nil)
+	}
+
+	cases := []struct {
+		as     string
+		target string
+		action string
+		want   int
+	}{
+		{"mod", "admin", reviewBan, http.StatusForbidden},
+		{"mod", "admin", reviewRemove, http.StatusForbidden},
+		{"mod", "peer", reviewBan, http.StatusForbidden},
+		{"mod", "peer", reviewRemove, http.StatusForbidden},
+		// Approving takes nothing away from anyone
+		{"mod", "admin", reviewApprove, http.StatusOK},
+		{"mod", "member", reviewRemove, http.StatusOK},
+		{"admin", "peer", reviewBan, http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		if code := review(tc.as, tc.target, tc.action); code != tc.want {
+			t.Errorf("%s trying to %s %s's chirp: got %d, want %d", tc.as, tc.action, tc.target, code, tc.want)
+		}
+	}
+
+	for name, banned := range map[string]bool{"admin": false, "mod": false, "peer": true, "member": false} {
+		usr, _ := apicfg.db.getByEmail(name + "@example.com")
+
+		if usr.Is_Banned != banned {
+			t.Errorf("%s banned: %t, want %t", name, usr.Is_Banned, banned)
+		}
+	}
+
+	if _, err := apicfg.db.getChirp(chirps["admin"].ID); err != nil {
+		t.Errorf("admin's chirp after the refused removal: %v", err)
+	}
+
+	// Refused actions aren't in the audit log
+	entries, err := apicfg.db.getAuditLog()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 {
+		t.Errorf("got %d audit entries, want 3", len(entries))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// searchIndex is an in-memory inverted index over chirp bodies. It's built from
+// the store at startup and kept up to date as chirps are created and deleted.
+type searchIndex struct {
+	mux *sync.RWMutex
+	// term -> chirp ID -> positions of the term in the chirp
+	postings map[string]map[int][]int
+	// chirp ID -> its tokens, kept to remove it again and to find highlights
+	docs map[int][]searchToken
+}
+
+type searchToken struct {
+	Term string
+	// Offsets in Unicode code points, end exclusive
+	Start int
+	End   int
+}
+
+type highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type searchResult struct {
+	Chirp      chirp       `json:"chirp"`
+	Score      float64     `json:"score"`
+	Highlights []highlight `json:"highlights"`
+}
+
+// One part of a query: a single term, a quoted phrase, or either ending in * for a prefix match
+type searchClause struct {
+	Terms  []string
+	Prefix bool
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		mux:      &sync.RWMutex{},
+		postings: map[string]map[int][]int{},
+		docs:     map[int][]searchToken{},
+	}
+}
+
+func buildSearchIndex(db Store) (*searchIndex, error) {
+	index := newSearchIndex()
+
+	chirpArr, err := db.getAllChirps()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, val := range chirpArr {
+		index.add(val)
+	}
+
+	return index, nil
+}
+
+// Splits text into lower case runs of letters and digits
+func tokenize(text string) []searchToken {
+	tokens := []searchToken{}
+	current := []rune{}
+	start := 0
+	pos := 0
+
+	flush := func() {
+		if len(current) > 0 {
+			tokens = append(tokens, searchToken{Term: string(current), Start: start, End: pos})
+			current = current[:0]
+		}
+	}
+
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if len(current) == 0 {
+				start = pos
+			}
+			current = append(current, unicode.ToLower(r))
+		} else {
+			flush()
+		}
+		pos++
+	}
+
+	flush()
+
+	return tokens
+}
+
+func parseSearchQuery(q string) []searchClause {
+	clauses := []searchClause{}
+
+	addClause := func(text string) {
+		prefix := strings.HasSuffix(text, "*")
+		tokens := tokenize(text)
+
+		if len(tokens) == 0 {
+			return
+		}
+
+		clause := searchClause{Prefix: prefix}
+
+		for _, token := range tokens {
+			clause.Terms = append(clause.Terms, token.Term)
+		}
+
+		clauses = append(clauses, clause)
+	}
+
+	// Quotes alternate between phrases and plain words
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			addClause(part)
+			continue
+		}
+
+		for _, word := range strings.Fields(part) {
+			addClause(word)
+		}
+	}
+
+	return clauses
+}
+
+func (index *searchIndex) add(val chirp) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(val.ID)
+
+	tokens := tokenize(val.Chirp)
+
+	for i, token := range tokens {
+		if index.postings[token.Term] == nil {
+			index.postings[token.Term] = map[int][]int{}
+		}
+		index.postings[token.Term][val.ID] = append(index.postings[token.Term][val.ID], i)
+	}
+
+	index.docs[val.ID] = tokens
+}
+
+func (index *searchIndex) remove(id int) {
+	index.mux.Lock()
+	defer index.mux.Unlock()
+
+	index.removeLocked(id)
+}
+
+func (index *searchIndex) removeLocked(id int) {
+	for _, token := range index.docs[id] {
+		delete(index.postings[token.Term], id)
+
+		if len(index.postings[token.Term]) == 0 {
+			delete(index.postings, token.Term)
+		}
+	}
+
+	delete(index.docs, id)
+}
+
+// Terms in the index that a single query term matches
+func (index *searchIndex) expand(term string, prefix bool) []string {
+	if !prefix {
+		if _, ok := index.postings[term]; ok {
+			return []string{term}
+		}
+		return nil
+	}
+
+	terms := []string{}
+
+	for indexed := range index.postings {
+		if strings.HasPrefix(indexed, term) {
+			terms = append(terms, indexed)
+		}
+	}
+
+	return terms
+}
+
+// Finds where a clause matches, returning the token positions each match starts at per chirp
+func (index *searchIndex) matchClause(clause searchClause) map[int][]int {
+	last := len(clause.Terms) - 1
+
+	// Positions of every term in the clause, only the last one can be a prefix
+	termPositions := make([]map[int][]int, len(clause.Terms))
+
+	for i, term := range clause.Terms {
+		termPositions[i] = map[int][]int{}
+
+		for _, indexed := range index.expand(term, clause.Prefix && i == last) {
+			for id, positions := range index.postings[indexed] {
+				termPositions[i][id] = append(termPositions[i][id], positions...)
+			}
+		}
+	}
+
+	matches := map[int][]int{}
+
+	for id, starts := range termPositions[0] {
+		for _, start := range starts {
+			found := true
+
+			for offset := 1; offset <= last && found; offset++ {
+				found = containsInt(termPositions[offset][id], start+offset)
+			}
+
+			if found {
+				matches[id] = append(matches[id], start)
+			}
+		}
+	}
+
+	return matches
+}
+
+func containsInt(arr []int, val int) bool {
+	for _, item := range arr {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the chirps matching every clause of q, best first, along with their
+// scores and the spans of the body that matched. Only the chirp IDs are filled in,
+// a limit of 0 returns every match.
+func (index *searchIndex) search(q string, limit int) []searchResult {
+	clauses := parseSearchQuery(q)
+
+	if len(clauses) == 0 {
+		return []searchResult{}
+	}
+
+	index.mux.RLock()
+	defer index.mux.RUnlock()
+
+	results := map[int]*searchResult{}
+	total := float64(len(index.docs))
+
+	for i, clause := range clauses {
+		matches := index.matchClause(clause)
+		idf := math.Log(1 + total/float64(len(matches)+1))
+
+		for id, starts := range matches {
+			if i > 0 && results[id] == nil {
+				continue
+			}
+
+			if results[id] == nil {
+				results[id] = &searchResult{Chirp: chirp{ID: id}}
+			}
+
+			tokens := index.docs[id]
+
+			for _, start := range starts {
+				results[id].Highlights = append(results[id].Highlights, highlight{
+					Start: tokens[start].Start,
+					End:   tokens[start+len(clause.Terms)-1].End,
+				})
+			}
+
+			// Phrases are rarer than their terms, so count them for more
+			results[id].Score += float64(len(starts)) * idf * float64(len(clause.Terms))
+		}
+
+		// Every clause has to match
+		for id := range results {
+			if _, ok := matches[id]; !ok {
+				delete(results, id)
+			}
+		}
+	}
+
+	resultArr := []searchResult{}
+
+	for id, result := range results {
+		result.Score /= math.Sqrt(float64(len(index.docs[id])))
+
+		sort.Slice(result.Highlights, func(i, j int) bool {
+			return result.Highlights[i].Start < result.Highlights[j].Start
+		})
+
+		resultArr = append(resultArr, *result)
+	}
+
+	sort.Slice(resultArr, func(i, j int) bool {
+		if resultArr[i].Score != resultArr[j].Score {
+			return resultArr[i].Score > resultArr[j].Score
+		}
+		// Newer chirps first when the scores tie
+		return resultArr[i].Chirp.ID > resultArr[j].Chirp.ID
+	})
+
+	if limit > 0 && len(resultArr) > limit {
+		resultArr = resultArr[:limit]
+	}
+
+	return resultArr
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func newTestSearchIndex(bodies ...string) *searchIndex {
+	index := newSearchIndex()
+
+	for i, body := range bodies {
+		index.add(chirp{ID: i + 1, Chirp: body})
+	}
+
+	return index
+}
+
+func resultIDs(results []searchResult) []int {
+	ids := []int{}
+
+	for _, result := range results {
+		ids = append(ids, result.Chirp.ID)
+	}
+
+	return ids
+}
+
+func TestSearchMatching(t *testing.T) {
+	index := newTestSearchIndex(
+		"the quick brown fox",
+		"brown quick the fox",
+		"a quiet night",
+		"Quick! Brown-ish cows",
+	)
+
+	cases := []struct {
+		q    string
+		want []int
+	}{
+		{"quick", []int{4, 1, 2}},
+		{"QUICK", []int{4, 1, 2}},
+		{`"quick brown"`, []int{4, 1}},
+		{`"brown quick"`, []int{2}},
+		// Every clause has to match
+		{"quick night", []int{}},
+		{"quiet night", []int{3}},
+		{"qui*", []int{4, 3, 1, 2}},
+		// Only the last term of a phrase is a prefix
+		{`"quick bro*"`, []int{4, 1}},
+		{`"qu* brown"`, []int{}},
+		{"zebra", []int{}},
+		{"", []int{}},
+		{`"" *`, []int{}},
+	}
+
+	for _, tc := range cases {
+		got := resultIDs(index.search(tc.q, 0))
+
+		// Ranking is tested separately, here only the set matters
+		slices.Sort(got)
+		want := slices.Clone(tc.want)
+		slices.Sort(want)
+
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", tc.q, got, want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	index := newTestSearchIndex(
+		"cats are fine I suppose",
+		"cats cats cats",
+		"cats",
+		"cats",
+		"dogs and cats and a long tail of other words",
+	)
+
+	got := resultIDs(index.search("cats", 0))
+	// More matches per word first, then shorter chirps, then newer ones on a tie
+	want := []int{2, 4, 3, 1, 5}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got := resultIDs(index.search("cats", 2)); !slices.Equal(got, want[:2]) {
+		t.Errorf("limit 2: got %v, want %v", got, want[:2])
+	}
+
+	// A phrase counts for more than its words matched apart
+	index = newTestSearchIndex("dogs and cats", "cats dogs")
+
+	if got := resultIDs(index.search(`"cats dogs"`, 0)); !slices.Equal(got, []int{2}) {
+		t.Errorf("phrase: got %v, want [2]", got)
+	}
+
+	if got := resultIDs(index.search("cats dogs", 0)); !slices.Equal(got, []int{2, 1}) {
+		t.Errorf("words: got %v, want [2 1]", got)
+	}
+}
+
+func TestSearchHighlights(t *testing.T) {
+	index := newTestSearchIndex("héllo wörld 👋 wörld", "say hello, World")
+
+	cases := []struct {
+		q    string
+		want map[int][]highlight
+	}{
+		// Offsets are in code points, the emoji counts as one
+		{"wörld", map[int][]highlight{1: {{6, 11}, {14, 19}}}},
+		{"héllo wörld", map[int][]highlight{1: {{0, 5}, {6, 11}, {14, 19}}}},
+		{`"héllo wörld"`, map[int][]highlight{1: {{0, 11}}}},
+		{`"hello world"`, map[int][]highlight{2: {{4, 16}}}},
+		{"hel*", map[int][]highlight{2: {{4, 9}}}},
+		{"w*", map[int][]highlight{1: {{6, 11}, {14, 19}}, 2: {{11, 16}}}},
+	}
+
+	for _, tc := range cases {
+		got := map[int][]highlight{}
+
+		for _, result := range index.search(tc.q, 0) {
+			got[result.Chirp.ID] = result.Highlights
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestSearchLimitCountsVisibleChirps(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	creds := map[string]string{"email": "author@example.com", "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+		t.Fatalf("creating user: %d", code)
+	}
+
+	author := login(t, handler, "author@example.com")
+	chirps := map[string]chirp{}
+
+	for _, body := range []string{"match one", "match two", "match three"} {
+		created := chirp{}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": body}, &created); code != http.StatusCreated {
+			t.Fatalf("chirping %q: %d", body, code)
+		}
+
+		chirps[body] = created
+	}
+
+	search := func(limit int) []string {
+		results := []searchResult{}
+
+		if code := doRequest(t, handler, http.MethodGet, fmt.Sprintf("/api/chirps/search?q=match&limit=%d", limit), "", nil, &results); code != http.StatusOK {
+			t.Fatalf("searching: %d", code)
+		}
+
+		bodies := []string{}
+
+		for _, result := range results {
+			bodies = append(bodies, result.Chirp.Chirp)
+		}
+
+		return bodies
+	}
+
+	path := fmt.Sprintf("/api/chirps/%d", chirps["match three"].ID)
+
+	if code := doRequest(t, handler, http.MethodDelete, path, author.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("trashing: %d", code)
+	}
+
+	if slices.Contains(resultIDs(apicfg.search.search("match", 0)), chirps["match three"].ID) {
+		t.Error("trashed chirp is still in the search index")
+	}
+
+	// Held straight in the store, as if it happened after the index was last told
+	if _, err := apicfg.db.setChirpFlagged(chirps["match two"].ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The two best matches are both hidden, the limit still has to be filled
+	if got := search(1); !slices.Equal(got, []string{"match one"}) {
+		t.Errorf("limit 1: got %v, want [match one]", got)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, path+"/restore", author.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("restoring: %d", code)
+	}
+
+	if got := search(5); !slices.Equal(got, []string{"match three", "match one"}) {
+		t.Errorf("after restoring: got %v, want [match three match one]", got)
+	}
+}
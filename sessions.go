@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// User agents longer than this are cut short, they're only shown back to the user
+const maxUserAgentLength = 256
+
+var (
+	errSessionNotFound = errors.New("session not found")
+	errSessionEnded    = errors.New("session has been logged out")
+)
+
+// Where a session is being used from
+type device struct {
+	User_Agent string
+	IP         string
+}
+
+// A login on one device, made up of the refresh tokens rotated from it
+type session struct {
+	// The refresh token family, also carried in the session's JWTs
+	ID           string    `json:"id"`
+	User_Agent   string    `json:"user_agent"`
+	IP           string    `json:"ip"`
+	Created_At   time.Time `json:"created_at"`
+	Last_Used_At time.Time `json:"last_used_at"`
+	Expires_At   time.Time `json:"expires_at"`
+	// Whether it's the session the request was made with
+	Current bool `json:"current"`
+}
+
+func deviceFromRequest(r *http.Request) device {
+	userAgent := r.UserAgent()
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	return device{User_Agent: userAgent, IP: ip}
+}
+
+// Validates the JWT in the Authorization header and returns the user and the
+// session it belongs to. JWTs from before sessions existed have none.
+func (apicfg *apiConfig) sessionFromRequest(r *http.Request) (int, string, error) {
+	userID, err := apicfg.userIDFromRequest(r)
+
+	if err != nil {
+		return -1, "", err
+	}
+
+	claims, err := apicfg.parseJWT(r.Header.Get("Authorization"))
+
+	if err != nil {
+		return -1, "", errors.New("error validating token")
+	}
+
+	return userID, claims.Session_ID, nil
+}
+
+// Whether the session hasn't been logged out or expired
+func (apicfg *apiConfig) sessionLive(sessionID string) (bool, error) {
+	current, err := apicfg.db.getSession(sessionID)
+
+	if errors.Is(err, errTokenNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return time.Now().Before(current.Expiry_Time), nil
+}
+
+// The user's live sessions, most recently used first
+func (apicfg *apiConfig) listSessions(userID int, currentID string) ([]session, error) {
+	tokens, err := apicfg.db.getUserSessions(userID)
+
+	if err != nil {
+		return []session{}, err
+	}
+
+	sessions := []session{}
+
+	for _, val := range tokens {
+		if !time.Now().Before(val.Expiry_Time) {
+			continue
+		}
+
+		sessions = append(sessions, session{
+			ID:           val.Family_ID,
+			User_Agent:   val.User_Agent,
+			IP:           val.IP,
+			Created_At:   val.Created_At,
+			Last_Used_At: val.Last_Used_At,
+			Expires_At:   val.Expiry_Time,
+			Current:      val.Family_ID == currentID,
+		})
+	}
+
+	return sessions, nil
+}
+
+// Logs out one of the user's sessions, its refresh token and JWTs stop working straight away
+func (apicfg *apiConfig) revokeSession(userID int, sessionID string) error {
+	current, err := apicfg.db.getSession(sessionID)
+
+	// Someone else's session is as good as missing
+	if errors.Is(err, errTokenNotFound) || (err == nil && current.ID != userID) {
+		return errSessionNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return apicfg.db.revokeRefrFamily(sessionID)
+}
+
+// Logs out every session of the user's but the current one. With no current
+// session, from a JWT older than sessions, that's all of them.
+func (apicfg *apiConfig) revokeOtherSessions(userID int, currentID string) error {
+	tokens, err := apicfg.db.getUserSessions(userID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, val := range tokens {
+		if val.Family_ID == currentID {
+			continue
+		}
+
+		if err := apicfg.db.revokeRefrFamily(val.Family_ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// An apiConfig over db with the defaults main uses, minus anything that needs env variables
+func newTestAPI(t *testing.T, db Store) *apiConfig {
+	t.Helper()
+
+	search, err := buildSearchIndex(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashtags, err := buildHashtagIndex(db)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timelines, err := buildTimelineCache(db, defaultTimelineSize, defaultTimelineFanoutLimit)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moderation, err := newModerator(filepath.Join(t.TempDir(), "moderation.json"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mediaStore, err := newBlobStore(t.TempDir())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &apiConfig{
+		jwtSecret:      "test",
+		jwtKeys:        &keyRing{byID: map[string]*jwtKey{}},
+		db:             db,
+		search:         search,
+		hashtags:       hashtags,
+		restoreWindow:  defaultRestoreWindow,
+		timelines:      timelines,
+		moderation:     moderation,
+		chirpLimits:    chirpLimits{Standard: defaultChirpLength, Red: defaultRedChirpLength},
+		media:          mediaStore,
+		mediaMaxSize:   defaultMediaMaxSize,
+		trendingWindow: defaultTrendingWindow,
+		refreshTTL:     defaultRefreshTTL,
+	}
+}
+
+// Sends a request to the API and decodes the JSON response into out, if given
+func doRequest(t *testing.T, handler http.Handler, method, path, token string, body any, out any) int {
+	t.Helper()
+
+	data := []byte{}
+
+	if body != nil {
+		var err error
+
+		if data, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if out != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+			t.Fatalf("%s %s: decoding %q: %v", method, path, rec.Body.String(), err)
+		}
+	}
+
+	return rec.Code
+}
+
+// Creates a user with the password "password" and logs them in
+func signup(t *testing.T, handler http.Handler, email string) jwtResponse {
+	t.Helper()
+
+	creds := map[string]string{"email": email, "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+		t.Fatalf("creating %s: %d", email, code)
+	}
+
+	return login(t, handler, email)
+}
+
+func login(t *testing.T, handler http.Handler, email string) jwtResponse {
+	t.Helper()
+
+	creds := map[string]string{"email": email, "password": "password"}
+	resp := jwtResponse{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/login", "", creds, &resp); code != http.StatusOK {
+		t.Fatalf("logging in as %s: %d", email, code)
+	}
+
+	return resp
+}
+
+// Every route that needs a JWT, with a body it would accept. Chirp 1 and user 2 are
+// expected to exist.
+var authenticatedRoutes = []struct {
+	method string
+	path   string
+	body   any
+}{
+	{http.MethodPost, "/api/chirps", map[string]string{"body": "still here"}},
+	{http.MethodPut, "/api/chirps/1", map[string]string{"body": "edited"}},
+	{http.MethodPatch, "/api/chirps/1", map[string]string{"body": "edited"}},
+	{http.MethodDelete, "/api/chirps/1", nil},
+	{http.MethodPost, "/api/chirps/1/restore", nil},
+	{http.MethodPost, "/api/chirps/1/like", nil},
+	{http.MethodDelete, "/api/chirps/1/like", nil},
+	{http.MethodPost, "/api/chirps/1/rechirp", nil},
+	{http.MethodDelete, "/api/chirps/1/rechirp", nil},
+	{http.MethodPost, "/api/chirps/1/report", map[string]string{"reason": "spam"}},
+	{http.MethodGet, "/api/chirps/trash", nil},
+	{http.MethodGet, "/api/likes", nil},
+	{http.MethodGet, "/api/timeline", nil},
+	{http.MethodPut, "/api/users", map[string]string{"email": "thief@example.com", "password": "stolen"}},
+	{http.MethodPost, "/api/users/2/follow", nil},
+	{http.MethodDelete, "/api/users/2/follow", nil},
+	{http.MethodPost, "/api/media", nil},
+	{http.MethodGet, "/api/sessions", nil},
+	{http.MethodDelete, "/api/sessions", nil},
+	{http.MethodDelete, "/api/sessions/other", nil},
+	{http.MethodGet, "/api/metrics", nil},
+	{http.MethodGet, "/admin/metrics", nil},
+	{http.MethodPost, "/api/reset", nil},
+	{http.MethodGet, "/admin/moderation/queue", nil},
+	{http.MethodPost, "/admin/moderation/chirps/1/approve", nil},
+	{http.MethodGet, "/admin/moderation/audit", nil},
+	{http.MethodPut, "/admin/users/2/role", map[string]string{"role": roleAdmin}},
+}
+
+func TestRevokedSessionIsRejectedEverywhere(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		creds := map[string]string{"email": email, "password": "password"}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d", email, code)
+		}
+	}
+
+	// An admin, so the admin routes fail for the session and not the role
+	if _, err := grantAdmin(apicfg.db, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	stolen := login(t, handler, "a@example.com")
+	kept := login(t, handler, "a@example.com")
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", stolen.Token, map[string]string{"body": "hello"}, nil); code != http.StatusCreated {
+		t.Fatalf("chirping before the session is revoked: %d", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodDelete, "/api/sessions", kept.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("logging out everywhere else: %d", code)
+	}
+
+	for _, route := range authenticatedRoutes {
+		if code := doRequest(t, handler, route.method, route.path, stolen.Token, route.body, nil); code != http.StatusUnauthorized {
+			t.Errorf("%s %s with a revoked session: got %d, want 401", route.method, route.path, code)
+		}
+	}
+
+	usr, err := apicfg.db.getUsrByID(1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usr.Email != "a@example.com" {
+		t.Errorf("revoked session changed the email to %s", usr.Email)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/sessions", kept.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("the session that logged the others out: got %d, want 200", code)
+	}
+}
+
+func TestBannedUserIsForbiddenEverywhere(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	banned := signup(t, handler, "a@example.com")
+	signup(t, handler, "b@example.com")
+
+	// An admin, so the admin routes fail for the ban and not the role
+	if _, err := grantAdmin(apicfg.db, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", banned.Token, map[string]string{"body": "hello"}, nil); code != http.StatusCreated {
+		t.Fatalf("chirping before the ban: %d", code)
+	}
+
+	_, err := apicfg.db.updateUser(1, func(usr *user) error {
+		usr.Is_Banned = true
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A banned user still has a valid token, logging in again wouldn't help
+	for _, route := range authenticatedRoutes {
+		resp := errResponse{}
+
+		if code := doRequest(t, handler, route.method, route.path, banned.Token, route.body, &resp); code != http.StatusForbidden || resp.Error != errUserBanned.Error() {
+			t.Errorf("%s %s while banned: got %d %+v, want 403 %q", route.method, route.path, code, resp, errUserBanned)
+		}
+	}
+
+	creds := map[string]string{"email": "a@example.com", "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/login", "", creds, nil); code != http.StatusForbidden {
+		t.Errorf("logging in while banned: got %d, want 403", code)
+	}
+
+	if code, _ := refresh(t, handler, banned.Refresh_Token); code != http.StatusForbidden {
+		t.Errorf("refreshing while banned: got %d, want 403", code)
+	}
+}
+
+func TestSessionLookupFollowsRotation(t *testing.T) {
+	db := newMemDB()
+	now := time.Now().UTC()
+
+	first := DB_Refr_Token{ID: 1, Expiry_Time: now.Add(time.Hour), Token_Hash: "first", Family_ID: "family", Created_At: now, Last_Used_At: now}
+
+	if err := db.appendDBRefrToken(first); err != nil {
+		t.Fatal(err)
+	}
+
+	second := first
+	second.Token_Hash = "second"
+
+	if err := db.rotateRefrToken(first.Token_Hash, second); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := db.getSession("family")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current.Token_Hash != "second" {
+		t.Errorf("session is on token %s, want second", current.Token_Hash)
+	}
+
+	if err := db.revokeRefrFamily("family"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.getSession("family"); err != errTokenNotFound {
+		t.Errorf("revoked session: got %v, want errTokenNotFound", err)
+	}
+}
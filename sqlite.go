@@ -0,0 +1,1385 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func init() {
+	// Lets migrations hash the refresh tokens already stored, SQLite has no SHA-256 of its own
+	sql.Register("sqlite3_chirpy", &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("sha256_hex", hashRefreshToken, true)
+		},
+	})
+}
+
+// Each entry is one schema version, applied in order and never edited once
+// released. New schema changes are appended to the end.
+var sqliteMigrations = []string{
+	// 1: initial schema
+	`CREATE TABLE users (
+		id            INTEGER PRIMARY KEY,
+		email         TEXT    NOT NULL UNIQUE,
+		password      BLOB    NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE chirps (
+		id        INTEGER PRIMARY KEY,
+		author_id INTEGER NOT NULL,
+		body      TEXT    NOT NULL
+	);
+	CREATE INDEX chirps_author_id ON chirps (author_id);
+	CREATE TABLE refresh_tokens (
+		refresh_token TEXT     PRIMARY KEY,
+		user_id       INTEGER  NOT NULL,
+		expiry_time   DATETIME NOT NULL
+	);`,
+	// 2: never reuse IDs of deleted rows, and give chirps and users an opaque ID
+	`CREATE TABLE users_new (
+		id            INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid          TEXT    NOT NULL UNIQUE,
+		email         TEXT    NOT NULL UNIQUE,
+		password      BLOB    NOT NULL,
+		is_chirpy_red INTEGER NOT NULL DEFAULT 0
+	);
+	INSERT INTO users_new (id, uuid, email, password, is_chirpy_red)
+		SELECT id, ` + sqliteRandomUUID + `, email, password, is_chirpy_red FROM users;
+	DROP TABLE users;
+	ALTER TABLE users_new RENAME TO users;
+	CREATE TABLE chirps_new (
+		id        INTEGER PRIMARY KEY AUTOINCREMENT,
+		uuid      TEXT    NOT NULL UNIQUE,
+		author_id INTEGER NOT NULL,
+		body      TEXT    NOT NULL
+	);
+	INSERT INTO chirps_new (id, uuid, author_id, body)
+		SELECT id, ` + sqliteRandomUUID + `, author_id, body FROM chirps;
+	DROP TABLE chirps;
+	ALTER TABLE chirps_new RENAME TO chirps;
+	CREATE INDEX chirps_author_id ON chirps (author_id);`,
+	// 3: timestamps, rows from before this are stamped with the time of the migration
+	`ALTER TABLE chirps ADD COLUMN created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE chirps ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	UPDATE chirps SET created_at = ` + sqliteNow + `, updated_at = ` + sqliteNow + `;
+	CREATE INDEX chirps_created_at ON chirps (created_at, id);
+	ALTER TABLE users ADD COLUMN created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE users ADD COLUMN updated_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	UPDATE users SET created_at = ` + sqliteNow + `, updated_at = ` + sqliteNow + `;`,
+	// 4: chirp editing
+	`ALTER TABLE chirps ADD COLUMN edited INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE chirp_revisions (
+		chirp_id   INTEGER  NOT NULL,
+		revision   INTEGER  NOT NULL,
+		body       TEXT     NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (chirp_id, revision)
+	);`,
+	// 5: soft delete
+	`ALTER TABLE chirps ADD COLUMN deleted_at DATETIME;
+	CREATE INDEX chirps_deleted_at ON chirps (deleted_at);`,
+	// 6: replies
+	`ALTER TABLE chirps ADD COLUMN in_reply_to INTEGER;
+	CREATE INDEX chirps_in_reply_to ON chirps (in_reply_to, created_at, id);`,
+	// 7: follow graph
+	`CREATE TABLE follows (
+		follower_id INTEGER  NOT NULL,
+		followee_id INTEGER  NOT NULL,
+		created_at  DATETIME NOT NULL,
+		PRIMARY KEY (follower_id, followee_id)
+	);
+	CREATE INDEX follows_followee_id ON follows (followee_id);
+	CREATE INDEX chirps_author_created_at ON chirps (author_id, created_at, id);`,
+	// 8: likes and re-chirps
+	`CREATE TABLE reactions (
+		kind       TEXT     NOT NULL,
+		user_id    INTEGER  NOT NULL,
+		chirp_id   INTEGER  NOT NULL,
+		created_at DATETIME NOT NULL,
+		PRIMARY KEY (chirp_id, kind, user_id)
+	);
+	CREATE INDEX reactions_user_id ON reactions (user_id, kind, created_at);`,
+	// 9: chirps held for review by moderation
+	`ALTER TABLE chirps ADD COLUMN flagged INTEGER NOT NULL DEFAULT 0;`,
+	// 10: moderation queue
+	`ALTER TABLE users ADD COLUMN is_banned INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE reports (
+		chirp_id    INTEGER  NOT NULL,
+		reporter_id INTEGER  NOT NULL,
+		reason      TEXT     NOT NULL,
+		created_at  DATETIME NOT NULL,
+		resolved_at DATETIME,
+		PRIMARY KEY (chirp_id, reporter_id)
+	);
+	CREATE INDEX reports_resolved_at ON reports (resolved_at, created_at);
+	CREATE TABLE audit_log (
+		id           INTEGER  PRIMARY KEY AUTOINCREMENT,
+		moderator_id INTEGER  NOT NULL,
+		action       TEXT     NOT NULL,
+		chirp_id     INTEGER  NOT NULL,
+		author_id    INTEGER  NOT NULL,
+		body         TEXT     NOT NULL,
+		note         TEXT     NOT NULL,
+		created_at   DATETIME NOT NULL
+	);`,
+	// 11: roles
+	`ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';`,
+	// 12: media attachments, chirps keep their media IDs comma separated
+	`ALTER TABLE chirps ADD COLUMN media TEXT NOT NULL DEFAULT '';
+	CREATE TABLE media (
+		id           TEXT     PRIMARY KEY,
+		uploader_id  INTEGER  NOT NULL,
+		content_type TEXT     NOT NULL,
+		size         INTEGER  NOT NULL,
+		width        INTEGER  NOT NULL,
+		height       INTEGER  NOT NULL,
+		created_at   DATETIME NOT NULL
+	);`,
+	// 13: mentions, hashtags and links as JSON, NULL until backfillEntities has parsed the body
+	`ALTER TABLE chirps ADD COLUMN entities TEXT;`,
+	// 14: refresh token rotation, existing tokens each start their own family
+	`ALTER TABLE refresh_tokens ADD COLUMN family_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN rotated_at DATETIME;
+	UPDATE refresh_tokens SET family_id = lower(hex(randomblob(16)));
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);`,
+	// 15: refresh tokens are only kept as their SHA-256
+	`CREATE TABLE refresh_tokens_new (
+		token_hash  TEXT     PRIMARY KEY,
+		user_id     INTEGER  NOT NULL,
+		expiry_time DATETIME NOT NULL,
+		family_id   TEXT     NOT NULL,
+		rotated_at  DATETIME
+	);
+	INSERT INTO refresh_tokens_new (token_hash, user_id, expiry_time, family_id, rotated_at)
+		SELECT sha256_hex(refresh_token), user_id, expiry_time, family_id, rotated_at FROM refresh_tokens;
+	DROP TABLE refresh_tokens;
+	ALTER TABLE refresh_tokens_new RENAME TO refresh_tokens;
+	CREATE INDEX refresh_tokens_family_id ON refresh_tokens (family_id);`,
+	// 16: sessions, existing ones are stamped with the time of the migration
+	`ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+	ALTER TABLE refresh_tokens ADD COLUMN created_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	ALTER TABLE refresh_tokens ADD COLUMN last_used_at DATETIME NOT NULL DEFAULT '0001-01-01 00:00:00+00:00';
+	UPDATE refresh_tokens SET created_at = ` + sqliteNow + `, last_used_at = ` + sqliteNow + `;
+	CREATE INDEX refresh_tokens_user_id ON refresh_tokens (user_id);`,
+	// 17: handles for mentions, existing users have none until they pick one
+	`ALTER TABLE users ADD COLUMN handle TEXT NOT NULL DEFAULT '';
+	CREATE UNIQUE INDEX users_handle ON users (handle) WHERE handle != '';`,
+}
+
+// The current time in the same format the driver writes time.Time values in.
+// Whole seconds only, as the driver drops trailing zeros from fractions and the
+// strings have to match exactly for created_at comparisons to work.
+const sqliteNow = `strftime('%Y-%m-%d %H:%M:%S+00:00', 'now')`
+
+// Builds a random version 4 UUID in SQL, for backfilling existing rows
+const sqliteRandomUUID = `lower(hex(randomblob(4)) || '-' || hex(randomblob(2)) || '-4' || substr(hex(randomblob(2)), 2) || '-' ||
+	substr('89ab', 1 + (abs(random()) % 4), 1) || substr(hex(randomblob(2)), 2) || '-' || hex(randomblob(6)))`
+
+const chirpColumns = `id, uuid, author_id, body, created_at, updated_at, edited, deleted_at, in_reply_to, flagged, media, entities,
+	(SELECT uuid FROM users WHERE users.id = chirps.author_id),
+	(SELECT uuid FROM chirps AS parents WHERE parents.id = chirps.in_reply_to),
+	(SELECT COUNT(*) FROM chirps AS replies WHERE replies.in_reply_to = chirps.id AND replies.deleted_at IS NULL),
+	(SELECT COUNT(*) FROM reactions WHERE reactions.chirp_id = chirps.id AND reactions.kind = 'like'),
+	(SELECT COUNT(*) FROM reactions WHERE reactions.chirp_id = chirps.id AND reactions.kind = 'rechirp')`
+
+const userColumns = `id, uuid, email, password, is_chirpy_red, created_at, updated_at, is_banned, role, handle`
+
+const refrTokenColumns = `user_id, expiry_time, token_hash, family_id, rotated_at, user_agent, ip, created_at, last_used_at`
+
+// Entities are stored as JSON, always as an array so they're told apart from rows not yet backfilled
+func encodeEntities(entities []entity) string {
+	if entities == nil {
+		entities = []entity{}
+	}
+
+	data, _ := json.Marshal(entities)
+
+	return string(data)
+}
+
+// Chirps that aren't replies have a NULL parent rather than 0
+func nullableChirpID(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// Either *sql.Row or *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanChirp(row rowScanner) (chirp, error) {
+	val := chirp{}
+	deletedAt := sql.NullTime{}
+	inReplyTo := sql.NullInt64{}
+	mediaIDs := ""
+	entities := sql.NullString{}
+	authorUUID := sql.NullString{}
+	inReplyToUUID := sql.NullString{}
+
+	err := row.Scan(&val.ID, &val.UUID, &val.Author_ID, &val.Chirp, &val.Created_At, &val.Updated_At, &val.Edited, &deletedAt, &inReplyTo, &val.Flagged, &mediaIDs, &entities,
+		&authorUUID, &inReplyToUUID, &val.Reply_Count, &val.Like_Count, &val.Rechirp_Count)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return chirp{}, errChirpNotFound
+	}
+
+	if deletedAt.Valid {
+		val.Deleted_At = &deletedAt.Time
+	}
+
+	val.In_Reply_To = int(inReplyTo.Int64)
+	val.Author_UUID = authorUUID.String
+	val.In_Reply_To_UUID = inReplyToUUID.String
+
+	if mediaIDs != "" {
+		val.Media_IDs = strings.Split(mediaIDs, ",")
+	}
+
+	if err == nil && entities.Valid {
+		err = json.Unmarshal([]byte(entities.String), &val.Entities)
+	}
+
+	return val, err
+}
+
+func scanUser(row rowScanner) (user, error) {
+	usr := user{}
+
+	err := row.Scan(&usr.ID, &usr.UUID, &usr.Email, &usr.Password, &usr.Is_Chirpy_Red, &usr.Created_At, &usr.Updated_At, &usr.Is_Banned, &usr.Role, &usr.Handle)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return user{}, errUserNotFound
+	}
+
+	return usr, err
+}
+
+func scanRefrToken(row rowScanner) (DB_Refr_Token, error) {
+	val := DB_Refr_Token{}
+	rotatedAt := sql.NullTime{}
+
+	err := row.Scan(&val.ID, &val.Expiry_Time, &val.Token_Hash, &val.Family_ID, &rotatedAt, &val.User_Agent, &val.IP, &val.Created_At, &val.Last_Used_At)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return DB_Refr_Token{}, errTokenNotFound
+	}
+
+	if rotatedAt.Valid {
+		val.Rotated_At = &rotatedAt.Time
+	}
+
+	return val, err
+}
+
+// sqliteDB is the Store backed by an embedded SQLite database
+type sqliteDB struct {
+	db *sql.DB
+}
+
+func newSQLiteDB(path string) (*sqliteDB, error) {
+	// Secure delete zeroes what's removed, so revoked tokens and the plaintext ones
+	// hashed by migration 15 don't linger in free pages of the file. Transactions
+	// take the write lock up front, one that reads before it writes would otherwise
+	// fail with SQLITE_BUSY instead of waiting when another writes in between.
+	db, err := sql.Open("sqlite3_chirpy", path+"?_foreign_keys=on&_busy_timeout=5000&_secure_delete=on&_txlock=immediate")
+
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, so don't let database/sql fight over it
+	db.SetMaxOpenConns(1)
+
+	sqlite := &sqliteDB{db: db}
+
+	err = sqlite.migrate()
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	err = sqlite.backfillEntities()
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return sqlite, nil
+}
+
+// Brings the schema up to the latest version, each migration in its own transaction
+func (s *sqliteDB) migrate() error {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER  PRIMARY KEY,
+		applied_at DATETIME NOT NULL
+	)`)
+
+	if err != nil {
+		return err
+	}
+
+	var current int
+
+	err = s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+
+	if err != nil {
+		return err
+	}
+
+	if current > len(sqliteMigrations) {
+		return errors.New("database schema is newer than this build of chirpy")
+	}
+
+	for version := current + 1; version <= len(sqliteMigrations); version++ {
+		tx, err := s.db.Begin()
+
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(sqliteMigrations[version-1]); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UTC()); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Parses the entities of chirps written before they were stored
+func (s *sqliteDB) backfillEntities() error {
+	rows, err := s.db.Query(`SELECT id, body FROM chirps WHERE entities IS NULL`)
+
+	if err != nil {
+		return err
+	}
+
+	bodies := map[int]string{}
+
+	for rows.Next() {
+		var id int
+		var body string
+
+		if err := rows.Scan(&id, &body); err != nil {
+			rows.Close()
+			return err
+		}
+
+		bodies[id] = body
+	}
+
+	// Only one connection, so the rows have to be closed before looking up mentions
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, body := range bodies {
+		entities := resolveMentions(parseEntities(body), s.getByHandle)
+
+		if _, err := s.db.Exec(`UPDATE chirps SET entities = ? WHERE id = ?`, encodeEntities(entities), id); err != nil {
+			return err
+		}
+	}
+
+	return s.backfillMentionUUIDs()
+}
+
+// Fills in the UUIDs of users mentioned in chirps written before mentions carried one
+func (s *sqliteDB) backfillMentionUUIDs() error {
+	rows, err := s.db.Query(`SELECT id, entities FROM chirps WHERE entities LIKE '%"user_id":%' AND entities NOT LIKE '%"user_uuid":%'`)
+
+	if err != nil {
+		return err
+	}
+
+	stored := map[int][]entity{}
+
+	for rows.Next() {
+		var id int
+		var data string
+
+		if err := rows.Scan(&id, &data); err != nil {
+			rows.Close()
+			return err
+		}
+
+		entities := []entity{}
+
+		if err := json.Unmarshal([]byte(data), &entities); err != nil {
+			rows.Close()
+			return err
+		}
+
+		stored[id] = entities
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	lookup := func(id int) (user, bool) {
+		usr, err := s.getUsrByID(id)
+		return usr, err == nil
+	}
+
+	for id, entities := range stored {
+		if !fillMentionUUIDs(entities, lookup) {
+			continue
+		}
+
+		if _, err := s.db.Exec(`UPDATE chirps SET entities = ? WHERE id = ?`, encodeEntities(entities), id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqliteDB) getAllChirps() ([]chirp, error) {
+	rows, err := s.db.Query(`SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL AND flagged = 0 ORDER BY id`)
+
+	if err != nil {
+		return []chirp{}, err
+	}
+
+	defer rows.Close()
+
+	chirpArr := []chirp{}
+
+	for rows.Next() {
+		val, err := scanChirp(rows)
+
+		if err != nil {
+			return []chirp{}, err
+		}
+
+		chirpArr = append(chirpArr, val)
+	}
+
+	return chirpArr, rows.Err()
+}
+
+func (s *sqliteDB) listChirps(query chirpQuery) ([]chirp, error) {
+	stmt := `SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NULL AND flagged = ?`
+	args := []any{query.Held}
+
+	if query.Trashed {
+		stmt = `SELECT ` + chirpColumns + ` FROM chirps WHERE deleted_at IS NOT NULL`
+		args = []any{}
+	}
+
+	if query.Author_ID != 0 {
+		stmt += ` AND author_id = ?`
+		args = append(args, query.Author_ID)
+	}
+
+	if query.Author_IDs != nil {
+		placeholders := make([]string, len(query.Author_IDs))
+
+		for i, id := range query.Author_IDs {
+			placeholders[i] = "?"
+			args = append(args, id)
+		}
+
+		stmt += ` AND author_id IN (` + strings.Join(placeholders, ", ") + `)`
+	}
+
+	order := `ASC`
+
+	if query.Desc {
+		order = `DESC`
+	}
+
+	cmp := `>`
+
+	if query.Desc {
+		cmp = `<`
+	}
+
+	if query.After != nil && query.Sort_By == sortByCreatedAt {
+		after := query.After.Created_At.UTC()
+		stmt += ` AND (created_at ` + cmp + ` ? OR (created_at = ? AND id ` + cmp + ` ?))`
+		args = append(args, after, after, query.After.ID)
+	} else if query.After != nil {
+		stmt += ` AND id ` + cmp + ` ?`
+		args = append(args, query.After.ID)
+	}
+
+	if query.Sort_By == sortByCreatedAt {
+		stmt += ` ORDER BY created_at ` + order + `, id ` + order
+	} else {
+		stmt += ` ORDER BY id ` + order
+	}
+
+	if query.Limit > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, query.Limit)
+	}
+
+	rows, err := s.db.Query(stmt, args...)
+
+	if err != nil {
+		return []chirp{}, err
+	}
+
+	defer rows.Close()
+
+	chirpArr := []chirp{}
+
+	for rows.Next() {
+		val, err := scanChirp(rows)
+
+		if err != nil {
+			return []chirp{}, err
+		}
+
+		chirpArr = append(chirpArr, val)
+	}
+
+	return chirpArr, rows.Err()
+}
+
+func (s *sqliteDB) getChirp(id int) (chirp, error) {
+	return scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+}
+
+func (s *sqliteDB) getChirpByUUID(chirpUUID string) (chirp, error) {
+	return scanChirp(s.db.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE uuid = ?`, chirpUUID))
+}
+
+func (s *sqliteDB) insertChirp(newChirp chirp) (chirp, error) {
+	res, err := s.db.Exec(`INSERT INTO chirps (uuid, author_id, body, created_at, updated_at, in_reply_to, flagged, media, entities) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		newChirp.UUID, newChirp.Author_ID, newChirp.Chirp, newChirp.Created_At.UTC(), newChirp.Updated_At.UTC(), nullableChirpID(newChirp.In_Reply_To), newChirp.Flagged,
+		strings.Join(newChirp.Media_IDs, ","), encodeEntities(newChirp.Entities))
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	// Read back for the author and parent UUIDs
+	return s.getChirp(int(id))
+}
+
+func (s *sqliteDB) deleteChirp(id int) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM chirps WHERE id = ?`, id)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errChirpNotFound
+	}
+
+	if _, err := tx.Exec(`DELETE FROM chirp_revisions WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM reactions WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM reports WHERE chirp_id = ?`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteDB) setChirpDeleted(id int, deletedAt *time.Time) (chirp, error) {
+	var value any
+
+	if deletedAt != nil {
+		value = deletedAt.UTC()
+	}
+
+	res, err := s.db.Exec(`UPDATE chirps SET deleted_at = ? WHERE id = ?`, value, id)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return chirp{}, errChirpNotFound
+	}
+
+	return s.getChirp(id)
+}
+
+func (s *sqliteDB) setChirpFlagged(id int, flagged bool) (chirp, error) {
+	res, err := s.db.Exec(`UPDATE chirps SET flagged = ? WHERE id = ?`, flagged, id)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return chirp{}, errChirpNotFound
+	}
+
+	return s.getChirp(id)
+}
+
+func (s *sqliteDB) purgeDeletedChirps(before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM chirp_revisions WHERE chirp_id IN (SELECT id FROM chirps WHERE deleted_at < ?)`, before.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM reactions WHERE chirp_id IN (SELECT id FROM chirps WHERE deleted_at < ?)`, before.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM reports WHERE chirp_id IN (SELECT id FROM chirps WHERE deleted_at < ?)`, before.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := tx.Exec(`DELETE FROM chirps WHERE deleted_at < ?`, before.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	purged, _ := res.RowsAffected()
+
+	return int(purged), tx.Commit()
+}
+
+func (s *sqliteDB) updateChirpBody(id int, body string, entities []entity, flag bool, editedAt time.Time) (chirp, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	defer tx.Rollback()
+
+	val, err := scanChirp(tx.QueryRow(`SELECT `+chirpColumns+` FROM chirps WHERE id = ?`, id))
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at)
+		SELECT ?, COUNT(*) + 1, ?, ? FROM chirp_revisions WHERE chirp_id = ?`,
+		id, val.Chirp, val.Updated_At.UTC(), id)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	val.Chirp = body
+	val.Entities = entities
+	val.Edited = true
+	val.Flagged = val.Flagged || flag
+	val.Updated_At = editedAt
+
+	_, err = tx.Exec(`UPDATE chirps SET body = ?, entities = ?, edited = 1, flagged = ?, updated_at = ? WHERE id = ?`, body, encodeEntities(entities), val.Flagged, editedAt.UTC(), id)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	return val, tx.Commit()
+}
+
+func (s *sqliteDB) getChirpRevisions(id int) ([]chirpRevision, error) {
+	if _, err := s.getChirp(id); err != nil {
+		return []chirpRevision{}, err
+	}
+
+	rows, err := s.db.Query(`SELECT chirp_id, revision, body, created_at FROM chirp_revisions WHERE chirp_id = ? ORDER BY revision`, id)
+
+	if err != nil {
+		return []chirpRevision{}, err
+	}
+
+	defer rows.Close()
+
+	revisions := []chirpRevision{}
+
+	for rows.Next() {
+		val := chirpRevision{}
+
+		if err := rows.Scan(&val.Chirp_ID, &val.Revision, &val.Chirp, &val.Created_At); err != nil {
+			return []chirpRevision{}, err
+		}
+
+		revisions = append(revisions, val)
+	}
+
+	return revisions, rows.Err()
+}
+
+func (s *sqliteDB) getReplies(id int) ([]chirp, error) {
+	if _, err := s.getChirp(id); err != nil {
+		return []chirp{}, err
+	}
+
+	rows, err := s.db.Query(`SELECT `+chirpColumns+` FROM chirps WHERE in_reply_to = ? ORDER BY created_at, id`, id)
+
+	if err != nil {
+		return []chirp{}, err
+	}
+
+	defer rows.Close()
+
+	replies := []chirp{}
+
+	for rows.Next() {
+		val, err := scanChirp(rows)
+
+		if err != nil {
+			return []chirp{}, err
+		}
+
+		replies = append(replies, val)
+	}
+
+	return replies, rows.Err()
+}
+
+func (s *sqliteDB) getUsrByID(id int) (user, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+}
+
+func (s *sqliteDB) getUsrByUUID(userUUID string) (user, error) {
+	return scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE uuid = ?`, userUUID))
+}
+
+func (s *sqliteDB) getByHandle(handle string) (user, bool) {
+	if handle == "" {
+		return user{}, false
+	}
+
+	usr, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE handle = ?`, handle))
+
+	if err != nil {
+		return user{}, false
+	}
+
+	return usr, true
+}
+
+func (s *sqliteDB) getByEmail(email string) (user, bool) {
+	usr, err := scanUser(s.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE email = ?`, email))
+
+	if err != nil {
+		return user{}, false
+	}
+
+	return usr, true
+}
+
+// Turns a broken unique constraint on users into the error for whichever column it was
+func userConstraintError(err error) error {
+	var sqliteErr sqlite3.Error
+
+	if !errors.As(err, &sqliteErr) || sqliteErr.ExtendedCode != sqlite3.ErrConstraintUnique {
+		return err
+	}
+
+	if strings.Contains(sqliteErr.Error(), "users.handle") {
+		return errHandleExists
+	}
+
+	return errEmailExists
+}
+
+func (s *sqliteDB) insertUser(newUser user) (user, error) {
+	res, err := s.db.Exec(`INSERT INTO users (uuid, email, password, is_chirpy_red, created_at, updated_at, role, handle) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		newUser.UUID, newUser.Email, newUser.Password, newUser.Is_Chirpy_Red, newUser.Created_At.UTC(), newUser.Updated_At.UTC(), newUser.Role, newUser.Handle)
+
+	if err != nil {
+		return user{}, userConstraintError(err)
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return user{}, err
+	}
+
+	newUser.ID = int(id)
+
+	return newUser, nil
+}
+
+func (s *sqliteDB) updateUser(id int, fn func(*user) error) (user, error) {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return user{}, err
+	}
+
+	defer tx.Rollback()
+
+	usr, err := scanUser(tx.QueryRow(`SELECT `+userColumns+` FROM users WHERE id = ?`, id))
+
+	if err != nil {
+		return user{}, err
+	}
+
+	if err := fn(&usr); err != nil {
+		return user{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email = ?, password = ?, is_chirpy_red = ?, updated_at = ?, is_banned = ?, role = ?, handle = ? WHERE id = ?`,
+		usr.Email, usr.Password, usr.Is_Chirpy_Red, usr.Updated_At.UTC(), usr.Is_Banned, usr.Role, usr.Handle, id)
+
+	if err != nil {
+		return user{}, userConstraintError(err)
+	}
+
+	return usr, tx.Commit()
+}
+
+func (s *sqliteDB) addFollow(followerID, followeeID int, followedAt time.Time) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`,
+		followerID, followeeID, followedAt.UTC())
+
+	return err
+}
+
+func (s *sqliteDB) removeFollow(followerID, followeeID int) error {
+	_, err := s.db.Exec(`DELETE FROM follows WHERE follower_id = ? AND followee_id = ?`, followerID, followeeID)
+
+	return err
+}
+
+func (s *sqliteDB) getFollowers(userID int) ([]follow, error) {
+	return s.queryFollows(`SELECT follower_id, followee_id, created_at FROM follows WHERE followee_id = ?
+		ORDER BY created_at DESC, follower_id DESC`, userID)
+}
+
+func (s *sqliteDB) getFollowing(userID int) ([]follow, error) {
+	return s.queryFollows(`SELECT follower_id, followee_id, created_at FROM follows WHERE follower_id = ?
+		ORDER BY created_at DESC, followee_id DESC`, userID)
+}
+
+func (s *sqliteDB) getAllFollows() ([]follow, error) {
+	return s.queryFollows(`SELECT follower_id, followee_id, created_at FROM follows
+		ORDER BY created_at DESC, follower_id DESC, followee_id DESC`)
+}
+
+func (s *sqliteDB) queryFollows(stmt string, args ...any) ([]follow, error) {
+	rows, err := s.db.Query(stmt, args...)
+
+	if err != nil {
+		return []follow{}, err
+	}
+
+	defer rows.Close()
+
+	follows := []follow{}
+
+	for rows.Next() {
+		val := follow{}
+
+		if err := rows.Scan(&val.Follower_ID, &val.Followee_ID, &val.Created_At); err != nil {
+			return []follow{}, err
+		}
+
+		follows = append(follows, val)
+	}
+
+	return follows, rows.Err()
+}
+
+func (s *sqliteDB) addReaction(val reaction) error {
+	if _, err := s.getChirp(val.Chirp_ID); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO reactions (kind, user_id, chirp_id, created_at) VALUES (?, ?, ?, ?)`,
+		val.Kind, val.User_ID, val.Chirp_ID, val.Created_At.UTC())
+
+	return err
+}
+
+func (s *sqliteDB) removeReaction(kind string, userID, chirpID int) error {
+	if _, err := s.getChirp(chirpID); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`DELETE FROM reactions WHERE kind = ? AND user_id = ? AND chirp_id = ?`, kind, userID, chirpID)
+
+	return err
+}
+
+func (s *sqliteDB) getUserReactions(kind string, userID int) ([]reaction, error) {
+	rows, err := s.db.Query(`SELECT kind, user_id, chirp_id, created_at FROM reactions WHERE kind = ? AND user_id = ?
+		ORDER BY created_at DESC, chirp_id DESC`, kind, userID)
+
+	if err != nil {
+		return []reaction{}, err
+	}
+
+	defer rows.Close()
+
+	reactions := []reaction{}
+
+	for rows.Next() {
+		val := reaction{}
+
+		if err := rows.Scan(&val.Kind, &val.User_ID, &val.Chirp_ID, &val.Created_At); err != nil {
+			return []reaction{}, err
+		}
+
+		reactions = append(reactions, val)
+	}
+
+	return reactions, rows.Err()
+}
+
+func (s *sqliteDB) addReport(val report) error {
+	if _, err := s.getChirp(val.Chirp_ID); err != nil {
+		return err
+	}
+
+	_, err := s.db.Exec(`INSERT INTO reports (chirp_id, reporter_id, reason, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (chirp_id, reporter_id) DO UPDATE SET reason = excluded.reason, created_at = excluded.created_at, resolved_at = NULL`,
+		val.Chirp_ID, val.Reporter_ID, val.Reason, val.Created_At.UTC())
+
+	return err
+}
+
+func (s *sqliteDB) getOpenReports() ([]report, error) {
+	rows, err := s.db.Query(`SELECT chirp_id, reporter_id, reason, created_at FROM reports WHERE resolved_at IS NULL
+		ORDER BY created_at, chirp_id, reporter_id`)
+
+	if err != nil {
+		return []report{}, err
+	}
+
+	defer rows.Close()
+
+	reports := []report{}
+
+	for rows.Next() {
+		val := report{}
+
+		if err := rows.Scan(&val.Chirp_ID, &val.Reporter_ID, &val.Reason, &val.Created_At); err != nil {
+			return []report{}, err
+		}
+
+		reports = append(reports, val)
+	}
+
+	return reports, rows.Err()
+}
+
+func (s *sqliteDB) resolveReports(chirpID int, resolvedAt time.Time) error {
+	_, err := s.db.Exec(`UPDATE reports SET resolved_at = ? WHERE chirp_id = ? AND resolved_at IS NULL`, resolvedAt.UTC(), chirpID)
+
+	return err
+}
+
+func (s *sqliteDB) appendAuditEntry(entry auditEntry) (auditEntry, error) {
+	res, err := s.db.Exec(`INSERT INTO audit_log (moderator_id, action, chirp_id, author_id, body, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		entry.Moderator_ID, entry.Action, entry.Chirp_ID, entry.Author_ID, entry.Chirp, entry.Note, entry.Created_At.UTC())
+
+	if err != nil {
+		return auditEntry{}, err
+	}
+
+	id, err := res.LastInsertId()
+
+	if err != nil {
+		return auditEntry{}, err
+	}
+
+	entry.ID = int(id)
+
+	return entry, nil
+}
+
+func (s *sqliteDB) getAuditLog() ([]auditEntry, error) {
+	rows, err := s.db.Query(`SELECT id, moderator_id, action, chirp_id, author_id, body, note, created_at FROM audit_log ORDER BY id DESC`)
+
+	if err != nil {
+		return []auditEntry{}, err
+	}
+
+	defer rows.Close()
+
+	entries := []auditEntry{}
+
+	for rows.Next() {
+		val := auditEntry{}
+
+		if err := rows.Scan(&val.ID, &val.Moderator_ID, &val.Action, &val.Chirp_ID, &val.Author_ID, &val.Chirp, &val.Note, &val.Created_At); err != nil {
+			return []auditEntry{}, err
+		}
+
+		entries = append(entries, val)
+	}
+
+	return entries, rows.Err()
+}
+
+func (s *sqliteDB) addMedia(val media) error {
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO media (id, uploader_id, content_type, size, width, height, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		val.ID, val.Uploader_ID, val.Content_Type, val.Size, val.Width, val.Height, val.Created_At.UTC())
+
+	return err
+}
+
+func (s *sqliteDB) getMedia(id string) (media, error) {
+	val := media{}
+
+	err := s.db.QueryRow(`SELECT id, uploader_id, content_type, size, width, height, created_at FROM media WHERE id = ?`, id).
+		Scan(&val.ID, &val.Uploader_ID, &val.Content_Type, &val.Size, &val.Width, &val.Height, &val.Created_At)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return media{}, errMediaNotFound
+	}
+
+	return val, err
+}
+
+func (s *sqliteDB) getRefrByHash(tokenHash string) (DB_Refr_Token, error) {
+	return scanRefrToken(s.db.QueryRow(`SELECT `+refrTokenColumns+` FROM refresh_tokens WHERE token_hash = ?`, tokenHash))
+}
+
+func (s *sqliteDB) appendDBRefrToken(refrToken DB_Refr_Token) error {
+	_, err := s.db.Exec(`INSERT INTO refresh_tokens (token_hash, user_id, expiry_time, family_id, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		refrToken.Token_Hash, refrToken.ID, refrToken.Expiry_Time.UTC(), refrToken.Family_ID, refrToken.User_Agent, refrToken.IP, refrToken.Created_At.UTC(), refrToken.Last_Used_At.UTC())
+
+	return err
+}
+
+func (s *sqliteDB) rotateRefrToken(tokenHash string, next DB_Refr_Token) error {
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE refresh_tokens SET rotated_at = ? WHERE token_hash = ? AND rotated_at IS NULL`, time.Now().UTC(), tokenHash)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		exists := false
+
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM refresh_tokens WHERE token_hash = ?)`, tokenHash).Scan(&exists); err != nil {
+			return err
+		}
+
+		if exists {
+			return errTokenReused
+		}
+
+		return errTokenNotFound
+	}
+
+	// Rotated tokens live as long as the family does, so reuse is caught for as long as it matters
+	_, err = tx.Exec(`UPDATE refresh_tokens SET expiry_time = ? WHERE family_id = ?`, next.Expiry_Time.UTC(), next.Family_ID)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token_hash, user_id, expiry_time, family_id, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		next.Token_Hash, next.ID, next.Expiry_Time.UTC(), next.Family_ID, next.User_Agent, next.IP, next.Created_At.UTC(), next.Last_Used_At.UTC())
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteDB) getSession(familyID string) (DB_Refr_Token, error) {
+	return scanRefrToken(s.db.QueryRow(`SELECT `+refrTokenColumns+` FROM refresh_tokens WHERE family_id = ? AND rotated_at IS NULL`, familyID))
+}
+
+func (s *sqliteDB) getUserSessions(userID int) ([]DB_Refr_Token, error) {
+	rows, err := s.db.Query(`SELECT `+refrTokenColumns+` FROM refresh_tokens WHERE user_id = ? AND rotated_at IS NULL ORDER BY last_used_at DESC`, userID)
+
+	if err != nil {
+		return []DB_Refr_Token{}, err
+	}
+
+	defer rows.Close()
+
+	sessions := []DB_Refr_Token{}
+
+	for rows.Next() {
+		val, err := scanRefrToken(rows)
+
+		if err != nil {
+			return []DB_Refr_Token{}, err
+		}
+
+		sessions = append(sessions, val)
+	}
+
+	return sessions, rows.Err()
+}
+
+func (s *sqliteDB) purgeExpiredRefrTokens(before time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE expiry_time < ?`, before.UTC())
+
+	if err != nil {
+		return 0, err
+	}
+
+	purged, _ := res.RowsAffected()
+
+	return int(purged), nil
+}
+
+func (s *sqliteDB) revokeRefrFamily(familyID string) error {
+	_, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, familyID)
+
+	return err
+}
+
+func (s *sqliteDB) removeRefrToken(tokenHash string) error {
+	res, err := s.db.Exec(`DELETE FROM refresh_tokens WHERE token_hash = ?`, tokenHash)
+
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errTokenNotFound
+	}
+
+	return nil
+}
+
+// Copies an existing database.json into an empty SQLite database in one transaction.
+// The file is only read, along with its journal if a crash left one behind, and
+// upgraded in memory.
+func (s *sqliteDB) importJSON(path string) error {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	entries, err := (&DB{path: path}).readJournal()
+
+	if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		if data, err = applyJournal(data, entries); err != nil {
+			return fmt.Errorf("database file %s is corrupt: %w", path, err)
+		}
+	}
+
+	dbstruct, err := decodeDBStructure(data)
+
+	if err != nil {
+		return fmt.Errorf("database file %s is corrupt: %w", path, err)
+	}
+
+	upgradeDBStructure(&dbstruct)
+
+	var existing int
+
+	err = s.db.QueryRow(`SELECT (SELECT COUNT(*) FROM users) + (SELECT COUNT(*) FROM chirps) + (SELECT COUNT(*) FROM refresh_tokens)`).Scan(&existing)
+
+	if err != nil {
+		return err
+	}
+
+	if existing > 0 {
+		return errors.New("sqlite database is not empty, refusing to import")
+	}
+
+	tx, err := s.db.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	for _, usr := range dbstruct.Users {
+		_, err := tx.Exec(`INSERT INTO users (id, uuid, email, password, is_chirpy_red, created_at, updated_at, is_banned, role, handle) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			usr.ID, usr.UUID, usr.Email, usr.Password, usr.Is_Chirpy_Red, usr.Created_At.UTC(), usr.Updated_At.UTC(), usr.Is_Banned, usr.Role, usr.Handle)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, val := range dbstruct.Chirps {
+		var deletedAt any
+
+		if val.Deleted_At != nil {
+			deletedAt = val.Deleted_At.UTC()
+		}
+
+		_, err := tx.Exec(`INSERT INTO chirps (id, uuid, author_id, body, created_at, updated_at, edited, deleted_at, in_reply_to, flagged, media, entities) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			val.ID, val.UUID, val.Author_ID, val.Chirp, val.Created_At.UTC(), val.Updated_At.UTC(), val.Edited, deletedAt, nullableChirpID(val.In_Reply_To), val.Flagged,
+			strings.Join(val.Media_IDs, ","), encodeEntities(val.Entities))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, following := range dbstruct.Follows {
+		for _, val := range following {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO follows (follower_id, followee_id, created_at) VALUES (?, ?, ?)`,
+				val.Follower_ID, val.Followee_ID, val.Created_At.UTC())
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, reactions := range dbstruct.Reactions {
+		for _, val := range reactions {
+			_, err := tx.Exec(`INSERT OR IGNORE INTO reactions (kind, user_id, chirp_id, created_at) VALUES (?, ?, ?, ?)`,
+				val.Kind, val.User_ID, val.Chirp_ID, val.Created_At.UTC())
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, reports := range dbstruct.Reports {
+		for _, val := range reports {
+			var resolvedAt any
+
+			if val.Resolved_At != nil {
+				resolvedAt = val.Resolved_At.UTC()
+			}
+
+			_, err := tx.Exec(`INSERT OR IGNORE INTO reports (chirp_id, reporter_id, reason, created_at, resolved_at) VALUES (?, ?, ?, ?, ?)`,
+				val.Chirp_ID, val.Reporter_ID, val.Reason, val.Created_At.UTC(), resolvedAt)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, val := range dbstruct.Audit_Log {
+		_, err := tx.Exec(`INSERT INTO audit_log (id, moderator_id, action, chirp_id, author_id, body, note, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			val.ID, val.Moderator_ID, val.Action, val.Chirp_ID, val.Author_ID, val.Chirp, val.Note, val.Created_At.UTC())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, val := range dbstruct.Media {
+		_, err := tx.Exec(`INSERT INTO media (id, uploader_id, content_type, size, width, height, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			val.ID, val.Uploader_ID, val.Content_Type, val.Size, val.Width, val.Height, val.Created_At.UTC())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, revisions := range dbstruct.Revisions {
+		for _, val := range revisions {
+			_, err := tx.Exec(`INSERT INTO chirp_revisions (chirp_id, revision, body, created_at) VALUES (?, ?, ?, ?)`,
+				val.Chirp_ID, val.Revision, val.Chirp, val.Created_At.UTC())
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, val := range dbstruct.Refresh_Tokens {
+		var rotatedAt any
+
+		if val.Rotated_At != nil {
+			rotatedAt = val.Rotated_At.UTC()
+		}
+
+		_, err := tx.Exec(`INSERT OR IGNORE INTO refresh_tokens (token_hash, user_id, expiry_time, family_id, rotated_at, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			val.Token_Hash, val.ID, val.Expiry_Time.UTC(), val.Family_ID, rotatedAt, val.User_Agent, val.IP, val.Created_At.UTC(), val.Last_Used_At.UTC())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Carry over the high-water marks so IDs of records deleted before the import aren't reused
+	for table, seq := range map[string]int{"chirps": dbstruct.Chirp_Seq, "users": dbstruct.User_Seq, "audit_log": dbstruct.Audit_Seq} {
+		_, err := tx.Exec(`DELETE FROM sqlite_sequence WHERE name = ? AND seq < ?`, table, seq)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = ?)`, table, seq, table)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestImportJSONOnlyReadsTheSource(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "database.json")
+
+	// A file from before roles and UUIDs, with a write that only made it to the journal
+	original := []byte(`{"chirps":{},"users":{"1":{"id":1,"email":"old@example.com","password":"cGFzc3dvcmQ="}}}`)
+
+	if err := os.WriteFile(source, original, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal := []byte(`[{"field":"users","key":"2","value":{"id":2,"email":"journaled@example.com","password":"cGFzc3dvcmQ="}}]` + "\n")
+
+	if err := os.WriteFile(source+".journal", journal, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := newSQLiteDB(filepath.Join(dir, "database.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.db.Close()
+
+	if err := s.importJSON(source); err != nil {
+		t.Fatal(err)
+	}
+
+	for id, email := range map[int]string{1: "old@example.com", 2: "journaled@example.com"} {
+		usr, err := s.getUsrByID(id)
+
+		if err != nil {
+			t.Fatalf("user %d: %v", id, err)
+		}
+
+		if usr.Email != email || usr.Role != roleUser || usr.UUID == "" {
+			t.Errorf("user %d imported as %+v", id, usr)
+		}
+	}
+
+	if data, _ := os.ReadFile(source); !bytes.Equal(data, original) {
+		t.Errorf("source rewritten to %s", data)
+	}
+
+	if data, _ := os.ReadFile(source + ".journal"); !bytes.Equal(data, journal) {
+		t.Errorf("journal rewritten to %q", data)
+	}
+}
+
+func TestImportJSONFailsOnMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.json")
+
+	s, err := newSQLiteDB(filepath.Join(dir, "database.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.db.Close()
+
+	if err := s.importJSON(missing); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+
+	for _, path := range []string{missing, missing + ".journal"} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("import created %s", path)
+		}
+	}
+}
+
+func TestSQLiteHashesLegacyRefreshTokens(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.db")
+	tokens := []string{"legacy-token-one", "legacy-token-two"}
+
+	// A database as it was before migration 15, with the tokens stored as they are
+	old, err := sql.Open("sqlite3_chirpy", path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := old.Exec(`CREATE TABLE schema_migrations (version INTEGER PRIMARY KEY, applied_at DATETIME NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+
+	for version := 1; version <= 14; version++ {
+		if _, err := old.Exec(sqliteMigrations[version-1]); err != nil {
+			t.Fatalf("migration %d: %v", version, err)
+		}
+
+		if _, err := old.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().UTC()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := old.Exec(`INSERT INTO users (uuid, email, password) VALUES (?, 'old@example.com', 'x')`, uuid.NewString()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range tokens {
+		_, err := old.Exec(`INSERT INTO refresh_tokens (refresh_token, user_id, expiry_time, family_id) VALUES (?, 1, ?, ?)`,
+			token, time.Now().Add(time.Hour).UTC(), uuid.NewString())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	old.Close()
+
+	s, err := newSQLiteDB(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.db.Close()
+
+	for _, token := range tokens {
+		stored, err := s.getRefrByHash(hashRefreshToken(token))
+
+		if err != nil {
+			t.Fatalf("%s: %v", token, err)
+		}
+
+		if stored.ID != 1 || stored.Token_Hash != hashRefreshToken(token) {
+			t.Errorf("%s migrated as %+v", token, stored)
+		}
+
+		if _, err := s.getRefrByHash(token); err != errTokenNotFound {
+			t.Errorf("%s can still be looked up as it is: %v", token, err)
+		}
+	}
+
+	// Secure delete means the dropped table doesn't linger in free pages
+	checkNoPlaintextTokens(t, dir, tokens...)
+
+	handler := newTestAPI(t, s).routes()
+
+	if code, _ := refresh(t, handler, tokens[0]); code != http.StatusOK {
+		t.Fatalf("refreshing with a migrated token: %d", code)
+	}
+
+	if code, _ := refresh(t, handler, tokens[0]); code != http.StatusUnauthorized {
+		t.Errorf("migrated token reused: got %d, want 401", code)
+	}
+}
+
+func TestImportJSONHashesLegacyRefreshTokens(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "database.json")
+	tokens := []string{"legacy-token-one", "legacy-token-two"}
+
+	writeLegacyTokenFile(t, source, tokens...)
+
+	dest := t.TempDir()
+	s, err := newSQLiteDB(filepath.Join(dest, "database.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.db.Close()
+
+	if err := s.importJSON(source); err != nil {
+		t.Fatal(err)
+	}
+
+	families := map[string]bool{}
+
+	for _, token := range tokens {
+		stored, err := s.getRefrByHash(hashRefreshToken(token))
+
+		if err != nil {
+			t.Fatalf("%s: %v", token, err)
+		}
+
+		if stored.Family_ID == "" || families[stored.Family_ID] {
+			t.Errorf("%s imported as %+v", token, stored)
+		}
+
+		families[stored.Family_ID] = true
+	}
+
+	checkNoPlaintextTokens(t, dest, tokens...)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errChirpNotFound = errors.New("chirp not found")
+	errChirpGone     = errors.New("chirp has been deleted")
+	errUserNotFound  = errors.New("user not found")
+	errTokenNotFound = errors.New("token not found")
+	errTokenReused   = errors.New("refresh token has already been used, log in again")
+	errEmailExists   = errors.New("email already exists")
+	errHandleExists  = errors.New("handle already taken")
+	errMediaNotFound = errors.New("media not found")
+)
+
+// chirpQuery describes which chirps listChirps returns and in what order
+type chirpQuery struct {
+	// 0 means every author
+	Author_ID int
+	// Only chirps by one of these authors, nil means every author
+	Author_IDs []int
+	// sortByCreatedAt or sortByID
+	Sort_By string
+	Desc    bool
+	// Only chirps that come after this one in the chosen order
+	After *chirpCursor
+	// 0 means no limit
+	Limit int
+	// List chirps in the trash instead of live ones
+	Trashed bool
+	// List live chirps held for review instead of public ones
+	Held bool
+}
+
+// Store is the persistence layer behind the handlers. apiConfig holds a single
+// Store, so a backend can be swapped out without touching the HTTP layer.
+type Store interface {
+	// Every chirp that isn't in the trash or held for review
+	getAllChirps() ([]chirp, error)
+	listChirps(query chirpQuery) ([]chirp, error)
+	getChirp(id int) (chirp, error)
+	getChirpByUUID(uuid string) (chirp, error)
+	// Assigns the chirp a new ID and stores it in one step
+	insertChirp(chirp chirp) (chirp, error)
+	deleteChirp(id int) error
+	// Moves the chirp to the trash, or takes it back out when deletedAt is nil
+	setChirpDeleted(id int, deletedAt *time.Time) (chirp, error)
+	// Hard deletes chirps that went in the trash before the cutoff, returning how many
+	purgeDeletedChirps(before time.Time) (int, error)
+	// Saves the current body as a revision and replaces it, along with the entities found in it.
+	// flag holds the chirp for review in the same step, a flag is never cleared here.
+	updateChirpBody(id int, body string, entities []entity, flag bool, editedAt time.Time) (chirp, error)
+	// Marks the chirp as held for review, or clears the mark
+	setChirpFlagged(id int, flagged bool) (chirp, error)
+	// Earlier bodies of the chirp, oldest first
+	getChirpRevisions(id int) ([]chirpRevision, error)
+	// Direct replies to the chirp, including ones in the trash, oldest first
+	getReplies(id int) ([]chirp, error)
+
+	getUsrByID(id int) (user, error)
+	getUsrByUUID(uuid string) (user, error)
+	getByEmail(email string) (user, bool)
+	// Takes a handle as normaliseHandle returns it, users without one are never found
+	getByHandle(handle string) (user, bool)
+	// Assigns the user a new ID and stores it, failing if the email or handle is taken
+	insertUser(user user) (user, error)
+	// Loads the user, lets fn change it and saves it in one step, so changes made
+	// at the same time aren't lost. An error from fn leaves the user as it was.
+	updateUser(id int, fn func(*user) error) (user, error)
+
+	// Following someone twice is the same as following them once
+	addFollow(followerID, followeeID int, followedAt time.Time) error
+	// Unfollowing someone who isn't followed does nothing
+	removeFollow(followerID, followeeID int) error
+	// Who follows the user, most recent first
+	getFollowers(userID int) ([]follow, error)
+	// Who the user follows, most recent first
+	getFollowing(userID int) ([]follow, error)
+	getAllFollows() ([]follow, error)
+
+	// Reacting to the same chirp twice is the same as reacting once
+	addReaction(val reaction) error
+	// Removing a reaction that isn't there does nothing
+	removeReaction(kind string, userID, chirpID int) error
+	// Reactions of one kind by the user, most recent first
+	getUserReactions(kind string, userID int) ([]reaction, error)
+
+	// Reporting the same chirp again replaces the earlier report and reopens it
+	addReport(val report) error
+	// Reports no moderator has acted on yet, oldest first
+	getOpenReports() ([]report, error)
+	resolveReports(chirpID int, resolvedAt time.Time) error
+	// Assigns the entry the next ID and stores it
+	appendAuditEntry(entry auditEntry) (auditEntry, error)
+	// Newest first
+	getAuditLog() ([]auditEntry, error)
+
+	// Storing media that's already there keeps the first upload
+	addMedia(val media) error
+	getMedia(id string) (media, error)
+
+	// Tokens are only ever stored and looked up by their hash, see hashRefreshToken
+	getRefrByHash(tokenHash string) (DB_Refr_Token, error)
+	appendDBRefrToken(refrToken DB_Refr_Token) error
+	removeRefrToken(tokenHash string) error
+	// Marks a token as replaced and stores next in its place, in the same family.
+	// A token can only be rotated once, after that it's errTokenReused.
+	rotateRefrToken(tokenHash string, next DB_Refr_Token) error
+	revokeRefrFamily(familyID string) error
+	// A session is a family of refresh tokens, these return the token currently in use for it
+	getSession(familyID string) (DB_Refr_Token, error)
+	// Most recently used first
+	getUserSessions(userID int) ([]DB_Refr_Token, error)
+	// Removes tokens that expired before the cutoff, returning how many
+	purgeExpiredRefrTokens(before time.Time) (int, error)
+}
+
+// Picks the backend named by the DB_DRIVER env variable, defaulting to the JSON file.
+// An empty path falls back to the default location for that backend.
+func openStore(driver, path string) (Store, error) {
+	switch driver {
+	case "", "json":
+		if path == "" {
+			path = pathToDB
+		}
+		return newDB(path)
+	case "sqlite":
+		if path == "" {
+			path = pathToSQLiteDB
+		}
+		return newSQLiteDB(path)
+	case "memory":
+		return newMemDB(), nil
+	}
+
+	return nil, errors.New("unknown database driver: " + driver)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+)
+
+const (
+	defaultThreadDepth = 10
+	maxThreadDepth     = 50
+	// How many chirps a thread response holds, the root included
+	defaultThreadLimit = 200
+	maxThreadLimit     = 1000
+)
+
+var (
+	errParentNotFound = &validationError{Code: "parent_not_found", Msg: "chirp being replied to not found"}
+	errParentGone     = &validationError{Code: "parent_gone", Msg: "chirp being replied to has been deleted"}
+)
+
+// threadNode is a chirp and the replies under it
+type threadNode struct {
+	Chirp   chirp        `json:"chirp"`
+	Replies []threadNode `json:"replies"`
+	// There are replies past the depth or node limit that were left out
+	More_Replies bool `json:"more_replies,omitempty"`
+	// Set when the node limit cut the replies short, passed as ?cursor to this
+	// chirp's thread it picks up after the last reply here
+	Next_Cursor string `json:"next_cursor,omitempty"`
+}
+
+// Reads ?depth, how many levels of replies to include below the root
+func parseThreadDepth(query url.Values) (int, error) {
+	strDepth := query.Get("depth")
+
+	if strDepth == "" {
+		return defaultThreadDepth, nil
+	}
+
+	depth, err := strconv.Atoi(strDepth)
+
+	if err != nil || depth < 0 {
+		return 0, errors.New("invalid depth")
+	}
+
+	return min(depth, maxThreadDepth), nil
+}
+
+// Reads ?limit, how many chirps to return at most. The root and one reply are
+// the least, so paging through a thread always makes progress.
+func parseThreadLimit(query url.Values) (int, error) {
+	strLimit := query.Get("limit")
+
+	if strLimit == "" {
+		return defaultThreadLimit, nil
+	}
+
+	limit, err := strconv.Atoi(strLimit)
+
+	if err != nil || limit < 2 {
+		return 0, errors.New("invalid limit")
+	}
+
+	return min(limit, maxThreadLimit), nil
+}
+
+// Deleted chirps and ones held for review are only shown as tombstones in threads
+func hiddenInThread(val chirp) bool {
+	return val.Deleted_At != nil || val.Flagged
+}
+
+// What's left of a deleted chirp in a thread, enough to keep its replies in place
+func tombstoneChirp(val chirp) chirp {
+	return chirp{
+		ID:               val.ID,
+		UUID:             val.UUID,
+		Created_At:       val.Created_At,
+		Updated_At:       val.Updated_At,
+		Deleted_At:       val.Deleted_At,
+		In_Reply_To:      val.In_Reply_To,
+		In_Reply_To_UUID: val.In_Reply_To_UUID,
+		Reply_Count:      val.Reply_Count,
+		Flagged:          val.Flagged,
+	}
+}
+
+// Builds the reply tree under root, depth levels deep and at most limit chirps
+// big, starting from the first reply to root after the cursor. Hidden chirps
+// only stay in the tree as tombstones while there are replies under them.
+func (apicfg *apiConfig) buildThread(root chirp, depth, limit int, after *chirpCursor) (threadNode, error) {
+	budget := limit - 1
+
+	return apicfg.buildThreadNode(root, depth, after, &budget)
+}
+
+// Fills in one node of a thread, budget is how many more chirps the whole tree can take
+func (apicfg *apiConfig) buildThreadNode(root chirp, depth int, after *chirpCursor, budget *int) (threadNode, error) {
+	node := threadNode{Chirp: apicfg.publicChirp(root), Replies: []threadNode{}}
+
+	if hiddenInThread(root) {
+		node.Chirp = apicfg.publicChirp(tombstoneChirp(root))
+	}
+
+	replies, err := apicfg.db.getReplies(root.ID)
+
+	if err != nil {
+		return threadNode{}, err
+	}
+
+	if after != nil {
+		last := chirp{ID: after.ID, Created_At: after.Created_At}
+
+		for len(replies) > 0 && !chirpLess(last, replies[0], sortByCreatedAt) {
+			replies = replies[1:]
+		}
+	}
+
+	if depth == 0 {
+		node.More_Replies = len(replies) > 0
+		return node, nil
+	}
+
+	for i, reply := range replies {
+		if *budget == 0 {
+			node.More_Replies = true
+
+			if i > 0 {
+				node.Next_Cursor = apicfg.encodeCursorAfter(replies[i-1])
+			}
+
+			break
+		}
+
+		*budget--
+
+		child, err := apicfg.buildThreadNode(reply, depth-1, nil, budget)
+
+		if err != nil {
+			return threadNode{}, err
+		}
+
+		// Left out, so it doesn't count towards the limit
+		if hiddenInThread(child.Chirp) && len(child.Replies) == 0 && !child.More_Replies {
+			*budget++
+			continue
+		}
+
+		node.Replies = append(node.Replies, child)
+	}
+
+	return node, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A user who can chirp through the API, with a helper to post replies
+type threadAuthor struct {
+	t       *testing.T
+	handler http.Handler
+	token   string
+}
+
+func newThreadAuthor(t *testing.T, handler http.Handler, email string) threadAuthor {
+	t.Helper()
+
+	return threadAuthor{t: t, handler: handler, token: signup(t, handler, email).Token}
+}
+
+func (author threadAuthor) post(body string, parent chirp) chirp {
+	author.t.Helper()
+
+	params := map[string]string{"body": body}
+
+	if parent.UUID != "" {
+		params["in_reply_to"] = parent.UUID
+	}
+
+	created := chirp{}
+
+	if code := doRequest(author.t, author.handler, http.MethodPost, "/api/chirps", author.token, params, &created); code != http.StatusCreated {
+		author.t.Fatalf("chirping %q: %d", body, code)
+	}
+
+	return created
+}
+
+// Writes a thread as nested bodies, "R(A(A1) B)", with tombstones as "-" and
+// cut off nodes marked with "+"
+func describeThread(node threadNode) string {
+	out := node.Chirp.Chirp
+
+	if out == "" {
+		out = "-"
+	}
+
+	if node.More_Replies {
+		out += "+"
+	}
+
+	if len(node.Replies) == 0 {
+		return out
+	}
+
+	children := []string{}
+
+	for _, reply := range node.Replies {
+		children = append(children, describeThread(reply))
+	}
+
+	return out + "(" + strings.Join(children, " ") + ")"
+}
+
+func getThread(t *testing.T, handler http.Handler, path string) (int, threadNode) {
+	t.Helper()
+
+	// Errors decode into an empty node
+	node := threadNode{}
+	code := doRequest(t, handler, http.MethodGet, path, "", nil, &node)
+
+	return code, node
+}
+
+func TestThreadTree(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	author := newThreadAuthor(t, handler, "author@example.com")
+
+	root := author.post("R", chirp{})
+	a := author.post("A", root)
+	author.post("B", root)
+	a1 := author.post("A1", a)
+	a1a := author.post("A1a", a1)
+	author.post("C", chirp{})
+
+	path := "/api/chirps/" + root.UUID + "/thread"
+
+	cases := []struct {
+		query string
+		want  string
+	}{
+		{"", "R(A(A1(A1a)) B)"},
+		{"?depth=0", "R+"},
+		{"?depth=1", "R(A+ B)"},
+		{"?depth=2", "R(A(A1+) B)"},
+		{"?depth=1000", "R(A(A1(A1a)) B)"},
+	}
+
+	for _, tc := range cases {
+		code, thread := getThread(t, handler, path+tc.query)
+
+		if code != http.StatusOK {
+			t.Fatalf("%s: %d", tc.query, code)
+		}
+
+		if got := describeThread(thread); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	// Reply counts only take in direct replies
+	_, thread := getThread(t, handler, path)
+	counts := map[string]int{}
+
+	var walk func(node threadNode)
+	walk = func(node threadNode) {
+		counts[node.Chirp.Chirp] = node.Chirp.Reply_Count
+
+		for _, reply := range node.Replies {
+			walk(reply)
+		}
+	}
+
+	walk(thread)
+
+	for body, want := range map[string]int{"R": 2, "A": 1, "B": 0, "A1": 1, "A1a": 0} {
+		if counts[body] != want {
+			t.Errorf("%s has %d replies, want %d", body, counts[body], want)
+		}
+	}
+
+	// A thread can start part way down
+	if _, thread := getThread(t, handler, "/api/chirps/"+a1.UUID+"/thread"); describeThread(thread) != "A1(A1a)" {
+		t.Errorf("thread under A1: got %s", describeThread(thread))
+	}
+
+	for _, query := range []string{"?depth=-1", "?depth=x", "?limit=1", "?limit=x", "?cursor=nonsense"} {
+		if code, _ := getThread(t, handler, path+query); code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want 400", query, code)
+		}
+	}
+
+	if code, _ := getThread(t, handler, "/api/chirps/"+a1a.UUID+"x/thread"); code != http.StatusNotFound {
+		t.Errorf("missing chirp: got %d, want 404", code)
+	}
+}
+
+func TestThreadTombstones(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	author := newThreadAuthor(t, handler, "author@example.com")
+
+	root := author.post("R", chirp{})
+	a := author.post("A", root)
+	b := author.post("B", root)
+	a1 := author.post("A1", a)
+
+	trash := func(val chirp) {
+		t.Helper()
+
+		if code := doRequest(t, handler, http.MethodDelete, "/api/chirps/"+val.UUID, author.token, nil, nil); code != http.StatusNoContent {
+			t.Fatalf("trashing %s: %d", val.Chirp, code)
+		}
+	}
+
+	path := "/api/chirps/" + root.UUID + "/thread"
+
+	// A deleted parent keeps its place while it has replies, a deleted leaf is dropped
+	trash(a)
+	trash(b)
+
+	_, thread := getThread(t, handler, path)
+
+	if got := describeThread(thread); got != "R(-(A1))" {
+		t.Errorf("after trashing A and B: got %s, want R(-(A1))", got)
+	}
+
+	tombstone := thread.Replies[0].Chirp
+
+	if tombstone.UUID != a.UUID || tombstone.Deleted_At == nil || tombstone.Author_ID != 0 || tombstone.Reply_Count != 1 {
+		t.Errorf("tombstone: %+v", tombstone)
+	}
+
+	if thread.Chirp.Reply_Count != 0 {
+		t.Errorf("R counts %d replies, want 0 once both are trashed", thread.Chirp.Reply_Count)
+	}
+
+	// The same goes for the root
+	trash(root)
+
+	if _, thread := getThread(t, handler, path); describeThread(thread) != "-(-(A1))" {
+		t.Errorf("after trashing R: got %s, want -(-(A1))", describeThread(thread))
+	}
+
+	trash(a1)
+
+	if code, _ := getThread(t, handler, path); code != http.StatusGone {
+		t.Errorf("deleted root with nothing left under it: got %d, want 410", code)
+	}
+
+	// Restoring brings the counts back
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+b.UUID+"/restore", author.token, nil, nil); code != http.StatusOK {
+		t.Fatalf("restoring B: %d", code)
+	}
+
+	if _, thread := getThread(t, handler, path); describeThread(thread) != "-(B)" || thread.Chirp.Reply_Count != 1 {
+		t.Errorf("after restoring B: got %s with %d replies", describeThread(thread), thread.Chirp.Reply_Count)
+	}
+}
+
+func TestThreadNodeLimit(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+	author := newThreadAuthor(t, handler, "author@example.com")
+
+	root := author.post("R", chirp{})
+
+	for i := 1; i <= 5; i++ {
+		reply := author.post(fmt.Sprint(i), root)
+		author.post(fmt.Sprintf("%da", i), reply)
+	}
+
+	path := "/api/chirps/" + root.UUID + "/thread?limit=4"
+	pages := []string{}
+
+	for cursor := ""; ; {
+		url := path
+
+		if cursor != "" {
+			url += "&cursor=" + cursor
+		}
+
+		code, thread := getThread(t, handler, url)
+
+		if code != http.StatusOK {
+			t.Fatalf("%s: %d", url, code)
+		}
+
+		pages = append(pages, describeThread(thread))
+		cursor = thread.Next_Cursor
+
+		if cursor == "" {
+			break
+		}
+
+		if len(pages) > 5 {
+			t.Fatalf("still paging after %v", pages)
+		}
+	}
+
+	// Each page holds at most four chirps, a reply whose own replies didn't fit is marked
+	want := []string{"R+(1(1a) 2+)", "R+(3(3a) 4+)", "R(5(5a))"}
+
+	if strings.Join(pages, " | ") != strings.Join(want, " | ") {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+
+	// A node cut off without any of its replies is paged by asking for its own thread
+	_, thread := getThread(t, handler, path)
+
+	if thread.Replies[1].Next_Cursor != "" {
+		t.Errorf("reply 2 has a cursor though none of its replies were sent")
+	}
+
+	if _, sub := getThread(t, handler, "/api/chirps/"+thread.Replies[1].Chirp.UUID+"/thread?limit=4"); describeThread(sub) != "2(2a)" {
+		t.Errorf("thread under 2: got %s", describeThread(sub))
+	}
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimelineSize        = 800
+	defaultTimelineFanoutLimit = 10000
+)
+
+// timelineCache keeps every user's home timeline materialised in memory. New
+// chirps are pushed into their followers' timelines as they're written, except
+// for authors with more than fanoutLimit followers: pushing to all of them would
+// make posting slow, so their chirps are fetched and merged in when a timeline
+// is read instead. Timelines only hold the newest size chirps; pages past that
+// come from storage.
+type timelineCache struct {
+	mux *sync.RWMutex
+	db  Store
+	// Newest chirps from the people each user follows, by user ID
+	timelines map[int]*timeline
+	// How many followers each user has, by user ID
+	followerCounts map[int]int
+	size           int
+	fanoutLimit    int
+}
+
+type timeline struct {
+	// Newest first
+	entries []timelineEntry
+	// Older entries were dropped to stay within size, so the timeline can't
+	// answer for anything past its last entry
+	truncated bool
+}
+
+// Only enough of a chirp to order it, the chirp itself is loaded when read so
+// edits and deletes show up without touching the cache
+type timelineEntry struct {
+	Chirp_ID   int
+	Author_ID  int
+	Created_At time.Time
+}
+
+func newTimelineEntry(val chirp) timelineEntry {
+	return timelineEntry{Chirp_ID: val.ID, Author_ID: val.Author_ID, Created_At: val.Created_At}
+}
+
+// Whether a comes before b in a timeline, the same order as listChirps sorting by created_at descending
+func (a timelineEntry) newerThan(b timelineEntry) bool {
+	return chirpLess(chirp{ID: b.Chirp_ID, Created_At: b.Created_At}, chirp{ID: a.Chirp_ID, Created_At: a.Created_At}, sortByCreatedAt)
+}
+
+// Rebuilds every timeline from the follows and chirps in storage
+func buildTimelineCache(db Store, size, fanoutLimit int) (*timelineCache, error) {
+	cache := &timelineCache{
+		mux:            &sync.RWMutex{},
+		db:             db,
+		timelines:      map[int]*timeline{},
+		followerCounts: map[int]int{},
+		size:           size,
+		fanoutLimit:    fanoutLimit,
+	}
+
+	follows, err := db.getAllFollows()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, val := range follows {
+		cache.followerCounts[val.Followee_ID]++
+	}
+
+	// One pass over the chirps grouped by author, rather than a query per follow
+	chirpArr, err := db.getAllChirps()
+
+	if err != nil {
+		return nil, err
+	}
+
+	byAuthor := map[int][]timelineEntry{}
+
+	for _, val := range chirpArr {
+		if cache.followerCounts[val.Author_ID] > 0 && cache.fannedOut(val.Author_ID) {
+			byAuthor[val.Author_ID] = append(byAuthor[val.Author_ID], newTimelineEntry(val))
+		}
+	}
+
+	for authorID, entries := range byAuthor {
+		sortTimelineEntries(entries)
+
+		// One more than fits, so a timeline knows it's missing older chirps
+		if len(entries) > size+1 {
+			byAuthor[authorID] = entries[:size+1]
+		}
+	}
+
+	for _, val := range follows {
+		tl := cache.timelines[val.Follower_ID]
+
+		if tl == nil {
+			tl = &timeline{entries: []timelineEntry{}}
+			cache.timelines[val.Follower_ID] = tl
+		}
+
+		tl.entries = append(tl.entries, byAuthor[val.Followee_ID]...)
+	}
+
+	for _, tl := range cache.timelines {
+		sortTimelineEntries(tl.entries)
+
+		if len(tl.entries) > size {
+			tl.entries = tl.entries[:size]
+			tl.truncated = true
+		}
+	}
+
+	return cache, nil
+}
+
+func sortTimelineEntries(entries []timelineEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].newerThan(entries[j])
+	})
+}
+
+// Whether an author's chirps are pushed into timelines, rather than merged in on read
+func (cache *timelineCache) fannedOut(authorID int) bool {
+	return cache.followerCounts[authorID] <= cache.fanoutLimit
+}
+
+// Adds entries to a timeline, keeping it in order, free of duplicates and within size
+func (cache *timelineCache) insert(userID int, entries ...timelineEntry) {
+	tl := cache.timelines[userID]
+
+	if tl == nil {
+		tl = &timeline{entries: []timelineEntry{}}
+		cache.timelines[userID] = tl
+	}
+
+	for _, entry := range entries {
+		i := sort.Search(len(tl.entries), func(i int) bool {
+			return !tl.entries[i].newerThan(entry)
+		})
+
+		if i < len(tl.entries) && tl.entries[i].Chirp_ID == entry.Chirp_ID {
+			continue
+		}
+
+		// Older than everything kept, and there may be older chirps missing in between
+		if i == len(tl.entries) && tl.truncated {
+			continue
+		}
+
+		tl.entries = append(tl.entries, timelineEntry{})
+		copy(tl.entries[i+1:], tl.entries[i:])
+		tl.entries[i] = entry
+	}
+
+	if len(tl.entries) > cache.size {
+		tl.entries = tl.entries[:cache.size]
+		tl.truncated = true
+	}
+}
+
+// Removes an author's chirps from a timeline
+func (cache *timelineCache) removeAuthor(userID, authorID int) {
+	tl := cache.timelines[userID]
+
+	if tl == nil {
+		return
+	}
+
+	kept := []timelineEntry{}
+
+	for _, entry := range tl.entries {
+		if entry.Author_ID != authorID {
+			kept = append(kept, entry)
+		}
+	}
+
+	tl.entries = kept
+}
+
+// Pulls an author's newest chirps from storage into a timeline, one more than
+// fits so the timeline is marked truncated if the author has older ones
+func (cache *timelineCache) loadAuthor(userID, authorID int) error {
+	chirpArr, err := cache.db.listChirps(chirpQuery{Author_ID: authorID, Sort_By: sortByCreatedAt, Desc: true, Limit: cache.size + 1})
+
+	if err != nil {
+		return err
+	}
+
+	entries := []timelineEntry{}
+
+	for _, val := range chirpArr {
+		entries = append(entries, newTimelineEntry(val))
+	}
+
+	cache.insert(userID, entries...)
+
+	return nil
+}
+
+// Pushes a new chirp into its author's followers' timelines
+func (cache *timelineCache) fanOut(val chirp) error {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if !cache.fannedOut(val.Author_ID) {
+		return nil
+	}
+
+	followers, err := cache.db.getFollowers(val.Author_ID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range followers {
+		cache.insert(f.Follower_ID, newTimelineEntry(val))
+	}
+
+	return nil
+}
+
+// Takes a chirp back out of its author's followers' timelines, for when it's deleted
+func (cache *timelineCache) removeChirp(val chirp) error {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	if !cache.fannedOut(val.Author_ID) {
+		return nil
+	}
+
+	followers, err := cache.db.getFollowers(val.Author_ID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, f := range followers {
+		tl := cache.timelines[f.Follower_ID]
+
+		if tl == nil {
+			continue
+		}
+
+		for i, entry := range tl.entries {
+			if entry.Chirp_ID == val.ID {
+				tl.entries = append(tl.entries[:i], tl.entries[i+1:]...)
+				break
+			}
+		}
+	}
+
+	return nil
+}
+
+// Records a new follow, called after it's been stored
+func (cache *timelineCache) followed(followerID, followeeID int) error {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	wasFannedOut := cache.fannedOut(followeeID)
+
+	followers, err := cache.recount(followeeID)
+
+	if err != nil {
+		return err
+	}
+
+	if wasFannedOut && !cache.fannedOut(followeeID) {
+		// Too many followers to keep pushing to, their chirps are read from storage from now on
+		for _, f := range followers {
+			cache.removeAuthor(f.Follower_ID, followeeID)
+		}
+		return nil
+	}
+
+	if !cache.fannedOut(followeeID) {
+		return nil
+	}
+
+	return cache.loadAuthor(followerID, followeeID)
+}
+
+// Records a removed follow, called after it's been stored
+func (cache *timelineCache) unfollowed(followerID, followeeID int) error {
+	cache.mux.Lock()
+	defer cache.mux.Unlock()
+
+	wasFannedOut := cache.fannedOut(followeeID)
+
+	followers, err := cache.recount(followeeID)
+
+	if err != nil {
+		return err
+	}
+
+	cache.removeAuthor(followerID, followeeID)
+
+	if !wasFannedOut && cache.fannedOut(followeeID) {
+		// Back under the limit, so their followers' timelines need their chirps again
+		for _, f := range followers {
+			if err := cache.loadAuthor(f.Follower_ID, followeeID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Updates a user's follower count from storage, as following twice doesn't add a follower
+func (cache *timelineCache) recount(userID int) ([]follow, error) {
+	followers, err := cache.db.getFollowers(userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cache.followerCounts[userID] = len(followers)
+
+	return followers, nil
+}
+
+// Up to limit chirp IDs from a user's cached timeline after the cursor. ok is
+// false when the cache can't tell what comes next and storage has to be asked.
+func (cache *timelineCache) page(userID int, after *chirpCursor, limit int) (ids []int, ok bool) {
+	cache.mux.RLock()
+	defer cache.mux.RUnlock()
+
+	tl := cache.timelines[userID]
+
+	if tl == nil {
+		return []int{}, true
+	}
+
+	start := 0
+
+	if after != nil {
+		cursor := timelineEntry{Chirp_ID: after.ID, Created_At: after.Created_At}
+
+		start = sort.Search(len(tl.entries), func(i int) bool {
+			return cursor.newerThan(tl.entries[i])
+		})
+	}
+
+	ids = []int{}
+
+	for _, entry := range tl.entries[start:] {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, entry.Chirp_ID)
+	}
+
+	if len(ids) < limit && tl.truncated {
+		return nil, false
+	}
+
+	return ids, true
+}
+
+// Which of the authors a user follows are merged in on read rather than fanned out
+func (cache *timelineCache) readAuthors(authorIDs []int) (fannedOut, onRead []int) {
+	cache.mux.RLock()
+	defer cache.mux.RUnlock()
+
+	fannedOut = []int{}
+	onRead = []int{}
+
+	for _, id := range authorIDs {
+		if cache.fannedOut(id) {
+			fannedOut = append(fannedOut, id)
+		} else {
+			onRead = append(onRead, id)
+		}
+	}
+
+	return fannedOut, onRead
+}
+
+// Loads the chirps a cached page points to. ok is false if any of them have
+// been deleted since, as the page would come up short.
+func (apicfg *apiConfig) loadTimelinePage(ids []int) (chirpArr []chirp, ok bool, err error) {
+	chirpArr = []chirp{}
+
+	for _, id := range ids {
+		val, err := apicfg.db.getChirp(id)
+
+		if errors.Is(err, errChirpNotFound) {
+			return nil, false, nil
+		}
+
+		if err != nil {
+			return nil, false, err
+		}
+
+		if val.Deleted_At != nil || val.Flagged {
+			return nil, false, nil
+		}
+
+		chirpArr = append(chirpArr, val)
+	}
+
+	return chirpArr, true, nil
+}
+
+// Chirps by the people userID follows, newest first, the page after the cursor
+func (apicfg *apiConfig) homeTimeline(userID int, limit int, after *chirpCursor) ([]chirp, error) {
+	following, err := apicfg.db.getFollowing(userID)
+
+	if err != nil {
+		return []chirp{}, err
+	}
+
+	if len(following) == 0 {
+		return []chirp{}, nil
+	}
+
+	authorIDs := []int{}
+
+	for _, val := range following {
+		authorIDs = append(authorIDs, val.Followee_ID)
+	}
+
+	fannedOut, onRead := apicfg.timelines.readAuthors(authorIDs)
+
+	chirpArr := []chirp{}
+	ok := false
+
+	if ids, cached := apicfg.timelines.page(userID, after, limit); cached {
+		chirpArr, ok, err = apicfg.loadTimelinePage(ids)
+
+		if err != nil {
+			return []chirp{}, err
+		}
+	}
+
+	// Fall back to building the page from storage
+	if !ok && len(fannedOut) > 0 {
+		chirpArr, err = apicfg.db.listChirps(chirpQuery{Author_IDs: fannedOut, Sort_By: sortByCreatedAt, Desc: true, After: after, Limit: limit})
+
+		if err != nil {
+			return []chirp{}, err
+		}
+	}
+
+	if len(onRead) > 0 {
+		merged, err := apicfg.db.listChirps(chirpQuery{Author_IDs: onRead, Sort_By: sortByCreatedAt, Desc: true, After: after, Limit: limit})
+
+		if err != nil {
+			return []chirp{}, err
+		}
+
+		chirpArr = append(chirpArr, merged...)
+
+		sort.Slice(chirpArr, func(i, j int) bool {
+			return chirpLess(chirpArr[j], chirpArr[i], sortByCreatedAt)
+		})
+
+		if len(chirpArr) > limit {
+			chirpArr = chirpArr[:limit]
+		}
+	}
+
+	return chirpArr, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Reads a user's whole home timeline, limit chirps a page
+func readTimeline(t *testing.T, handler http.Handler, token string, limit int) []string {
+	t.Helper()
+
+	bodies := []string{}
+	cursor := ""
+
+	for {
+		url := "/api/timeline?limit=" + strconv.Itoa(limit)
+
+		if cursor != "" {
+			url += "&cursor=" + cursor
+		}
+
+		page := chirpPage{}
+
+		if code := doRequest(t, handler, http.MethodGet, url, token, nil, &page); code != http.StatusOK {
+			t.Fatalf("GET %s: %d", url, code)
+		}
+
+		for _, val := range page.Chirps {
+			bodies = append(bodies, val.Chirp)
+		}
+
+		if page.Next_Cursor == "" {
+			return bodies
+		}
+
+		cursor = page.Next_Cursor
+	}
+}
+
+func TestTimelineOrder(t *testing.T) {
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, _ := open()
+			handler := newTestAPI(t, db).routes()
+
+			reader := signup(t, handler, "reader@example.com")
+			users := map[string]threadAuthor{}
+
+			for _, name := range []string{"b", "c", "d"} {
+				users[name] = newThreadAuthor(t, handler, name+"@example.com")
+			}
+
+			follow := func(method string, email string) {
+				t.Helper()
+
+				usr, ok := db.getByEmail(email)
+
+				if !ok {
+					t.Fatalf("no user %s", email)
+				}
+
+				if code := doRequest(t, handler, method, "/api/users/"+usr.UUID+"/follow", reader.Token, nil, nil); code != http.StatusNoContent {
+					t.Fatalf("%s follow %s: %d", method, email, code)
+				}
+			}
+
+			users["d"].post("d1", chirp{})
+			follow(http.MethodPost, "b@example.com")
+			follow(http.MethodPost, "c@example.com")
+
+			users["b"].post("b1", chirp{})
+			users["c"].post("c1", chirp{})
+			b2 := users["b"].post("b2", chirp{})
+			users["d"].post("d2", chirp{})
+
+			// Nothing by the reader or by people they don't follow
+			newThreadAuthor(t, handler, "e@example.com").post("e1", chirp{})
+
+			for _, limit := range []int{1, 2, 10} {
+				if got := readTimeline(t, handler, reader.Token, limit); !slices.Equal(got, []string{"b2", "c1", "b1"}) {
+					t.Errorf("limit %d: got %v, want [b2 c1 b1]", limit, got)
+				}
+			}
+
+			// Following someone brings in what they chirped before
+			follow(http.MethodPost, "d@example.com")
+
+			if got := readTimeline(t, handler, reader.Token, 2); !slices.Equal(got, []string{"d2", "b2", "c1", "b1", "d1"}) {
+				t.Errorf("after following d: got %v", got)
+			}
+
+			follow(http.MethodDelete, "c@example.com")
+
+			if got := readTimeline(t, handler, reader.Token, 2); !slices.Equal(got, []string{"d2", "b2", "b1", "d1"}) {
+				t.Errorf("after unfollowing c: got %v", got)
+			}
+
+			if code := doRequest(t, handler, http.MethodDelete, "/api/chirps/"+b2.UUID, users["b"].token, nil, nil); code != http.StatusNoContent {
+				t.Fatalf("trashing b2: %d", code)
+			}
+
+			if got := readTimeline(t, handler, reader.Token, 2); !slices.Equal(got, []string{"d2", "b1", "d1"}) {
+				t.Errorf("after b2 was trashed: got %v", got)
+			}
+
+			if got := readTimeline(t, handler, users["c"].token, 2); len(got) != 0 {
+				t.Errorf("c follows nobody, got %v", got)
+			}
+
+			if code := doRequest(t, handler, http.MethodGet, "/api/timeline", "", nil, nil); code != http.StatusUnauthorized {
+				t.Errorf("timeline without a token: got %d, want 401", code)
+			}
+		})
+	}
+}
+
+// A store that counts the listChirps queries made through it
+type listCountingStore struct {
+	Store
+	calls int
+}
+
+func (s *listCountingStore) listChirps(query chirpQuery) ([]chirp, error) {
+	s.calls++
+	return s.Store.listChirps(query)
+}
+
+// The chirp IDs a user's cached timeline holds and whether it was cut short
+func cachedTimeline(cache *timelineCache, userID int) ([]int, bool) {
+	cache.mux.RLock()
+	defer cache.mux.RUnlock()
+
+	ids := []int{}
+	tl := cache.timelines[userID]
+
+	if tl == nil {
+		return ids, false
+	}
+
+	for _, entry := range tl.entries {
+		ids = append(ids, entry.Chirp_ID)
+	}
+
+	return ids, tl.truncated
+}
+
+func TestTimelineFanoutLimit(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	timelines, err := buildTimelineCache(apicfg.db, defaultTimelineSize, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apicfg.timelines = timelines
+	handler := apicfg.routes()
+
+	reader := signup(t, handler, "reader@example.com")
+	other := signup(t, handler, "other@example.com")
+	author := newThreadAuthor(t, handler, "author@example.com")
+	authorUser, _ := apicfg.db.getByEmail("author@example.com")
+	path := "/api/users/" + authorUser.UUID + "/follow"
+
+	if code := doRequest(t, handler, http.MethodPost, path, reader.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("following: %d", code)
+	}
+
+	first := author.post("first", chirp{})
+
+	// One follower is within the limit, so the chirp is pushed
+	if ids, _ := cachedTimeline(timelines, reader.ID); !slices.Equal(ids, []int{first.ID}) {
+		t.Errorf("pushed timeline: got %v, want [%d]", ids, first.ID)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, path, other.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("following: %d", code)
+	}
+
+	second := author.post("second", chirp{})
+
+	// Two aren't, the author's chirps are left out of the cache and merged in on read
+	for _, usr := range []jwtResponse{reader, other} {
+		if ids, _ := cachedTimeline(timelines, usr.ID); len(ids) != 0 {
+			t.Errorf("%s's cached timeline past the limit: got %v", usr.Email, ids)
+		}
+
+		if got := readTimeline(t, handler, usr.Token, 1); !slices.Equal(got, []string{"second", "first"}) {
+			t.Errorf("%s's timeline past the limit: got %v", usr.Email, got)
+		}
+	}
+
+	if code := doRequest(t, handler, http.MethodDelete, path, other.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("unfollowing: %d", code)
+	}
+
+	// Back within the limit, the remaining follower's timeline is filled in again
+	if ids, _ := cachedTimeline(timelines, reader.ID); !slices.Equal(ids, []int{second.ID, first.ID}) {
+		t.Errorf("timeline back under the limit: got %v, want [%d %d]", ids, second.ID, first.ID)
+	}
+
+	if got := readTimeline(t, handler, other.Token, 1); len(got) != 0 {
+		t.Errorf("timeline after unfollowing: got %v", got)
+	}
+}
+
+func TestTimelineRebuild(t *testing.T) {
+	const size, fanoutLimit = 3, 2
+
+	for name, open := range stressStores(t) {
+		db, reopen := open()
+
+		if reopen == nil {
+			continue
+		}
+
+		t.Run(name, func(t *testing.T) {
+			apicfg := newTestAPI(t, db)
+			timelines, err := buildTimelineCache(db, size, fanoutLimit)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			apicfg.timelines = timelines
+			handler := apicfg.routes()
+
+			readers := []jwtResponse{}
+
+			for _, email := range []string{"r1@example.com", "r2@example.com", "r3@example.com"} {
+				readers = append(readers, signup(t, handler, email))
+			}
+
+			authors := map[string]threadAuthor{}
+
+			for _, name := range []string{"popular", "prolific", "quiet"} {
+				authors[name] = newThreadAuthor(t, handler, name+"@example.com")
+			}
+
+			follow := func(reader jwtResponse, name string) {
+				t.Helper()
+
+				usr, _ := db.getByEmail(name + "@example.com")
+
+				if code := doRequest(t, handler, http.MethodPost, "/api/users/"+usr.UUID+"/follow", reader.Token, nil, nil); code != http.StatusNoContent {
+					t.Fatalf("%s following %s: %d", reader.Email, name, code)
+				}
+			}
+
+			follow(readers[0], "quiet")
+			authors["quiet"].post("q1", chirp{})
+			follow(readers[0], "prolific")
+			follow(readers[1], "prolific")
+
+			for _, body := range []string{"p1", "p2", "p3", "p4", "p5"} {
+				authors["prolific"].post(body, chirp{})
+			}
+
+			follow(readers[0], "popular")
+			follow(readers[1], "popular")
+			authors["popular"].post("x1", chirp{})
+			// The third follower takes popular past the limit
+			follow(readers[2], "popular")
+			authors["popular"].post("x2", chirp{})
+
+			want := map[string][]string{
+				"r1@example.com": {"x2", "x1", "p5", "p4", "p3", "p2", "p1", "q1"},
+				"r2@example.com": {"x2", "x1", "p5", "p4", "p3", "p2", "p1"},
+				"r3@example.com": {"x2", "x1"},
+			}
+
+			for _, reader := range readers {
+				if got := readTimeline(t, handler, reader.Token, 2); !slices.Equal(got, want[reader.Email]) {
+					t.Errorf("%s before the restart: got %v, want %v", reader.Email, got, want[reader.Email])
+				}
+			}
+
+			counting := &listCountingStore{Store: reopen()}
+			rebuilt, err := buildTimelineCache(counting, size, fanoutLimit)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if counting.calls != 0 {
+				t.Errorf("rebuilding made %d listChirps queries, want none", counting.calls)
+			}
+
+			// Each timeline is the newest chirps by the fanned out authors, popular is read from storage
+			wantCached := map[string][]string{
+				"r1@example.com": {"p5", "p4", "p3"},
+				"r2@example.com": {"p5", "p4", "p3"},
+				"r3@example.com": {},
+			}
+
+			for _, reader := range readers {
+				ids, truncated := cachedTimeline(rebuilt, reader.ID)
+				bodies := []string{}
+
+				for _, id := range ids {
+					val, err := counting.getChirp(id)
+
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					bodies = append(bodies, val.Chirp)
+				}
+
+				if !slices.Equal(bodies, wantCached[reader.Email]) || truncated != (len(bodies) > 0) {
+					t.Errorf("%s: rebuilt %v (truncated %t), want %v", reader.Email, bodies, truncated, wantCached[reader.Email])
+				}
+			}
+
+			restarted := newTestAPI(t, counting.Store)
+			restarted.timelines = rebuilt
+			handler = restarted.routes()
+
+			for _, reader := range readers {
+				if got := readTimeline(t, handler, reader.Token, 2); !slices.Equal(got, want[reader.Email]) {
+					t.Errorf("%s after the restart: got %v, want %v", reader.Email, got, want[reader.Email])
+				}
+			}
+
+			// Following an author with more chirps than fit still pages back to the oldest
+			quiet := authors["quiet"]
+			quiet.handler = handler
+
+			for _, body := range []string{"q2", "q3", "q4", "q5"} {
+				quiet.post(body, chirp{})
+			}
+
+			follow(readers[2], "quiet")
+
+			if got := readTimeline(t, handler, readers[2].Token, 2); !slices.Equal(got, []string{"q5", "q4", "q3", "q2", "x2", "x1", "q1"}) {
+				t.Errorf("after following quiet: got %v", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+const (
+	defaultRestoreWindow = 30 * 24 * time.Hour
+	defaultPurgeInterval = time.Hour
+)
+
+var errRestoreWindowPassed = errors.New("chirp can no longer be restored")
+
+// Moves a chirp to the trash, where its author can restore it until the restore window passes
+func (apicfg *apiConfig) trashChirp(chirpID int) error {
+	now := time.Now().UTC()
+
+	trashed, err := apicfg.db.setChirpDeleted(chirpID, &now)
+
+	if err != nil {
+		return err
+	}
+
+	return apicfg.unpublishChirp(trashed)
+}
+
+func (apicfg *apiConfig) restoreChirp(trashed chirp) (chirp, error) {
+	if trashed.Deleted_At == nil {
+		return trashed, nil
+	}
+
+	if time.Since(*trashed.Deleted_At) > apicfg.restoreWindow {
+		return chirp{}, errRestoreWindowPassed
+	}
+
+	restored, err := apicfg.db.setChirpDeleted(trashed.ID, nil)
+
+	if err != nil {
+		return chirp{}, err
+	}
+
+	if err := apicfg.publishChirp(restored); err != nil {
+		return chirp{}, err
+	}
+
+	return restored, nil
+}
+
+// Hard deletes chirps whose restore window has passed every interval, until ctx is cancelled
+func (apicfg *apiConfig) runChirpPurger(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := apicfg.db.purgeDeletedChirps(time.Now().Add(-apicfg.restoreWindow))
+
+		if err != nil {
+			log.Println("Error purging deleted chirps:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted chirps", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
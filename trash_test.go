@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTrashedChirpsAreGone(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	handler := apicfg.routes()
+
+	for _, email := range []string{"author@example.com", "other@example.com"} {
+		creds := map[string]string{"email": email, "password": "password"}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+			t.Fatalf("creating %s: %d", email, code)
+		}
+	}
+
+	author := login(t, handler, "author@example.com")
+	other := login(t, handler, "other@example.com")
+	created := chirp{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": "regrettable"}, &created); code != http.StatusCreated {
+		t.Fatalf("chirping: %d", code)
+	}
+
+	path := "/api/chirps/" + created.UUID
+
+	if code := doRequest(t, handler, http.MethodDelete, path, other.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("trashing someone else's chirp: got %d, want 403", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodDelete, path, author.Token, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("trashing: %d", code)
+	}
+
+	routes := []struct {
+		method string
+		path   string
+		token  string
+		body   any
+	}{
+		{http.MethodGet, path, "", nil},
+		{http.MethodGet, path + "/revisions", "", nil},
+		{http.MethodGet, path + "/thread", "", nil},
+		{http.MethodPut, path, author.Token, map[string]string{"body": "edited"}},
+		{http.MethodDelete, path, author.Token, nil},
+		{http.MethodPost, path + "/like", other.Token, nil},
+		{http.MethodPost, path + "/rechirp", other.Token, nil},
+	}
+
+	for _, route := range routes {
+		if code := doRequest(t, handler, route.method, route.path, route.token, route.body, nil); code != http.StatusGone {
+			t.Errorf("%s %s on a trashed chirp: got %d, want 410", route.method, route.path, code)
+		}
+	}
+
+	// Replies are a validation error on the new chirp rather than a missing resource
+	reply := map[string]string{"body": "reply", "in_reply_to": created.UUID}
+	resp := errResponse{}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps", other.Token, reply, &resp); code != http.StatusBadRequest || resp.Code != errParentGone.Code {
+		t.Errorf("replying to a trashed chirp: got %d %q, want 400 %q", code, resp.Code, errParentGone.Code)
+	}
+
+	listed := []chirp{}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps", "", nil, &listed); code != http.StatusOK || len(listed) != 0 {
+		t.Errorf("listing chirps: got %d with %d chirps, want none", code, len(listed))
+	}
+
+	trash := []chirp{}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps/trash", author.Token, nil, &trash); code != http.StatusOK || len(trash) != 1 || trash[0].UUID != created.UUID {
+		t.Errorf("author's trash: got %d with %v", code, trash)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps/trash", other.Token, nil, &trash); code != http.StatusOK || len(trash) != 0 {
+		t.Errorf("someone else's trash: got %d with %v", code, trash)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, path+"/restore", other.Token, nil, nil); code != http.StatusForbidden {
+		t.Errorf("restoring someone else's chirp: got %d, want 403", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, path+"/restore", author.Token, nil, nil); code != http.StatusOK {
+		t.Fatalf("restoring: %d", code)
+	}
+
+	// Restoring twice is harmless
+	if code := doRequest(t, handler, http.MethodPost, path+"/restore", author.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("restoring again: got %d, want 200", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, path, "", nil, nil); code != http.StatusOK {
+		t.Errorf("restored chirp: got %d, want 200", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodGet, "/api/chirps/trash", author.Token, nil, &trash); code != http.StatusOK || len(trash) != 0 {
+		t.Errorf("trash after restoring: got %d with %v", code, trash)
+	}
+}
+
+func TestRestoreWindow(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.restoreWindow = time.Hour
+	handler := apicfg.routes()
+
+	creds := map[string]string{"email": "author@example.com", "password": "password"}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/users", "", creds, nil); code != http.StatusCreated {
+		t.Fatalf("creating user: %d", code)
+	}
+
+	author := login(t, handler, "author@example.com")
+	chirps := map[string]chirp{}
+
+	for _, body := range []string{"recent", "stale"} {
+		created := chirp{}
+
+		if code := doRequest(t, handler, http.MethodPost, "/api/chirps", author.Token, map[string]string{"body": body}, &created); code != http.StatusCreated {
+			t.Fatalf("chirping: %d", code)
+		}
+
+		chirps[body] = created
+	}
+
+	recent := time.Now().UTC().Add(-59 * time.Minute)
+	stale := time.Now().UTC().Add(-61 * time.Minute)
+
+	if _, err := apicfg.db.setChirpDeleted(chirps["recent"].ID, &recent); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := apicfg.db.setChirpDeleted(chirps["stale"].ID, &stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+chirps["stale"].UUID+"/restore", author.Token, nil, nil); code != http.StatusGone {
+		t.Errorf("restoring after the window: got %d, want 410", code)
+	}
+
+	if code := doRequest(t, handler, http.MethodPost, "/api/chirps/"+chirps["recent"].UUID+"/restore", author.Token, nil, nil); code != http.StatusOK {
+		t.Errorf("restoring inside the window: got %d, want 200", code)
+	}
+}
+
+func TestPurgeDeletedChirps(t *testing.T) {
+	now := time.Now().UTC()
+
+	for name, open := range stressStores(t) {
+		t.Run(name, func(t *testing.T) {
+			db, reopen := open()
+
+			kept := seedChirp(t, db, now, -30, "kept")
+			recent := seedChirp(t, db, now, -20, "recent")
+			stale := seedChirp(t, db, now, -10, "stale")
+
+			if _, err := db.updateChirpBody(stale.ID, "stale, edited", nil, false, now); err != nil {
+				t.Fatal(err)
+			}
+
+			recentAt := now.Add(-time.Minute)
+			staleAt := now.Add(-2 * time.Hour)
+
+			if _, err := db.setChirpDeleted(recent.ID, &recentAt); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := db.setChirpDeleted(stale.ID, &staleAt); err != nil {
+				t.Fatal(err)
+			}
+
+			purged, err := db.purgeDeletedChirps(now.Add(-time.Hour))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if purged != 1 {
+				t.Errorf("purged %d chirps, want 1", purged)
+			}
+
+			if purged, err := db.purgeDeletedChirps(now.Add(-time.Hour)); err != nil || purged != 0 {
+				t.Errorf("purging again: got %d, %v, want nothing", purged, err)
+			}
+
+			check := func(db Store) {
+				t.Helper()
+
+				if _, err := db.getChirp(stale.ID); err != errChirpNotFound {
+					t.Errorf("purged chirp: got %v, want errChirpNotFound", err)
+				}
+
+				if _, err := db.getChirpRevisions(stale.ID); err != errChirpNotFound {
+					t.Errorf("purged chirp's revisions: got %v, want errChirpNotFound", err)
+				}
+
+				for _, val := range []chirp{kept, recent} {
+					if _, err := db.getChirp(val.ID); err != nil {
+						t.Errorf("%s: %v", val.Chirp, err)
+					}
+				}
+			}
+
+			check(db)
+
+			if reopen != nil {
+				check(reopen())
+			}
+		})
+	}
+}
+
+func TestChirpPurgerStopsOnShutdown(t *testing.T) {
+	apicfg := newTestAPI(t, newMemDB())
+	apicfg.restoreWindow = time.Hour
+
+	stale := seedChirp(t, apicfg.db, time.Now().UTC(), -180, "stale")
+	deletedAt := time.Now().UTC().Add(-2 * time.Hour)
+
+	if _, err := apicfg.db.setChirpDeleted(stale.ID, &deletedAt); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		apicfg.runChirpPurger(ctx, time.Hour)
+		close(done)
+	}()
+
+	// The first pass runs straight away rather than after an interval
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		if _, err := apicfg.db.getChirp(stale.ID); err == errChirpNotFound {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("purger never removed the stale chirp")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purger didn't stop after its context was cancelled")
+	}
+}
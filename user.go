@@ -1,10 +1,36 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Handles are what mentions resolve against, so an email never has to appear in a chirp
+var handlePattern = regexp.MustCompile(`^[a-z0-9_]{1,30}$`)
+
+var errInvalidHandle = &validationError{Code: "invalid_handle", Msg: "a handle is 1 to 30 letters, digits or underscores"}
+
 type user struct {
 	ID            int    `json:"id"`
+	UUID          string `json:"uuid"`
 	Email         string `json:"email"`
 	Password      []byte `json:"password"`
 	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
+	Created_At    time.Time `json:"created_at"`
+	Updated_At    time.Time `json:"updated_at"`
+	Is_Banned     bool      `json:"is_banned"`
+	// One of user, moderator or admin
+	Role string `json:"role"`
+	// What others mention the user by, empty until they pick one
+	Handle string `json:"handle"`
 }
 
 type jsonUser struct {
@@ -13,18 +39,177 @@ type jsonUser struct {
 	//difference is password (string)
 	Password      string `json:"password"`
 	Is_Chirpy_Red bool   `json:"is_chirpy_red"`
+	Handle        string `json:"handle"`
 }
 
 type displayUser struct {
-	ID    int    `json:"id"`
+	// Left out when OPAQUE_IDS is set
+	ID    int    `json:"id,omitempty"`
+	UUID  string `json:"uuid"`
 	Email string `json:"email"`
 	Is_Chirpy_Red bool `json:"is_chirpy_red"`
+	Created_At    time.Time `json:"created_at"`
+	Updated_At    time.Time `json:"updated_at"`
+	Role          string    `json:"role"`
+	Handle        string    `json:"handle,omitempty"`
 }
 
 func (usr *user) omitPassword() displayUser {
 	return displayUser{
 		usr.ID,
+		usr.UUID,
 		usr.Email,
 		usr.Is_Chirpy_Red,
+		usr.Created_At,
+		usr.Updated_At,
+		usr.Role,
+		usr.Handle,
+	}
+}
+
+// The user as clients see it, without their sequential ID when OPAQUE_IDS is set
+func (apicfg *apiConfig) publicUser(usr user) displayUser {
+	display := usr.omitPassword()
+
+	if apicfg.opaqueIDs {
+		display.ID = 0
+	}
+
+	return display
+}
+
+// Handles are case insensitive, so they're stored lowercased
+func normaliseHandle(handle string) (string, error) {
+	handle = strings.ToLower(handle)
+
+	if !handlePattern.MatchString(handle) {
+		return "", errInvalidHandle
+	}
+
+	return handle, nil
+}
+
+// Same as chirpFromParam but for users, returning the internal ID
+func (apicfg *apiConfig) userIDFromParam(param string) (int, error) {
+	if _, err := uuid.Parse(param); err == nil {
+		usr, err := apicfg.db.getUsrByUUID(param)
+		return usr.ID, err
 	}
+
+	id, err := strconv.Atoi(param)
+
+	if err != nil || apicfg.opaqueIDs {
+		return -1, errUserNotFound
+	}
+
+	return id, nil
+}
+
+func (apicfg *apiConfig) validatePotential(body io.ReadCloser) (user, error) {
+	newUser := jsonUser{}
+
+	dec := json.NewDecoder(body)
+
+	err := dec.Decode(&newUser)
+
+	if err != nil {
+		return user{}, errors.New("error decoding request")
+	}
+
+	potUser, exists := apicfg.db.getByEmail(newUser.Email)
+
+	if !exists || bcrypt.CompareHashAndPassword(potUser.Password, []byte(newUser.Password)) != nil {
+		return user{}, errors.New("invalid login details, please try again")
+	}
+
+	if potUser.Is_Banned {
+		return user{}, errUserBanned
+	}
+
+	return potUser, nil
+}
+
+// Decodes the user details in a request, the ID is set by whoever stores it
+func createTempUser(body io.ReadCloser) (user, error) {
+	defer body.Close()
+
+	newUser := jsonUser{}
+
+	finalUser := user{}
+
+	dec := json.NewDecoder(body)
+
+	err := dec.Decode(&newUser)
+
+	if err != nil {
+		return user{}, err
+	}
+
+	finalUser.Password, err = bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+
+	finalUser.Email = newUser.Email
+
+	if err != nil {
+		return user{}, errors.New("error creating password")
+	}
+
+	if newUser.Handle != "" {
+		finalUser.Handle, err = normaliseHandle(newUser.Handle)
+	}
+
+	return finalUser, err
+}
+
+func (apicfg *apiConfig) createUser(body io.ReadCloser) (user, error) {
+	defer body.Close()
+
+	newUser := jsonUser{}
+
+	finalUser := user{
+		UUID:          uuid.NewString(),
+		Is_Chirpy_Red: false,
+		Created_At:    time.Now().UTC(),
+	}
+
+	finalUser.Updated_At = finalUser.Created_At
+
+	dec := json.NewDecoder(body)
+
+	err := dec.Decode(&newUser)
+
+	if err != nil {
+		return user{}, err
+	}
+
+	finalUser.Password, err = bcrypt.GenerateFromPassword([]byte(newUser.Password), bcrypt.DefaultCost)
+
+	if err != nil {
+		return user{}, errors.New("error creating password")
+	}
+
+	finalUser.Email = newUser.Email
+	finalUser.Role = roleUser
+
+	if newUser.Handle != "" {
+		finalUser.Handle, err = normaliseHandle(newUser.Handle)
+
+		if err != nil {
+			return user{}, err
+		}
+	}
+
+	return apicfg.db.insertUser(finalUser)
+}
+
+func (apicfg *apiConfig) updateUser(updatedUser *user, userID int) (user, error) {
+	return apicfg.db.updateUser(userID, func(dbUser *user) error {
+		dbUser.Email = updatedUser.Email
+		dbUser.Password = updatedUser.Password
+		dbUser.Updated_At = time.Now().UTC()
+		// Leaving the handle out keeps the one the user has
+		if updatedUser.Handle != "" {
+			dbUser.Handle = updatedUser.Handle
+		}
+		return nil
+	})
 }
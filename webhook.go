@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
 type webhookBody struct {
 	Event string `json:"event"`
 	Data webhookData
@@ -8,3 +14,29 @@ type webhookBody struct {
 type webhookData struct {
 	ID int `json:"user_id"`
 }
+
+func (apicfg *apiConfig) upgradeUser(id int) error {
+	_, err := apicfg.db.updateUser(id, func(dbUser *user) error {
+		dbUser.Is_Chirpy_Red = true
+		dbUser.Updated_At = time.Now().UTC()
+		return nil
+	})
+
+	return err
+}
+
+func (apicfg *apiConfig) decodeWebhook(data io.ReadCloser) error {
+	webhook := webhookBody{}
+
+	var err error
+
+	defer data.Close()
+
+	json.NewDecoder(data).Decode(&webhook)
+
+	if webhook.Event == "user.upgraded" {
+		err = apicfg.upgradeUser(webhook.Data.ID)
+	}
+
+	return err
+}